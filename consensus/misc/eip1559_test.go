@@ -130,3 +130,32 @@ func TestCalcBaseFee(t *testing.T) {
 		}
 	}
 }
+
+// TestCalcBaseFeeCustomParams tests the base fee derivation with non-mainnet
+// EIP-1559 parameters, as used by some L2 chains.
+func TestCalcBaseFeeCustomParams(t *testing.T) {
+	config := config()
+	config.EIP1559Elasticity = 6
+	config.EIP1559Denominator = 50
+
+	tests := []struct {
+		parentGasUsed   uint64
+		expectedBaseFee int64
+	}{
+		{5000000, params.InitialBaseFee}, // usage == target
+		{0, 980000000},                   // empty parent
+		{6000000, 1004000000},            // usage above target
+		{30000000, 1100000000},           // full parent
+	}
+	for i, test := range tests {
+		parent := &types.Header{
+			Number:   common.Big32,
+			GasLimit: 30000000,
+			GasUsed:  test.parentGasUsed,
+			BaseFee:  big.NewInt(params.InitialBaseFee),
+		}
+		if have, want := CalcBaseFee(config, parent), big.NewInt(test.expectedBaseFee); have.Cmp(want) != 0 {
+			t.Errorf("test %d: have %d  want %d, ", i, have, want)
+		}
+	}
+}
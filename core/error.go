@@ -32,6 +32,10 @@ var (
 	// ErrNoGenesis is returned when there is no Genesis Block.
 	ErrNoGenesis = errors.New("genesis not found in chain")
 
+	// ErrExecutionAborted is returned if the execution of a transaction is
+	// cancelled midway, its state changes are not committed then.
+	ErrExecutionAborted = errors.New("execution aborted")
+
 	errSideChainReceipts = errors.New("side blocks can't be accepted as ancient chain data")
 )
 
@@ -102,6 +102,11 @@ func applyTransaction(msg types.Message, config *params.ChainConfig, author *com
 	if err != nil {
 		return nil, err
 	}
+	// The execution is incomplete if it's cancelled, leave the pending changes
+	// uncommitted for the caller to revert.
+	if evm.Cancelled() {
+		return nil, ErrExecutionAborted
+	}
 
 	// Update the state with pending changes.
 	var root []byte
@@ -151,3 +156,11 @@ func ApplyTransaction(config *params.ChainConfig, bc ChainContext, author *commo
 	vmenv := vm.NewEVM(blockContext, vm.TxContext{}, statedb, config, cfg)
 	return applyTransaction(msg, config, author, gp, statedb, header.Number, header.Hash(), tx, usedGas, vmenv)
 }
+
+// ApplyTransactionWithEVM is identical to ApplyTransaction, but it executes the
+// transaction in the given EVM, e.g. for cancelling the execution. The gas pool
+// is consumed and the state changes are left uncommitted if the execution is
+// cancelled, ErrExecutionAborted is returned then.
+func ApplyTransactionWithEVM(msg types.Message, config *params.ChainConfig, author *common.Address, gp *GasPool, statedb *state.StateDB, header *types.Header, tx *types.Transaction, usedGas *uint64, evm *vm.EVM) (*types.Receipt, error) {
+	return applyTransaction(msg, config, author, gp, statedb, header.Number, header.Hash(), tx, usedGas, evm)
+}
@@ -189,6 +189,12 @@ func (tx *Transaction) decodeTyped(b []byte) (TxData, error) {
 	}
 }
 
+// Time returns the time when the transaction was first seen locally, namely
+// when it was created or decoded.
+func (tx *Transaction) Time() time.Time {
+	return tx.time
+}
+
 // setDecoded sets the inner transaction and size after decoding.
 func (tx *Transaction) setDecoded(inner TxData, size uint64) {
 	tx.inner = inner
@@ -468,6 +474,8 @@ func (s TxByNonce) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 type TxWithMinerFee struct {
 	tx       *Transaction
 	minerFee *big.Int
+	score    int64    // Score of the sender for breaking price ties, higher goes first
+	priority *big.Int // Priority bid of the transaction ranked before the price, nil means none
 }
 
 // NewTxWithMinerFee creates a wrapped transaction, calculating the effective
@@ -490,16 +498,40 @@ type TxByPriceAndTime []*TxWithMinerFee
 
 func (s TxByPriceAndTime) Len() int { return len(s) }
 func (s TxByPriceAndTime) Less(i, j int) bool {
-	// If the prices are equal, use the time the transaction was first seen for
-	// deterministic sorting
+	// The higher priority bid goes first regardless of the price. If the prices
+	// are equal, prefer the higher scored sender, then use the time the
+	// transaction was first seen, and finally the hash for deterministic sorting
+	// even if the times are equal, e.g. the ones without a known arrival
+	if s[i].priority != nil || s[j].priority != nil {
+		if cmp := priorityCmp(s[i].priority, s[j].priority); cmp != 0 {
+			return cmp > 0
+		}
+	}
 	cmp := s[i].minerFee.Cmp(s[j].minerFee)
 	if cmp == 0 {
-		return s[i].tx.time.Before(s[j].tx.time)
+		if s[i].score != s[j].score {
+			return s[i].score > s[j].score
+		}
+		if !s[i].tx.time.Equal(s[j].tx.time) {
+			return s[i].tx.time.Before(s[j].tx.time)
+		}
+		return bytes.Compare(s[i].tx.Hash().Bytes(), s[j].tx.Hash().Bytes()) < 0
 	}
 	return cmp > 0
 }
 func (s TxByPriceAndTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 
+// priorityCmp compares two priority bids, nil is deemed zero.
+func priorityCmp(a, b *big.Int) int {
+	if a == nil {
+		a = common.Big0
+	}
+	if b == nil {
+		b = common.Big0
+	}
+	return a.Cmp(b)
+}
+
 func (s *TxByPriceAndTime) Push(x interface{}) {
 	*s = append(*s, x.(*TxWithMinerFee))
 }
@@ -520,6 +552,9 @@ type TransactionsByPriceAndNonce struct {
 	heads   TxByPriceAndTime                // Next transaction for each unique account (price heap)
 	signer  Signer                          // Signer for the set of transactions
 	baseFee *big.Int                        // Current base fee
+	valuer  func(*Transaction) *big.Int     // Custom transaction valuer, nil means the effective miner tip
+	scorer  func(common.Address) int64      // Sender scorer for breaking price ties, nil means neutral
+	bidder  func(*Transaction) *big.Int     // Priority bid source ranked before the value, nil means none
 }
 
 // NewTransactionsByPriceAndNonce creates a transaction set that can retrieve
@@ -528,28 +563,73 @@ type TransactionsByPriceAndNonce struct {
 // Note, the input map is reowned so the caller should not interact any more with
 // if after providing it to the constructor.
 func NewTransactionsByPriceAndNonce(signer Signer, txs map[common.Address]Transactions, baseFee *big.Int) *TransactionsByPriceAndNonce {
+	return NewTransactionsByValueAndNonce(signer, txs, baseFee, nil, nil)
+}
+
+// NewTransactionsByValueAndNonce creates a transaction set that can retrieve
+// transactions sorted by the given valuer in a nonce-honouring way. If no valuer
+// is provided, transactions are sorted by the effective miner tip. Transactions
+// with a negative effective miner tip are rejected regardless of the valuer.
+//
+// The optional scorer rates the senders, transactions of equal value are ordered
+// by the score of their senders in descending order, before the arrival time.
+//
+// Note, the input map is reowned so the caller should not interact any more with
+// if after providing it to the constructor.
+func NewTransactionsByValueAndNonce(signer Signer, txs map[common.Address]Transactions, baseFee *big.Int, valuer func(*Transaction) *big.Int, scorer func(common.Address) int64) *TransactionsByPriceAndNonce {
+	return NewTransactionsByPriorityAndNonce(signer, txs, baseFee, nil, valuer, scorer)
+}
+
+// NewTransactionsByPriorityAndNonce is identical to NewTransactionsByValueAndNonce,
+// but the transactions are ranked by the priority bids from the given bidder
+// first, e.g. for the priority auctions of L2 sequencers. The value decides only
+// among the equal bids, a missing bid is deemed zero.
+//
+// Note, the input map is reowned so the caller should not interact any more with
+// if after providing it to the constructor.
+func NewTransactionsByPriorityAndNonce(signer Signer, txs map[common.Address]Transactions, baseFee *big.Int, bidder func(*Transaction) *big.Int, valuer func(*Transaction) *big.Int, scorer func(common.Address) int64) *TransactionsByPriceAndNonce {
+	t := &TransactionsByPriceAndNonce{
+		txs:     txs,
+		heads:   make(TxByPriceAndTime, 0, len(txs)),
+		signer:  signer,
+		baseFee: baseFee,
+		valuer:  valuer,
+		scorer:  scorer,
+		bidder:  bidder,
+	}
 	// Initialize a price and received time based heap with the head transactions
-	heads := make(TxByPriceAndTime, 0, len(txs))
 	for from, accTxs := range txs {
 		acc, _ := Sender(signer, accTxs[0])
-		wrapped, err := NewTxWithMinerFee(accTxs[0], baseFee)
+		wrapped, err := t.wrap(acc, accTxs[0])
 		// Remove transaction if sender doesn't match from, or if wrapping fails.
 		if acc != from || err != nil {
 			delete(txs, from)
 			continue
 		}
-		heads = append(heads, wrapped)
+		t.heads = append(t.heads, wrapped)
 		txs[from] = accTxs[1:]
 	}
-	heap.Init(&heads)
+	heap.Init(&t.heads)
+	return t
+}
 
-	// Assemble and return the transaction set
-	return &TransactionsByPriceAndNonce{
-		txs:     txs,
-		heads:   heads,
-		signer:  signer,
-		baseFee: baseFee,
+// wrap wraps the transaction with its value, sender score and priority bid for
+// sorting.
+func (t *TransactionsByPriceAndNonce) wrap(from common.Address, tx *Transaction) (*TxWithMinerFee, error) {
+	wrapped, err := NewTxWithMinerFee(tx, t.baseFee)
+	if err != nil {
+		return nil, err
+	}
+	if t.valuer != nil {
+		wrapped.minerFee = t.valuer(tx)
+	}
+	if t.scorer != nil {
+		wrapped.score = t.scorer(from)
+	}
+	if t.bidder != nil {
+		wrapped.priority = t.bidder(tx)
 	}
+	return wrapped, nil
 }
 
 // Peek returns the next transaction by price.
@@ -564,7 +644,7 @@ func (t *TransactionsByPriceAndNonce) Peek() *Transaction {
 func (t *TransactionsByPriceAndNonce) Shift() {
 	acc, _ := Sender(t.signer, t.heads[0].tx)
 	if txs, ok := t.txs[acc]; ok && len(txs) > 0 {
-		if wrapped, err := NewTxWithMinerFee(txs[0], t.baseFee); err == nil {
+		if wrapped, err := t.wrap(acc, txs[0]); err == nil {
 			t.heads[0], t.txs[acc] = wrapped, txs[1:]
 			heap.Fix(&t.heads, 0)
 			return
@@ -357,6 +357,125 @@ func testTransactionPriceNonceSort(t *testing.T, baseFee *big.Int) {
 	}
 }
 
+// Tests that transactions can be sorted by a custom valuer, here reversing the
+// natural price ordering, while still honouring the nonces of the accounts.
+func TestTransactionValueNonceSort(t *testing.T) {
+	keys := make([]*ecdsa.PrivateKey, 5)
+	for i := 0; i < len(keys); i++ {
+		keys[i], _ = crypto.GenerateKey()
+	}
+	signer := HomesteadSigner{}
+
+	groups := map[common.Address]Transactions{}
+	for start, key := range keys {
+		addr := crypto.PubkeyToAddress(key.PublicKey)
+		for i := 0; i < 3; i++ {
+			tx, _ := SignTx(NewTransaction(uint64(i), common.Address{}, big.NewInt(100), 100, big.NewInt(int64(start+1)), nil), signer, key)
+			groups[addr] = append(groups[addr], tx)
+		}
+	}
+	valuer := func(tx *Transaction) *big.Int {
+		return new(big.Int).Neg(tx.GasPrice())
+	}
+	txset := NewTransactionsByValueAndNonce(signer, groups, nil, valuer, nil)
+
+	txs := Transactions{}
+	for tx := txset.Peek(); tx != nil; tx = txset.Peek() {
+		txs = append(txs, tx)
+		txset.Shift()
+	}
+	if len(txs) != len(keys)*3 {
+		t.Fatalf("expected %d transactions, found %d", len(keys)*3, len(txs))
+	}
+	for i := 1; i < len(txs); i++ {
+		if txs[i-1].GasPrice().Cmp(txs[i].GasPrice()) > 0 {
+			t.Errorf("invalid value ordering: tx #%d (price %v) > tx #%d (price %v)", i-1, txs[i-1].GasPrice(), i, txs[i].GasPrice())
+		}
+		fromi, _ := Sender(signer, txs[i-1])
+		fromj, _ := Sender(signer, txs[i])
+		if fromi == fromj && txs[i-1].Nonce() > txs[i].Nonce() {
+			t.Errorf("invalid nonce ordering: tx #%d (N=%v) > tx #%d (N=%v)", i-1, txs[i-1].Nonce(), i, txs[i].Nonce())
+		}
+	}
+}
+
+// Tests that transactions of the same price are ordered by the sender scores if
+// a scorer is provided, regardless of the time they were first seen.
+func TestTransactionScoreSort(t *testing.T) {
+	keys := make([]*ecdsa.PrivateKey, 5)
+	for i := 0; i < len(keys); i++ {
+		keys[i], _ = crypto.GenerateKey()
+	}
+	signer := HomesteadSigner{}
+
+	groups := map[common.Address]Transactions{}
+	scores := map[common.Address]int64{}
+	for i, key := range keys {
+		addr := crypto.PubkeyToAddress(key.PublicKey)
+
+		tx, _ := SignTx(NewTransaction(0, common.Address{}, big.NewInt(100), 100, big.NewInt(1), nil), signer, key)
+		tx.time = time.Unix(0, int64(i))
+
+		groups[addr] = append(groups[addr], tx)
+		scores[addr] = int64(i)
+	}
+	txset := NewTransactionsByValueAndNonce(signer, groups, nil, nil, func(addr common.Address) int64 { return scores[addr] })
+
+	txs := Transactions{}
+	for tx := txset.Peek(); tx != nil; tx = txset.Peek() {
+		txs = append(txs, tx)
+		txset.Shift()
+	}
+	if len(txs) != len(keys) {
+		t.Fatalf("expected %d transactions, found %d", len(keys), len(txs))
+	}
+	for i := 1; i < len(txs); i++ {
+		fromi, _ := Sender(signer, txs[i-1])
+		fromj, _ := Sender(signer, txs[i])
+		if scores[fromi] < scores[fromj] {
+			t.Errorf("invalid score ordering: tx #%d (S=%d) < tx #%d (S=%d)", i-1, scores[fromi], i, scores[fromj])
+		}
+	}
+}
+
+// Tests that transactions are ordered by the priority bids first if a bidder is
+// provided, regardless of their prices.
+func TestTransactionPrioritySort(t *testing.T) {
+	keys := make([]*ecdsa.PrivateKey, 5)
+	for i := 0; i < len(keys); i++ {
+		keys[i], _ = crypto.GenerateKey()
+	}
+	signer := HomesteadSigner{}
+
+	groups := map[common.Address]Transactions{}
+	bids := map[common.Hash]*big.Int{}
+	for i, key := range keys {
+		addr := crypto.PubkeyToAddress(key.PublicKey)
+
+		// The cheaper transactions bid higher, the last one doesn't bid at all
+		tx, _ := SignTx(NewTransaction(0, common.Address{}, big.NewInt(100), 100, big.NewInt(int64(10+i)), nil), signer, key)
+		groups[addr] = append(groups[addr], tx)
+		if i < len(keys)-1 {
+			bids[tx.Hash()] = big.NewInt(int64(len(keys) - i))
+		}
+	}
+	txset := NewTransactionsByPriorityAndNonce(signer, groups, nil, func(tx *Transaction) *big.Int { return bids[tx.Hash()] }, nil, nil)
+
+	txs := Transactions{}
+	for tx := txset.Peek(); tx != nil; tx = txset.Peek() {
+		txs = append(txs, tx)
+		txset.Shift()
+	}
+	if len(txs) != len(keys) {
+		t.Fatalf("expected %d transactions, found %d", len(keys), len(txs))
+	}
+	for i := 1; i < len(txs); i++ {
+		if priorityCmp(bids[txs[i-1].Hash()], bids[txs[i].Hash()]) < 0 {
+			t.Errorf("invalid priority ordering: tx #%d (B=%v) < tx #%d (B=%v)", i-1, bids[txs[i-1].Hash()], i, bids[txs[i].Hash()])
+		}
+	}
+}
+
 // Tests that if multiple transactions have the same price, the ones seen earlier
 // are prioritized to avoid network spam attacks aiming for a specific ordering.
 func TestTransactionTimeSort(t *testing.T) {
@@ -405,6 +524,52 @@ func TestTransactionTimeSort(t *testing.T) {
 	}
 }
 
+// Tests that the transactions with the same price and time are sorted by hash,
+// the same order is produced regardless of the map iteration.
+func TestTransactionHashSort(t *testing.T) {
+	signer := HomesteadSigner{}
+
+	var txs Transactions
+	for i := 0; i < 8; i++ {
+		key, _ := crypto.GenerateKey()
+		tx, _ := SignTx(NewTransaction(0, common.Address{}, big.NewInt(100), 100, big.NewInt(1), nil), signer, key)
+		tx.time = time.Unix(0, 1)
+		txs = append(txs, tx)
+	}
+	var first Transactions
+	for round := 0; round < 16; round++ {
+		groups := make(map[common.Address]Transactions)
+		for _, tx := range txs {
+			from, _ := Sender(signer, tx)
+			groups[from] = Transactions{tx}
+		}
+		txset := NewTransactionsByPriceAndNonce(signer, groups, nil)
+
+		var sorted Transactions
+		for tx := txset.Peek(); tx != nil; tx = txset.Peek() {
+			sorted = append(sorted, tx)
+			txset.Shift()
+		}
+		if len(sorted) != len(txs) {
+			t.Fatalf("expected %d transactions, found %d", len(txs), len(sorted))
+		}
+		for i := 1; i < len(sorted); i++ {
+			if bytes.Compare(sorted[i-1].Hash().Bytes(), sorted[i].Hash().Bytes()) > 0 {
+				t.Fatalf("invalid hash ordering: tx #%d %x > tx #%d %x", i-1, sorted[i-1].Hash(), i, sorted[i].Hash())
+			}
+		}
+		if first == nil {
+			first = sorted
+			continue
+		}
+		for i := range sorted {
+			if sorted[i].Hash() != first[i].Hash() {
+				t.Fatalf("round %d: unstable ordering at #%d", round, i)
+			}
+		}
+	}
+}
+
 // TestTransactionCoding tests serializing/de-serializing to/from rlp and JSON.
 func TestTransactionCoding(t *testing.T) {
 	key, err := crypto.GenerateKey()
@@ -54,6 +54,11 @@ func (evm *EVM) precompile(addr common.Address) (PrecompiledContract, bool) {
 		precompiles = PrecompiledContractsHomestead
 	}
 	p, ok := precompiles[addr]
+	if ok && evm.Config.DisabledPrecompiles != nil {
+		if _, disabled := evm.Config.DisabledPrecompiles[addr]; disabled {
+			return nil, false
+		}
+	}
 	return p, ok
 }
 
@@ -33,6 +33,11 @@ type Config struct {
 	JumpTable *JumpTable // EVM instruction table, automatically populated if unset
 
 	ExtraEips []int // Additional EIPS that are to be enabled
+
+	// DisabledPrecompiles are the precompiled contracts treated as if they didn't
+	// exist, i.e. as accounts without code, for research only. They are still
+	// warm per EIP-2929 though.
+	DisabledPrecompiles map[common.Address]struct{}
 }
 
 // ScopeContext contains the things that are per-call, such as stack and memory,
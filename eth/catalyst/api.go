@@ -18,8 +18,6 @@
 package catalyst
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/big"
@@ -294,7 +292,11 @@ func (api *ConsensusAPI) ForkchoiceUpdatedV1(update beacon.ForkchoiceStateV1, pa
 			return valid(nil), beacon.InvalidPayloadAttributes.With(err)
 		}
 		id := computePayloadId(update.HeadBlockHash, payloadAttributes)
-		api.localBlocks.put(id, payload)
+		if err := api.localBlocks.put(id, payload, args); err != nil {
+			log.Error("Failed to track payload", "id", id, "err", err)
+			payload.Resolve() // terminate the background building
+			return valid(nil), beacon.GenericServerError.With(err)
+		}
 		return valid(&id), nil
 	}
 	return valid(nil), nil
@@ -445,15 +447,13 @@ func (api *ConsensusAPI) NewPayloadV1(params beacon.ExecutableDataV1) (beacon.Pa
 
 // computePayloadId computes a pseudo-random payloadid, based on the parameters.
 func computePayloadId(headBlockHash common.Hash, params *beacon.PayloadAttributesV1) beacon.PayloadID {
-	// Hash
-	hasher := sha256.New()
-	hasher.Write(headBlockHash[:])
-	binary.Write(hasher, binary.BigEndian, params.Timestamp)
-	hasher.Write(params.Random[:])
-	hasher.Write(params.SuggestedFeeRecipient[:])
-	var out beacon.PayloadID
-	copy(out[:], hasher.Sum(nil)[:8])
-	return out
+	args := &miner.BuildPayloadArgs{
+		Parent:       headBlockHash,
+		Timestamp:    params.Timestamp,
+		FeeRecipient: params.SuggestedFeeRecipient,
+		Random:       params.Random,
+	}
+	return args.Id()
 }
 
 // delayPayloadImport stashes the given block away for import at a later time,
@@ -981,3 +981,34 @@ func TestSimultaneousNewBlock(t *testing.T) {
 		parent = block
 	}
 }
+
+// TestPayloadIDCollision tests that a payload registered with the id of a tracked
+// one built from different arguments is rejected instead of overwriting it.
+func TestPayloadIDCollision(t *testing.T) {
+	var (
+		queue = newPayloadQueue()
+		id    = beacon.PayloadID{0x1}
+		args  = &miner.BuildPayloadArgs{
+			Parent:       common.Hash{0x1},
+			Timestamp:    1,
+			FeeRecipient: common.Address{0x1},
+		}
+	)
+	if err := queue.put(id, nil, args); err != nil {
+		t.Fatalf("Failed to track payload: %v", err)
+	}
+	// The same attributes re-sent by the beacon chain are accepted
+	same := *args
+	if err := queue.put(id, nil, &same); err != nil {
+		t.Fatalf("Failed to track identical payload: %v", err)
+	}
+	// Force a collision with different attributes
+	other := *args
+	other.Random = common.Hash{0x1}
+	if err := queue.put(id, nil, &other); err != errPayloadIDCollision {
+		t.Fatalf("Unexpected error, have %v, want %v", err, errPayloadIDCollision)
+	}
+	if err := queue.put(beacon.PayloadID{0x2}, nil, &other); err != nil {
+		t.Fatalf("Failed to track payload of distinct id: %v", err)
+	}
+}
@@ -17,6 +17,7 @@
 package catalyst
 
 import (
+	"errors"
 	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -35,11 +36,16 @@ const maxTrackedPayloads = 10
 // latest one; but have a slight wiggle room for non-ideal conditions.
 const maxTrackedHeaders = 10
 
+// errPayloadIDCollision is returned if a payload is registered with the id of
+// a tracked one which is built from different arguments.
+var errPayloadIDCollision = errors.New("payload id collision")
+
 // payloadQueueItem represents an id->payload tuple to store until it's retrieved
 // or evicted.
 type payloadQueueItem struct {
 	id      beacon.PayloadID
 	payload *miner.Payload
+	args    *miner.BuildPayloadArgs // The arguments the payload is built from
 }
 
 // payloadQueue tracks the latest handful of constructed payloads to be retrieved
@@ -57,16 +63,34 @@ func newPayloadQueue() *payloadQueue {
 	}
 }
 
-// put inserts a new payload into the queue at the given id.
-func (q *payloadQueue) put(id beacon.PayloadID, payload *miner.Payload) {
+// put inserts a new payload into the queue at the given id. The payload is
+// rejected if a tracked one of the same id is built from different arguments,
+// rather than serving the wrong block for the id afterwards.
+func (q *payloadQueue) put(id beacon.PayloadID, payload *miner.Payload, args *miner.BuildPayloadArgs) error {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
+	for _, item := range q.payloads {
+		if item == nil {
+			break
+		}
+		if item.id == id && !sameAttributes(item.args, args) {
+			return errPayloadIDCollision
+		}
+	}
 	copy(q.payloads[1:], q.payloads)
 	q.payloads[0] = &payloadQueueItem{
 		id:      id,
 		payload: payload,
+		args:    args,
 	}
+	return nil
+}
+
+// sameAttributes reports whether the two payload arguments are identical in the
+// attributes requested by the beacon chain, which the payload id commits to.
+func sameAttributes(a, b *miner.BuildPayloadArgs) bool {
+	return a.Parent == b.Parent && a.Timestamp == b.Timestamp && a.FeeRecipient == b.FeeRecipient && a.Random == b.Random
 }
 
 // get retrieves a previously stored payload item or nil if it does not exist.
@@ -18,6 +18,7 @@
 package miner
 
 import (
+	"crypto/ecdsa"
 	"fmt"
 	"math/big"
 	"sync"
@@ -27,6 +28,7 @@ import (
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/beacon"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/txpool"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -55,7 +57,230 @@ type Config struct {
 	Recommit   time.Duration  // The time interval for miner to re-create mining work.
 	Noverify   bool           // Disable remote mining solution verification(only useful in ethash).
 
-	NewPayloadTimeout time.Duration // The maximum time allowance for creating a new payload
+	NewPayloadTimeout   time.Duration // The maximum time allowance for creating a new payload
+	PayloadDiagnostics  bool          // Record the transaction inclusion diagnostics of payloads (debugging only)
+	EventDrivenRebuild  bool          // Re-build payloads upon new transactions instead of every recommit interval
+	PayloadCandidates   int           // The maximum number of the best distinct blocks retained per payload
+	InterruptSealing    bool          // Abort the in-flight payload building on other parents upon a new payload request
+	SpliceRebuild       bool          // Re-execute only the changed transaction suffix when re-building payloads
+	ValidateBeforeStore bool          // Re-validate payload blocks via the import path before storing (doubles the execution cost)
+	MinTxs              int           // The advisory minimum number of transactions of payloads, blocks reaching it are preferred
+	TieBreakByHash      bool          // Break payload fee ties by the lowest block hash instead of the arrival order
+	AllowStateOverrides bool          // Allow building payloads on top of an overridden parent state (simulation only)
+	AllowPrecompileOff  bool          // Allow building payloads with some precompiled contracts disabled (research only)
+	MinTxAge            time.Duration // The minimum time since the transactions were first seen for including in payloads
+	MaxRebuilds         int           // The maximum number of full-block building iterations per payload, zero means unlimited
+	FirstBuildDelay     time.Duration // The delay of the first full-block building after the empty one, zero means immediately
+	FinalRebuildLead    time.Duration // The lead time before the payload deadline for a final re-build capturing late transactions, zero means disabled
+	RetainReceipts      bool          // Retain the receipts of the best payload blocks for indexing (memory cost on large blocks)
+	MaxTxsPerSender     int           // The maximum number of txpool transactions per sender in payloads, zero means unlimited
+	TimestampSkew       time.Duration // The tolerated deviation of payload timestamps from the local clock before warning, zero means no check
+	MaxMempoolFraction  float64       // The maximum fraction of the pending gas consumed by a single block, zero or one means unlimited
+	TxExecutionTimeout  time.Duration // The maximum execution time of a single transaction in blocks, zero means unlimited
+	StoreEmptyFull      bool          // Store the transaction-less full blocks of payloads instead of skipping them as the empty block
+	AffordabilityMargin uint64        // The percentage the fee cap of transactions must exceed the base fee by for inclusion, zero means no margin
+	FeesETHDigits       int           // The significant digits of the payload fees reported in ether, zero means the default
+	RetainPrevious      bool          // Retain the prior best blocks of payloads for diffing (memory cost of an extra block)
+	ProfileAllocs       bool          // Sample the memory allocations of the payload building iterations (profiling only)
+	MaxFutureTimestamp  time.Duration // The maximum lead of payload timestamps over the local clock, zero means unlimited
+	Prefetch            bool          // Warm the state caches by executing the pending transactions concurrently on a throwaway state
+	MaxCalldataBytes    uint64        // The maximum total calldata bytes of the transactions in blocks, zero means unlimited
+	RecentPayloads      int           // The number of the last resolved payloads retained for analysis (memory cost of a block each), zero means none
+
+	// FeeRecipientCheck probes whether the fee recipient of payloads is able to
+	// receive value transfers, "warn" logs a warning and "error" rejects the
+	// payload if it's a reverting contract. It's only meaningful for the payout
+	// schemes transferring value to the recipient, since the default coinbase
+	// model credits the fees directly without executing any code.
+	FeeRecipientCheck string `toml:",omitempty"`
+
+	// AllowedTxTypes is the bitmask of the transaction types allowed in payloads,
+	// bit n stands for the transaction type n. Zero allows all types.
+	AllowedTxTypes uint64 `toml:",omitempty"`
+
+	// BuilderKey enables the builder payout mode if it's set. The full blocks of
+	// payloads are built with the builder account as the coinbase, and the profit
+	// is paid to the fee recipient with a transaction signed by the key at the end
+	// of the block. The value of the payload is the paid amount then.
+	BuilderKey *ecdsa.PrivateKey `toml:"-"`
+
+	// AccountScorer rates the transaction senders for building payloads, the
+	// transactions of higher scored accounts are included first at equal tip.
+	// Nil treats all the accounts as neutral.
+	AccountScorer AccountScorer `toml:"-"`
+
+	// PriorityBid is the optional source of the priority bids of transactions,
+	// e.g. the separate fees of the priority auctions run by L2 sequencers. The
+	// higher bids are placed earlier regardless of the tips, which only decide
+	// among the equal bids, nil bids are deemed zero. Nil ignores the bids.
+	PriorityBid func(tx *types.Transaction) *big.Int `toml:"-"`
+
+	// PrivateTxs is the optional source of the private transactions merged with
+	// the public pending ones for building blocks.
+	PrivateTxs PrivateTxSource `toml:"-"`
+
+	// DepositSource is the optional source of the deposit transactions, e.g. the
+	// L1 to L2 ones of a rollup sequencer, included in order at the very top of
+	// both the empty and full blocks of payloads.
+	DepositSource DepositSource `toml:"-"`
+
+	// FeeCalculator computes the proposer value of the built blocks, which the
+	// full blocks of payloads are compared by, e.g. for the chains with custom
+	// fee economics. Nil sums the transaction tips.
+	FeeCalculator FeeCalculator `toml:"-"`
+
+	// BaseFeeOracle is the optional source of the header base fee replacing the
+	// EIP-1559 derivation from the parent. The headers with the oracle base fee
+	// are verified against the consensus engine, the derived base fee is used
+	// instead if they're rejected or the oracle provides none.
+	BaseFeeOracle BaseFeeOracle `toml:"-"`
+
+	// RewardFunc is the optional block subsidy of the chains with custom reward
+	// mechanics. It's installed into the consensus engine, which mints it to the
+	// coinbase in Finalize for both the built and the imported blocks, it's
+	// ignored if the engine is not a RewardEngine. It's counted into the value
+	// of the blocks, except in the builder payout mode where the builder keeps it.
+	RewardFunc RewardFunc `toml:"-"`
+
+	// FinalizeTxs is the optional final pass over the transactions filled from
+	// the txpool before the block is sealed, e.g. for moving a backrun adjacent
+	// to its target. It may reorder or drop the transactions, but not add any.
+	// The rewritten list is re-executed, it's rejected in favor of the original
+	// one if it breaks the nonce order of any sender or doesn't fit in the block.
+	FinalizeTxs func([]*types.Transaction) []*types.Transaction `toml:"-"`
+
+	// BuildObjective selects which of the full blocks built for a payload is
+	// retained, the one with the highest fees by default.
+	BuildObjective BuildObjective
+
+	// ExcludeAddresses is an opt-in blocklist for building payloads. Transactions
+	// sent from or to, or touching (post-Berlin) any of the addresses during the
+	// execution, are never included in the payloads built for the beacon chain.
+	ExcludeAddresses []common.Address `toml:",omitempty"`
+
+	// AllowedSenders is an opt-in sender allowlist for building payloads, meant
+	// for the permissioned deployments. Only the txpool transactions sent from
+	// any of the addresses are included, empty allows all senders.
+	AllowedSenders []common.Address `toml:",omitempty"`
+
+	// ProposeMargin is the premium the local payload value must exceed a relay
+	// bid by to be considered worth proposing, see Payload.WorthProposing. Nil
+	// means no premium, the ties go to the local payload.
+	ProposeMargin *big.Int `toml:",omitempty"`
+
+	// RelaxOnLowValue is the fee threshold below which a payload full block is
+	// re-built once more with the optional inclusion filters dropped, namely the
+	// gas price floor, the affordability margin and the minimum transaction age,
+	// and the better of the two blocks is kept. The address blocklist and the
+	// sender allowlist are never relaxed. The fallback is made at most once per
+	// payload, upon the first poor block. Nil disables the fallback.
+	RelaxOnLowValue *big.Int `toml:",omitempty"`
+
+	// PropagationWeights weighs the components of the advisory propagation risk
+	// score of payloads, see Payload.PropagationRiskScore. Nil means the default
+	// weights.
+	PropagationWeights *PropagationWeights `toml:",omitempty"`
+
+	// PayloadExtra composes the header extra-data of payloads from a readable
+	// prefix and a structured build metadata suffix. Nil leaves the extra-data
+	// of payloads empty.
+	PayloadExtra *PayloadExtra `toml:",omitempty"`
+}
+
+// PayloadExtra is the layout of the payload header extra-data, a human readable
+// prefix followed by the build metadata, which is encoded as the version byte,
+// the strategy tag and the tag length byte at the very end, so that it can be
+// decoded backwards. The whole extra-data must fit in the protocol size limit.
+type PayloadExtra struct {
+	Prefix   string // The human readable prefix, e.g. the builder name
+	Version  byte   // The version of the build software
+	Strategy string // The tag of the build strategy, at most 255 bytes
+}
+
+// Encode assembles the extra-data, it fails if it exceeds the size limit.
+func (e *PayloadExtra) Encode() ([]byte, error) {
+	if len(e.Strategy) > 255 {
+		return nil, fmt.Errorf("strategy tag too long, %d > 255", len(e.Strategy))
+	}
+	extra := make([]byte, 0, len(e.Prefix)+len(e.Strategy)+2)
+	extra = append(extra, e.Prefix...)
+	extra = append(extra, e.Version)
+	extra = append(extra, e.Strategy...)
+	extra = append(extra, byte(len(e.Strategy)))
+	if uint64(len(extra)) > params.MaximumExtraDataSize {
+		return nil, fmt.Errorf("extra exceeds max length. %d > %v", len(extra), params.MaximumExtraDataSize)
+	}
+	return extra, nil
+}
+
+// DecodePayloadExtra parses the extra-data assembled by PayloadExtra.Encode.
+func DecodePayloadExtra(extra []byte) (*PayloadExtra, error) {
+	if len(extra) < 2 {
+		return nil, fmt.Errorf("extra too short, %d bytes", len(extra))
+	}
+	n := int(extra[len(extra)-1])
+	if len(extra) < n+2 {
+		return nil, fmt.Errorf("strategy tag overflows extra, %d > %d", n+2, len(extra))
+	}
+	var (
+		tag     = len(extra) - 1 - n
+		version = tag - 1
+	)
+	return &PayloadExtra{
+		Prefix:   string(extra[:version]),
+		Version:  extra[version],
+		Strategy: string(extra[tag : len(extra)-1]),
+	}, nil
+}
+
+// PrivateTxSource provides the transactions received via a private order flow,
+// which are merged with the public pending ones for building blocks, ordered by
+// their effective value alike. They are never added to the txpool, hence never
+// gossiped.
+type PrivateTxSource interface {
+	// Pending returns the executable private transactions, grouped by the
+	// sender and sorted by nonce.
+	Pending() map[common.Address]types.Transactions
+}
+
+// DepositSource provides the deposit transactions to be included at the top of
+// the payloads, before any transaction from the txpool.
+type DepositSource interface {
+	// Deposits returns the deposits for the block built on top of the given
+	// parent, in the inclusion order. They are never reordered or dropped, the
+	// payload is not built at all if any of them is invalid.
+	Deposits(parent *types.Header) ([]*types.Transaction, error)
+}
+
+// RewardFunc returns the subsidy minted to the coinbase of the block with the
+// given header, nil or zero means none.
+type RewardFunc func(header *types.Header) *big.Int
+
+// RewardEngine is a consensus engine supporting a custom block subsidy, minted
+// to the coinbase in Finalize after the engine rewards.
+type RewardEngine interface {
+	// SetRewardFunc installs the subsidy of the blocks finalized by the engine.
+	SetRewardFunc(reward RewardFunc)
+}
+
+// FeeCalculator computes the value of a block to its proposer. The receipts are
+// in the same order as the block transactions.
+type FeeCalculator interface {
+	Fees(block *types.Block, receipts []*types.Receipt) *big.Int
+}
+
+// BaseFeeOracle provides the base fee of the blocks built on top of the given
+// parent, e.g. a smoothed estimate for the chains with custom fee markets. Nil
+// means deriving it from the parent by the EIP-1559 rules.
+type BaseFeeOracle interface {
+	BaseFee(parent *types.Header) *big.Int
+}
+
+// AccountScorer rates accounts by their reputation, e.g. for deprioritizing the
+// transactions of accounts with a history of spamming. Zero is neutral, higher
+// scores are preferred.
+type AccountScorer interface {
+	Score(addr common.Address) int64
 }
 
 // DefaultConfig contains default settings for miner.
@@ -64,6 +289,9 @@ var DefaultConfig = Config{
 	GasPrice:          big.NewInt(params.GWei),
 	Recommit:          3 * time.Second,
 	NewPayloadTimeout: 2 * time.Second,
+
+	MaxMempoolFraction: 1,
+	MaxFutureTimestamp: time.Minute,
 }
 
 // Miner creates blocks and searches for proof-of-work values.
@@ -251,7 +479,51 @@ func (miner *Miner) SubscribePendingLogs(ch chan<- []*types.Log) event.Subscript
 	return miner.worker.pendingLogsFeed.Subscribe(ch)
 }
 
+// SubscribeBuiltBlocks starts delivering the full blocks accepted as the best
+// ones of the payloads, across all payloads. The delivery doesn't block the
+// building, the blocks are dropped if the subscribers fall behind.
+func (miner *Miner) SubscribeBuiltBlocks(ch chan<- *types.Block) event.Subscription {
+	return miner.worker.builtBlockFeed.Subscribe(ch)
+}
+
 // BuildPayload builds the payload according to the provided parameters.
 func (miner *Miner) BuildPayload(args *BuildPayloadArgs) (*Payload, error) {
 	return miner.worker.buildPayload(args)
 }
+
+// NextBaseFee returns the expected base fee of the block on top of the given
+// parent without building it. Nil is returned if it's before the London fork.
+func (miner *Miner) NextBaseFee(parent common.Hash) (*big.Int, error) {
+	return miner.worker.nextBaseFee(parent)
+}
+
+// ParentBlockValue returns the transaction tips paid by the given parent block,
+// which can be compared against Payload.CurrentFees for detecting the trend of
+// the fee environment.
+func (miner *Miner) ParentBlockValue(parent common.Hash) (*big.Int, error) {
+	return miner.worker.parentBlockValue(parent)
+}
+
+// SnapshotPending freezes the current pending transactions, which can be used
+// for building payloads against exactly the same transaction set.
+func (miner *Miner) SnapshotPending() *PendingSnapshot {
+	return miner.worker.snapshotPending()
+}
+
+// ActivePayloads returns the ids of the payloads currently being built, e.g.
+// for showing the in-flight proposing work.
+func (miner *Miner) ActivePayloads() []beacon.PayloadID {
+	return miner.worker.ActivePayloads()
+}
+
+// RecentPayloads returns the last n resolved payloads retained by the miner,
+// the most recent first.
+func (miner *Miner) RecentPayloads(n int) []*PayloadRecord {
+	return miner.worker.RecentPayloads(n)
+}
+
+// StopPayloadBuilding terminates the background builders of all in-flight
+// payloads. The payloads built so far can still be resolved afterwards.
+func (miner *Miner) StopPayloadBuilding() {
+	miner.worker.stopPayloadBuilding()
+}
@@ -19,6 +19,7 @@ package miner
 
 import (
 	"errors"
+	"strings"
 	"testing"
 	"time"
 
@@ -33,6 +34,7 @@ import (
 	"github.com/ethereum/go-ethereum/eth/downloader"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/trie"
 )
 
@@ -225,6 +227,43 @@ func TestMinerSetEtherbase(t *testing.T) {
 	}
 }
 
+func TestPayloadExtra(t *testing.T) {
+	var tests = []struct {
+		layout PayloadExtra
+		valid  bool
+	}{
+		{PayloadExtra{}, true},
+		{PayloadExtra{Prefix: "builder", Version: 3, Strategy: "greedy"}, true},
+		{PayloadExtra{Prefix: strings.Repeat("x", 30)}, true},
+		{PayloadExtra{Prefix: strings.Repeat("x", 31)}, false},
+		{PayloadExtra{Prefix: "builder", Strategy: strings.Repeat("s", 24)}, false},
+		{PayloadExtra{Strategy: strings.Repeat("s", 256)}, false},
+	}
+	for i, test := range tests {
+		extra, err := test.layout.Encode()
+		if (err == nil) != test.valid {
+			t.Fatalf("test %d: unexpected encoding result, err %v, want valid %v", i, err, test.valid)
+		}
+		if err != nil {
+			continue
+		}
+		if uint64(len(extra)) > params.MaximumExtraDataSize {
+			t.Fatalf("test %d: extra exceeds limit, %d bytes", i, len(extra))
+		}
+		decoded, err := DecodePayloadExtra(extra)
+		if err != nil {
+			t.Fatalf("test %d: failed to decode %v", i, err)
+		}
+		if *decoded != test.layout {
+			t.Fatalf("test %d: layout mismatch, have %+v, want %+v", i, decoded, test.layout)
+		}
+	}
+	// The truncated extra-data is rejected
+	if _, err := DecodePayloadExtra([]byte{0x01, 0x05}); err == nil {
+		t.Fatal("Truncated extra is decoded")
+	}
+}
+
 // waitForMiningState waits until either
 // * the desired mining state was reached
 // * a timeout was reached which fails the test
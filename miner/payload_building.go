@@ -17,15 +17,164 @@
 package miner
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/big"
+	"runtime"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/beacon"
+	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
+var (
+	payloadBuildMeter   = metrics.NewRegisteredMeter("miner/payload/build", nil)
+	payloadUpdateMeter  = metrics.NewRegisteredMeter("miner/payload/update", nil)
+	payloadInvalidMeter = metrics.NewRegisteredMeter("miner/payload/invalid", nil)
+
+	// starvedBlockMeter counts the full blocks including none of the pending
+	// transactions although some are available.
+	starvedBlockMeter = metrics.NewRegisteredMeter("miner/payload/starved", nil)
+
+	// payloadIterationTimer measures the latency of each full-block building
+	// iteration, and payloadFirstFullTimer measures the time from the payload
+	// creation until the first full block is ready, which is the key metric for
+	// proposers. Both are exported as summaries with quantiles.
+	payloadIterationTimer = metrics.NewRegisteredTimer("miner/payload/iteration", nil)
+	payloadFirstFullTimer = metrics.NewRegisteredTimer("miner/payload/firstfull", nil)
+
+	// payloadFeesHistograms sample the fees (in gwei) of the full blocks at the
+	// time they are installed as the best block, bucketed by the elapsed seconds
+	// since the payload creation. The fixed bucketing keeps the cardinality low
+	// while still revealing how the revenue accumulates within a slot.
+	payloadFeesHistograms = newFeesHistograms(payloadFeesBuckets)
+
+	// payloadExitMeters count the terminations of the background building by
+	// the cause, revealing whether the building gets its full time budget or
+	// is cut short by the eager resolving.
+	payloadExitMeters = map[string]metrics.Meter{
+		payloadExitResolved:  metrics.NewRegisteredMeter("miner/payload/exit/resolved", nil),
+		payloadExitCancelled: metrics.NewRegisteredMeter("miner/payload/exit/cancelled", nil),
+		payloadExitDeadline:  metrics.NewRegisteredMeter("miner/payload/exit/deadline", nil),
+		payloadExitInvalid:   metrics.NewRegisteredMeter("miner/payload/exit/invalid", nil),
+		payloadExitRebuilds:  metrics.NewRegisteredMeter("miner/payload/exit/rebuilds", nil),
+	}
+)
+
+// The causes of the termination of the background building.
+const (
+	payloadExitResolved  = "resolved"  // The payload is resolved by the caller
+	payloadExitCancelled = "cancelled" // The building is stopped without resolving, e.g. at shutdown
+	payloadExitDeadline  = "deadline"  // The deadline of the payload expired
+	payloadExitInvalid   = "invalid"   // The building is given up due to repeated invalid blocks
+	payloadExitRebuilds  = "rebuilds"  // The maximum number of the building iterations is reached
+)
+
+const (
+	// payloadLifetime is the time allowance of the background building since
+	// the payload creation, namely SECONDS_PER_SLOT (12s in the Mainnet
+	// configuration).
+	payloadLifetime = 12 * time.Second
+
+	// payloadStopTimeout is the maximum time allowance for waiting the in-flight
+	// payload builders to exit when the worker is shutting down.
+	payloadStopTimeout = 3 * time.Second
+
+	// eventRecommitFallback is the time interval to re-build the payload in the
+	// event-driven mode if no new transaction arrives.
+	eventRecommitFallback = 4 * time.Second
+
+	// maxPayloadCandidates is the maximum number of the candidate blocks allowed
+	// to be retained per payload, in order to limit the memory usage.
+	maxPayloadCandidates = 16
+
+	// maxInvalidPayloadBlocks is the number of the consecutive invalid blocks
+	// after which the payload building is given up.
+	maxInvalidPayloadBlocks = 3
+
+	// feeRecipientProbeGas is the gas allowance for probing whether the fee
+	// recipient is able to receive value transfers.
+	feeRecipientProbeGas = 100000
+
+	// payloadFeesBuckets is the number of the per-second buckets for sampling the
+	// full block fees, the samples after that are put into the last bucket.
+	payloadFeesBuckets = 12
+
+	// mempoolViewTop is the number of the most paying transactions recorded in
+	// the mempool view of payloads.
+	mempoolViewTop = 16
+
+	// emptyPayloadTimeout is the maximum time allowance for waiting the empty
+	// block to be ready when resolving the payload.
+	emptyPayloadTimeout = 2 * time.Second
+)
+
+// stateRetryBackoffs are the delays before retrying a full-block building which
+// failed due to the transiently unavailable state, e.g. during a snapshot flush.
+var stateRetryBackoffs = []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond}
+
+// The conditions ending the transaction filling of full blocks, see Payload.FillStopReason.
+const (
+	FillStopGasLimit     = "gas-limit"     // The block is full, the demand exceeds the capacity
+	FillStopTxsExhausted = "txs-exhausted" // The pending transactions are exhausted
+	FillStopInterrupted  = "interrupted"   // The filling is interrupted, e.g. by the timeout
+)
+
+// The supported modes of the fee recipient check, see Config.FeeRecipientCheck.
+const (
+	FeeRecipientCheckWarn  = "warn"  // Log a warning if the fee recipient rejects value transfers
+	FeeRecipientCheckError = "error" // Reject the payload if the fee recipient rejects value transfers
+)
+
+// errPayloadNotReady is returned if the payload has no block built yet.
+var errPayloadNotReady = errors.New("payload not ready")
+
+// errTooManyInvalidBlocks is set to the payload if the building is given up
+// due to producing invalid blocks repeatedly.
+var errTooManyInvalidBlocks = errors.New("too many invalid payload blocks")
+
+// errStateOverrideDisabled is returned if the state overrides are requested for
+// building payload without being allowed in the config.
+var errStateOverrideDisabled = errors.New("state overrides are disabled")
+
+// errPrecompileOffDisabled is returned if disabling precompiled contracts is
+// requested for building payload without being allowed in the config.
+var errPrecompileOffDisabled = errors.New("disabling precompiles is not allowed")
+
+// errCoinbaseConflict is returned if the separate coinbase of a payload differs
+// from the builder account paying the profit out.
+var errCoinbaseConflict = errors.New("coinbase conflicts with builder account")
+
+// errOmmersPostMerge is returned if ommers are requested for a payload built on
+// top of a parent which has reached the merge.
+var errOmmersPostMerge = errors.New("ommers are forbidden post-merge")
+
+// errFutureTimestamp is returned if the payload timestamp is further ahead of
+// the local clock than the configured tolerance.
+var errFutureTimestamp = errors.New("payload timestamp too far in the future")
+
+// errFeeRecipientRejects is returned if the fee recipient is a contract which
+// reverts upon receiving value transfers.
+var errFeeRecipientRejects = errors.New("fee recipient rejects value transfers")
+
 // BuildPayloadArgs contains the provided parameters for building payload.
 // Check engine-api specification for more details.
 // https://github.com/ethereum/execution-apis/blob/main/src/engine/specification.md#payloadattributesv1
@@ -34,76 +183,1655 @@ type BuildPayloadArgs struct {
 	Timestamp    uint64         // The provided timestamp of generated payload
 	FeeRecipient common.Address // The provided recipient address for collecting transaction fee
 	Random       common.Hash    // The provided randomness value
+
+	// Coinbase is the optional address written to the header coinbase instead
+	// of the fee recipient, e.g. a contract collecting the fees for distribution.
+	// The fee recipient still governs the payout, if the builder account is
+	// configured, the coinbase must be the builder account which pays the profit
+	// out to the fee recipient.
+	Coinbase common.Address
+
+	// TxValuer is an optional function for ranking the pending transactions,
+	// e.g. with the off-chain order flow. The nonce ordering and the gas limit
+	// still apply. The effective miner tip is used if it's not provided.
+	TxValuer func(tx *types.Transaction) *big.Int
+
+	// AppendTxs are the transactions to be included at the very end of the block,
+	// after the ones from the txpool, e.g. the epilogue system transactions. The
+	// full block is not built if they don't fit or revert. Note the empty block
+	// is built without them.
+	AppendTxs []*types.Transaction
+
+	// SeedTx is an optional transaction included at the very beginning of both
+	// the empty and full blocks, e.g. a critical system transaction, so that
+	// the fallback block is not truly empty. It should be cheap to keep the
+	// empty block building fast. No block is built if it fails or reverts.
+	SeedTx *types.Transaction
+
+	// Ommers are the uncle headers included in both the empty and full blocks,
+	// for the legacy test chains still processing them. At most two are allowed
+	// and they're forbidden once the merge is reached. The uncle inclusion
+	// reward is counted into the value of the blocks.
+	Ommers []*types.Header
+
+	// ReserveGas is the gas withheld from the txpool transactions, the filling
+	// stops once the gas limit minus the reservation is reached, guaranteeing
+	// room for the AppendTxs. It's released to them afterwards.
+	ReserveGas uint64
+
+	// StateOverrides are optional changes applied to the parent state, for
+	// simulating the payload as if certain accounts were different. They are
+	// applied to the in-memory copy used for building only, the real state is
+	// never mutated. Note the built blocks are invalid for the real chain.
+	// It's only allowed if Config.AllowStateOverrides is set.
+	StateOverrides StateOverride
+
+	// DisabledPrecompiles is an optional set of precompiled contracts executed
+	// as if they didn't exist, e.g. for testing the fallback behaviors of the
+	// contracts. Note the built blocks are invalid for the real chain. It's only
+	// allowed if Config.AllowPrecompileOff is set.
+	DisabledPrecompiles []common.Address
+
+	// Pending is an optional snapshot of the pending transactions to fill the
+	// full blocks from instead of the live txpool, e.g. for building multiple
+	// payloads against exactly the same transaction set.
+	Pending *PendingSnapshot
+
+	// Bundles are the optional transaction groups, e.g. submitted by searchers,
+	// included in order at the top of the full blocks before the txpool ones.
+	// Each bundle is included atomically, see Bundle.
+	Bundles []*Bundle
+
+	// OnTxIncluded is an optional callback invoked for each transaction included
+	// in the full blocks, along with its receipt, e.g. for streaming ingestion.
+	// Note the full block is re-built repeatedly, the callback fires for every
+	// build iteration, so the consumers should dedupe. It's invoked in a separate
+	// routine per iteration without blocking the building, the order across the
+	// iterations is not guaranteed.
+	OnTxIncluded func(tx *types.Transaction, receipt *types.Receipt)
+
+	// MinGasPrice is an optional gas price floor for the pre-1559 transactions,
+	// i.e. the legacy and access list ones, from the txpool. The transactions
+	// below it are skipped along with the subsequent ones of the sender, while
+	// the dynamic fee transactions are unaffected.
+	MinGasPrice *big.Int
+
+	// RelayMinGasPrice is an optional floor of the effective gas price for all the
+	// transaction types, e.g. the compliance requirement of a relay. The txpool
+	// transactions below it are skipped along with the subsequent ones of the
+	// sender, and the bundles containing any are rejected. Unlike MinGasPrice,
+	// it's kept by the relaxed re-builds. Note the explicitly supplied seed,
+	// deposit and appended transactions, as well as the builder payout one paying
+	// the base fee only, are not checked.
+	RelayMinGasPrice *big.Int
+
+	// GasUsedTarget optionally caps the gas the full blocks consume below the
+	// real gas limit, the filling stops at it as if the block was full, e.g. for
+	// testing the fill behavior deterministically or for throttling. Zero, or
+	// a value not below the gas limit, means the real gas limit.
+	GasUsedTarget uint64
+
+	// OrderSeed is an optional seed for deterministically perturbing the ordering
+	// of the transactions paying equal tips, e.g. for measuring the revenue impact
+	// of the ordering. The same seed always yields the same order, while the nonce
+	// ordering per account is preserved. It supersedes Config.AccountScorer for
+	// the build, zero means no perturbation.
+	OrderSeed uint64
+
+	// BlockVeto is an optional function consulted before storing a full block,
+	// e.g. for a compliance check on the assembled block. The block is discarded
+	// regardless of its fees if it returns true, and the building continues. It
+	// must be cheap and safe for concurrent use since it's invoked with the
+	// payload lock held.
+	BlockVeto func(block *types.Block) bool
+
+	// RequireRecipientGain is an opt-in sanity check of the payout, the full
+	// blocks not strictly increasing the balance of the fee recipient, e.g. if
+	// all the fees are burned, are discarded regardless of their fees.
+	RequireRecipientGain bool
+
+	// OnCandidate is an optional callback invoked for every full block built,
+	// reporting whether it's accepted as the new best block, e.g. for analysing
+	// the decisions of the build loop. It's invoked in a separate routine without
+	// blocking the building, the order across the blocks is not guaranteed.
+	OnCandidate func(block *types.Block, fees *big.Int, accepted bool)
+
+	// OnSuperseded is an optional callback invoked when a full block replaces a
+	// prior one as the best block, with the fees of both, e.g. for resubmitting
+	// the bids. The first full block doesn't fire it. It's invoked in a separate
+	// routine without blocking the building.
+	OnSuperseded func(old, new *big.Int)
+
+	// ElasticityMultiplier and BaseFeeChangeDenominator optionally override the
+	// EIP-1559 parameters of the chain config for deriving the base fee of the
+	// payload, zero means the chain config ones. It's meant for testing the L2
+	// parameters only, the blocks are invalid for the real chain if they differ.
+	ElasticityMultiplier     uint64
+	BaseFeeChangeDenominator uint64
+
+	// Label is an optional caller-supplied tag for attributing the payload to
+	// its source, it's also used in the metric names. Keep the label set small,
+	// otherwise unbounded number of metrics will be registered.
+	Label string
+
+	deposits []*types.Transaction // The deposits from the configured source, fetched once per payload
+}
+
+// AccountOverride is the set of fields to override of an account, nil means
+// the field is left as it is. State replaces the entire storage of the account
+// while StateDiff patches the given slots only, they are mutually exclusive.
+type AccountOverride struct {
+	Nonce     *uint64
+	Code      []byte
+	Balance   *big.Int
+	State     map[common.Hash]common.Hash
+	StateDiff map[common.Hash]common.Hash
+}
+
+// Bundle is a group of transactions included in the full blocks of payloads all
+// or nothing, in the given order. The whole bundle is dropped if any of them is
+// invalid or reverts, except for the reverts of the ones explicitly allowed.
+type Bundle struct {
+	Txs       []*types.Transaction // The transactions of the bundle in order
+	MayRevert []common.Hash        // The transactions of the bundle allowed to revert
+}
+
+// StateOverride is the collection of overridden accounts.
+type StateOverride map[common.Address]AccountOverride
+
+// apply overrides the fields of the specified accounts into the given state.
+func (diff StateOverride) apply(statedb *state.StateDB) error {
+	for addr, account := range diff {
+		if account.State != nil && account.StateDiff != nil {
+			return fmt.Errorf("account %s has both 'state' and 'stateDiff'", addr.Hex())
+		}
+		if account.Nonce != nil {
+			statedb.SetNonce(addr, *account.Nonce)
+		}
+		if account.Code != nil {
+			statedb.SetCode(addr, account.Code)
+		}
+		if account.Balance != nil {
+			statedb.SetBalance(addr, account.Balance)
+		}
+		if account.State != nil {
+			statedb.SetStorage(addr, account.State)
+		}
+		for key, value := range account.StateDiff {
+			statedb.SetState(addr, key, value)
+		}
+	}
+	return nil
+}
+
+// Id computes an 8-byte identifier by hashing the components of the payload arguments.
+func (args *BuildPayloadArgs) Id() beacon.PayloadID {
+	hasher := sha256.New()
+	hasher.Write(args.Parent[:])
+	binary.Write(hasher, binary.BigEndian, args.Timestamp)
+	hasher.Write(args.Random[:])
+	hasher.Write(args.FeeRecipient[:])
+	var out beacon.PayloadID
+	copy(out[:], hasher.Sum(nil)[:8])
+	return out
+}
+
+// Validate checks the consistency of the payload arguments against the given
+// parent header, in order to reject the invalid combinations early with clear
+// errors rather than failing confusingly in the building. The checks depending
+// on the miner config are performed by the worker separately.
+func (args *BuildPayloadArgs) Validate(config *params.ChainConfig, parent *types.Header) error {
+	if parent == nil {
+		return fmt.Errorf("missing parent %x", args.Parent)
+	}
+	if parent.Hash() != args.Parent {
+		return fmt.Errorf("parent mismatch, have %x, want %x", parent.Hash(), args.Parent)
+	}
+	if args.Timestamp <= parent.Time {
+		return fmt.Errorf("invalid timestamp, parent %d given %d", parent.Time, args.Timestamp)
+	}
+	if limit := parent.GasLimit + parent.GasLimit/params.GasLimitBoundDivisor; args.ReserveGas > limit {
+		return fmt.Errorf("reserved gas %d exceeds the gas limit %d", args.ReserveGas, limit)
+	}
+	if args.MinGasPrice != nil && args.MinGasPrice.Sign() < 0 {
+		return fmt.Errorf("negative minimum gas price %v", args.MinGasPrice)
+	}
+	if args.RelayMinGasPrice != nil && args.RelayMinGasPrice.Sign() < 0 {
+		return fmt.Errorf("negative relay minimum gas price %v", args.RelayMinGasPrice)
+	}
+	if len(args.Ommers) > 2 {
+		return fmt.Errorf("too many ommers, have %d, max %d", len(args.Ommers), 2)
+	}
+	// The operator-supplied transactions must be valid for the block and must
+	// not be duplicated, otherwise no full block can ever be built.
+	var (
+		signer = types.MakeSigner(config, new(big.Int).Add(parent.Number, common.Big1))
+		known  = make(map[common.Hash]struct{})
+		txs    = args.AppendTxs
+	)
+	if args.SeedTx != nil {
+		txs = append([]*types.Transaction{args.SeedTx}, txs...)
+	}
+	for i, bundle := range args.Bundles {
+		if len(bundle.Txs) == 0 {
+			return fmt.Errorf("empty bundle %d", i)
+		}
+		members := make(map[common.Hash]struct{}, len(bundle.Txs))
+		for _, tx := range bundle.Txs {
+			members[tx.Hash()] = struct{}{}
+		}
+		for _, hash := range bundle.MayRevert {
+			if _, ok := members[hash]; !ok {
+				return fmt.Errorf("bundle %d: reverting transaction %x not in bundle", i, hash)
+			}
+		}
+		txs = append(txs, bundle.Txs...)
+	}
+	for _, tx := range txs {
+		if _, err := types.Sender(signer, tx); err != nil {
+			return fmt.Errorf("invalid transaction %x: %v", tx.Hash(), err)
+		}
+		if _, ok := known[tx.Hash()]; ok {
+			return fmt.Errorf("duplicate transaction %x", tx.Hash())
+		}
+		known[tx.Hash()] = struct{}{}
+	}
+	for addr, account := range args.StateOverrides {
+		if account.State != nil && account.StateDiff != nil {
+			return fmt.Errorf("account %s has both 'state' and 'stateDiff'", addr.Hex())
+		}
+	}
+	return nil
+}
+
+// PayloadSnapshot is the resolved state of a payload, bundling the executable
+// data of the best block with its accompanying details.
+type PayloadSnapshot struct {
+	ID    beacon.PayloadID         // The identifier of the payload
+	Data  *beacon.ExecutableDataV1 // The executable data of the best block
+	Value *big.Int                 // The transaction fees of the best block in Wei, zero for the empty block
+	Full  bool                     // Flag whether the best block is a full block
+	Label string                   // The caller-supplied label of the payload
+	Fork  string                   // The consensus-layer fork name the payload targets
+}
+
+// payloadSnapshotVersion is the version of the encoded payload snapshots. It's
+// only bumped by incompatible changes, the new optional fields are ignored by
+// the older decoders.
+const payloadSnapshotVersion = 1
+
+// encodedSnapshot is the wire format of the payload snapshots.
+type encodedSnapshot struct {
+	Version uint64                   `json:"version"`
+	ID      beacon.PayloadID         `json:"id"`
+	Data    *beacon.ExecutableDataV1 `json:"data"`
+	Value   *hexutil.Big             `json:"value"`
+	Full    bool                     `json:"full"`
+	Label   string                   `json:"label,omitempty"`
+	Fork    string                   `json:"fork,omitempty"`
+}
+
+// Encode serializes the snapshot in the versioned format, e.g. for handing the
+// payload over to another process for the submission.
+func (s *PayloadSnapshot) Encode() ([]byte, error) {
+	if s.Data == nil || s.Value == nil {
+		return nil, errors.New("incomplete payload snapshot")
+	}
+	return json.Marshal(&encodedSnapshot{
+		Version: payloadSnapshotVersion,
+		ID:      s.ID,
+		Data:    s.Data,
+		Value:   (*hexutil.Big)(s.Value),
+		Full:    s.Full,
+		Label:   s.Label,
+		Fork:    s.Fork,
+	})
+}
+
+// DecodePayloadSnapshot reconstructs the snapshot serialized by Encode. An error
+// is returned if the encoding is malformed or of an unsupported version.
+func DecodePayloadSnapshot(data []byte) (*PayloadSnapshot, error) {
+	var enc encodedSnapshot
+	if err := json.Unmarshal(data, &enc); err != nil {
+		return nil, err
+	}
+	if enc.Version != payloadSnapshotVersion {
+		return nil, fmt.Errorf("unsupported payload snapshot version %d", enc.Version)
+	}
+	if enc.Data == nil || enc.Value == nil {
+		return nil, errors.New("incomplete payload snapshot")
+	}
+	return &PayloadSnapshot{
+		ID:    enc.ID,
+		Data:  enc.Data,
+		Value: (*big.Int)(enc.Value),
+		Full:  enc.Full,
+		Label: enc.Label,
+		Fork:  enc.Fork,
+	}, nil
+}
+
+// PendingSnapshot is a frozen set of the pending transactions of the txpool.
+type PendingSnapshot struct {
+	locals  map[common.Address]types.Transactions
+	remotes map[common.Address]types.Transactions
+}
+
+// copy returns the copies of the local and remote transaction sets, since they
+// are reowned by the transaction ordering.
+func (s *PendingSnapshot) copy() (map[common.Address]types.Transactions, map[common.Address]types.Transactions) {
+	locals := make(map[common.Address]types.Transactions, len(s.locals))
+	for addr, txs := range s.locals {
+		locals[addr] = txs
+	}
+	remotes := make(map[common.Address]types.Transactions, len(s.remotes))
+	for addr, txs := range s.remotes {
+		remotes[addr] = txs
+	}
+	return locals, remotes
+}
+
+// Len returns the number of the transactions in the snapshot.
+func (s *PendingSnapshot) Len() int {
+	var n int
+	for _, txs := range s.locals {
+		n += len(txs)
+	}
+	for _, txs := range s.remotes {
+		n += len(txs)
+	}
+	return n
+}
+
+// BuildReport is the consolidated summary of a payload building, intended for
+// troubleshooting a slot in one structured dump.
+type BuildReport struct {
+	ID          beacon.PayloadID // The identifier of the payload
+	Label       string           // The caller-supplied label of the payload
+	Parent      common.Hash      // The parent block the payload is built on top
+	Timestamp   uint64           // The timestamp of the payload
+	Rebuilds    int              // The number of the full blocks built
+	PeakGasUsed uint64           // The highest gas used across all the built full blocks
+	GasUsed     uint64           // The gas used by the best block
+	Fees        *big.Int         // The transaction fees of the best block
+	Full        bool             // Flag whether the best block is a full one rather than the empty one
+	FillStop    string           // The condition ended the filling of the best block, empty if not full
+	BuildTime   time.Duration    // The accumulated time spent in building
+	Err         error            // The reason why the building was given up, nil if it's not
+}
+
+// PayloadTimings is the timestamps of the lifecycle stages of a payload, the zero
+// time means the stage isn't reached yet.
+type PayloadTimings struct {
+	Started    time.Time // The time when the building of the payload started
+	EmptyReady time.Time // The time when the empty block became available
+	FirstFull  time.Time // The time when the first full block was accepted
+	LastUpdate time.Time // The time when the best full block was last updated
+	Stopped    time.Time // The time when the payload was resolved, stopped or expired
+}
+
+// PayloadRecord is the retained outcome of a resolved payload, kept by the
+// worker for the post-slot analysis.
+type PayloadRecord struct {
+	Report BuildReport  // The summary of the payload building
+	Block  *types.Block // The block the payload was resolved with
+}
+
+// iterationResult is the outcome of a full-block building iteration of payload,
+// it's only reported to the test hook.
+type iterationResult struct {
+	fees *big.Int // The transaction fees of the built block, nil if it failed
+	txs  int      // The number of transactions in the built block
+	err  error    // The reason why the iteration failed, nil if it succeeded
+}
+
+// MempoolView is the diagnostic summary of the pending transactions a full block
+// is filled from, e.g. for telling whether a missing transaction was visible to
+// the builder at all.
+type MempoolView struct {
+	Senders int           // The number of the senders with pending transactions
+	Txs     int           // The number of the pending transactions
+	Top     []common.Hash // The most paying transactions by the effective tip, in descending order
+}
+
+// newMempoolView summarizes the given pending transactions, the effective tips
+// are computed against the given base fee.
+func newMempoolView(locals, remotes map[common.Address]types.Transactions, baseFee *big.Int) *MempoolView {
+	var (
+		view = new(MempoolView)
+		txs  []*types.Transaction
+		tips = make(map[common.Hash]*big.Int)
+	)
+	for _, set := range []map[common.Address]types.Transactions{locals, remotes} {
+		for _, list := range set {
+			view.Senders++
+			for _, tx := range list {
+				tip, _ := tx.EffectiveGasTip(baseFee)
+				tips[tx.Hash()] = tip
+				txs = append(txs, tx)
+			}
+		}
+	}
+	view.Txs = len(txs)
+	sort.SliceStable(txs, func(i, j int) bool {
+		if cmp := tips[txs[i].Hash()].Cmp(tips[txs[j].Hash()]); cmp != 0 {
+			return cmp > 0
+		}
+		return bytes.Compare(txs[i].Hash().Bytes(), txs[j].Hash().Bytes()) < 0
+	})
+	if len(txs) > mempoolViewTop {
+		txs = txs[:mempoolViewTop]
+	}
+	for _, tx := range txs {
+		view.Top = append(view.Top, tx.Hash())
+	}
+	return view
+}
+
+// StalledAccount is the diagnostic record of an account whose transactions are
+// not included due to a nonce gap.
+type StalledAccount struct {
+	Address common.Address // The sender of the stalled transactions
+	Nonce   uint64         // The nonce expected by the state
+	Next    uint64         // The nonce of the next available transaction
+}
+
+// TxFee is the proposer fee contributed by an included transaction, namely its
+// effective tip times the gas used.
+type TxFee struct {
+	Hash common.Hash // The hash of the transaction
+	Fee  *big.Int    // The contributed fee in Wei
+}
+
+// fillReport is the outcome of the transaction filling of a full block.
+type fillReport struct {
+	stop     string           // The condition ended the filling, one of the FillStop constants
+	stalled  []StalledAccount // The accounts stalled by nonce gaps, nil if not collected
+	receipts []*types.Receipt // The receipts of the transactions in the block
+	view     *MempoolView     // The summary of the pending transactions, nil if not collected
+	starved  bool             // Flag whether none of the available pending transactions is included
+	gain     *big.Int         // The balance increase of the fee recipient, nil if not measured
+}
+
+// PayloadUpdate is the diagnostic record of a full-block update, it contains the
+// transactions newly included compared with the previous best block.
+type PayloadUpdate struct {
+	Elapsed time.Duration // The time passed since the payload was created
+	Fees    *big.Int      // The transaction fees of the new best block
+	Added   []common.Hash // The transactions absent from the previous best block
+}
+
+// AllocStats is the approximate memory allocation of the full-block building
+// iterations of a payload. It's derived from the process-wide allocation deltas
+// around the iterations, so the allocations of the concurrent activities, e.g.
+// the other payloads or the transaction gossip, are included too.
+type AllocStats struct {
+	Iterations int    // The number of the sampled iterations
+	Mallocs    uint64 // The cumulative count of the heap objects allocated
+	Bytes      uint64 // The cumulative bytes of the heap objects allocated
+}
+
+// BlockDiff is the difference between two successive best blocks of a payload.
+type BlockDiff struct {
+	Added    []common.Hash // The transactions absent from the prior best block
+	Removed  []common.Hash // The transactions of the prior best block dropped
+	FeeDelta *big.Int      // The fee increase over the prior best block
 }
 
 // Payload wraps the built payload(block waiting for sealing). According to the
 // engine-api specification, EL should build the initial version of the payload
 // which has an empty transaction set and then keep update it in order to maximize
 // the revenue. Therefore, the empty-block here is always available and full-block
-// will be set/updated afterwards.
+// will be set/updated afterwards. In case the empty-block is set asynchronously,
+// the resolving will wait for it until emptyPayloadTimeout.
 type Payload struct {
+	id       beacon.PayloadID
 	empty    *types.Block
 	full     *types.Block
 	fullFees *big.Int
+	fullGain *big.Int      // The balance increase of the fee recipient in the full block, nil if not measured
+	ready    chan struct{} // closed when the empty block is available
 	stop     chan struct{}
+	done     chan struct{} // closed when the background builder exits
 	lock     *sync.Mutex
 	cond     *sync.Cond
+
+	interrupt *int32 // The interrupt signal of the in-flight full-block building
+	err       error  // The reason why the building is given up, nil if it's not
+	forced    bool   // Flag whether the empty block is forced to be resolved
+	pinned    bool   // Flag whether the served block is pinned against the updates
+	committed bool   // Flag whether the served block is committed to a relay bid for good
+	resolved  bool   // Flag whether the payload is resolved by the caller
+	exit      string // The cause of the termination of the background building, empty if running
+
+	label       string          // The caller-supplied label for attributing the payload
+	fork        string          // The consensus-layer fork name the payload targets
+	parentRoot  common.Hash     // The state root of the parent header the payload is built on
+	created     time.Time       // The time when the payload was created
+	timings     PayloadTimings  // The timestamps of the lifecycle stages reached so far
+	deadline    time.Time       // The time when the background building is terminated
+	diagnostics bool            // Flag whether the inclusion diagnostics are recorded
+	updates     []PayloadUpdate // The diagnostic records of full-block updates
+
+	rebuilds    int              // The number of the full blocks built for the payload
+	peakGasUsed uint64           // The highest gas used across all the built full blocks
+	buildTime   time.Duration    // The accumulated wall-clock time spent in building
+	allocs      AllocStats       // The sampled allocations of the building iterations, zero if not profiled
+	fillStop    string           // The condition ended the filling of the current full block
+	stalled     []StalledAccount // The accounts stalled by nonce gaps in the current full block
+	view        *MempoolView     // The summary of the pending transactions the current full block is filled from
+	starved     bool             // Flag whether the current full block includes none of the available pending transactions
+	retain      bool             // Flag whether the receipts of the current full block are retained
+	receipts    []*types.Receipt // The receipts of the current full block, nil if not retained
+	minTxs      int              // The advisory minimum number of transactions, zero means no preference
+	signer      types.Signer     // The signer for recovering the senders, nil means deriving from the chain id
+	senders     int              // The cached number of the distinct senders in the current full block
+	sendersOf   *types.Block     // The full block the cached sender number belongs to
+	tieBreak    bool             // Flag whether the fee ties are broken by the lowest block hash
+	feesDigits  int              // The significant digits of the fees reported in ether, zero means the default
+	skipEmpty   bool             // Flag whether the transaction-less full blocks are skipped
+	idle        bool             // Flag whether a transaction-less full block is skipped as the empty one
+	replaced    int              // The number of the transactions replaced by their fee-bumped versions
+	keepPrev    bool             // Flag whether the prior best block is retained for diffing
+	prev        *types.Block     // The prior best block, nil if not retained or it's the empty one
+	prevFees    *big.Int         // The fees of the prior best block
+	requireGain bool             // Flag whether the full blocks must increase the fee recipient balance
+
+	veto          func(*types.Block) bool            // The function for discarding the full blocks, nil means never
+	onCandidate   func(*types.Block, *big.Int, bool) // The callback notified of every full block built, nil means none
+	onSuperseded  func(old, new *big.Int)            // The callback notified of the replaced full blocks, nil means none
+	built         chan<- *types.Block                // The channel for publishing the accepted full blocks, nil means none
+	margin        *big.Int                           // The premium over the relay bids for proposing, nil means none
+	riskWeights   *PropagationWeights                // The weights of the propagation risk score, nil means the default
+	compare       func(a, b *candidateStats) int     // The valuation for picking the best full block
+	maxCandidates int                                // The maximum number of the retained candidates
+	candidates    []*candidate                       // The best distinct full blocks, sorted by fees
+}
+
+// BuildObjective is the preset valuation of the payload full blocks, deciding
+// which of the built blocks is the best one.
+type BuildObjective uint8
+
+const (
+	BuildMaxFees    BuildObjective = iota // Prefer the highest transaction fees
+	BuildMaxTxs                           // Prefer the most transactions, e.g. for throughput benchmarks
+	BuildMaxGasUsed                       // Prefer the most gas used
+)
+
+// String implements fmt.Stringer.
+func (o BuildObjective) String() string {
+	switch o {
+	case BuildMaxFees:
+		return "max-fees"
+	case BuildMaxTxs:
+		return "max-txs"
+	case BuildMaxGasUsed:
+		return "max-gas-used"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(o))
+	}
+}
+
+// comparator returns the valuation of the objective, the ties are broken by
+// the fees. Nil is returned for an unknown objective.
+func (o BuildObjective) comparator() func(a, b *candidateStats) int {
+	switch o {
+	case BuildMaxFees:
+		return compareFees
+	case BuildMaxTxs:
+		return func(a, b *candidateStats) int {
+			if a.txs != b.txs {
+				return a.txs - b.txs
+			}
+			return compareFees(a, b)
+		}
+	case BuildMaxGasUsed:
+		return func(a, b *candidateStats) int {
+			switch {
+			case a.gasUsed > b.gasUsed:
+				return 1
+			case a.gasUsed < b.gasUsed:
+				return -1
+			}
+			return compareFees(a, b)
+		}
+	default:
+		return nil
+	}
+}
+
+// candidateStats bundles the metrics of a full block for the valuation.
+type candidateStats struct {
+	fees    *big.Int // The transaction fees of the block
+	gasUsed uint64   // The gas used by the block
+	txs     int      // The number of transactions in the block
+}
+
+// newCandidateStats collects the metrics of the given block.
+func newCandidateStats(block *types.Block, fees *big.Int) *candidateStats {
+	return &candidateStats{fees: fees, gasUsed: block.GasUsed(), txs: len(block.Transactions())}
+}
+
+// compareFees is the default valuation of the full blocks, comparing the
+// transaction fees. In post-merge stage, there is no uncle reward anymore and
+// transaction fee(apart from the mev revenue) is the only indicator.
+func compareFees(a, b *candidateStats) int {
+	return a.fees.Cmp(b.fees)
+}
+
+// candidate is a distinct full block built for the payload.
+type candidate struct {
+	block *types.Block
+	fees  *big.Int
+}
+
+// Bid is the relay bid of a payload, it packages the header of the best block
+// and the value paid to the fee recipient, signed by the builder. The relay
+// protocol specifics are left to the caller.
+type Bid struct {
+	Header    *types.Header // Header of the bid block
+	Value     *big.Int      // Value of the bid block, namely the transaction fees in Wei
+	Signature []byte        // Builder signature of the RLP encoded [header, value]
+}
+
+// newPayload initializes the payload object. The empty block can be absent and
+// set afterwards with setEmpty.
+func newPayload(empty *types.Block) *Payload {
+	lock := new(sync.Mutex)
+	payload := &Payload{
+		ready:   make(chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		lock:    lock,
+		cond:    sync.NewCond(lock),
+		created: time.Now(),
+		compare: compareFees,
+	}
+	payload.timings.Started = payload.created
+	if empty != nil {
+		payload.setEmpty(empty)
+	}
+	return payload
+}
+
+// setEmpty sets the empty block and marks the payload as ready for resolving.
+// The empty block can only be set once.
+func (payload *Payload) setEmpty(empty *types.Block) {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if payload.empty == nil {
+		payload.empty = empty
+		payload.timings.EmptyReady = time.Now()
+		close(payload.ready)
+	}
+}
+
+// waitEmpty waits until the empty block is available, at most emptyPayloadTimeout.
+// The lock must not be held by the caller.
+func (payload *Payload) waitEmpty() {
+	select {
+	case <-payload.ready:
+		return
+	default:
+	}
+	timer := time.NewTimer(emptyPayloadTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-payload.ready:
+	case <-timer.C:
+		log.Warn("Timed out waiting for the empty payload", "timeout", emptyPayloadTimeout)
+	}
+}
+
+// best returns the current best block along with its transaction fees, it can
+// be nil if the empty block is not ready yet. The lock must be held by the caller.
+func (payload *Payload) best() (*types.Block, *big.Int) {
+	if payload.full != nil && !payload.forced {
+		return payload.full, payload.fullFees
+	}
+	return payload.empty, new(big.Int)
+}
+
+// update updates the full-block with latest built version.
+func (payload *Payload) update(block *types.Block, fees *big.Int) {
+	payload.updateFull(block, fees, new(fillReport))
+}
+
+// updateFull is identical to update, but it also records the outcome of the
+// transaction filling of the block.
+func (payload *Payload) updateFull(block *types.Block, fees *big.Int, report *fillReport) {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	select {
+	case <-payload.stop:
+		return // reject stale update
+	default:
+	}
+	payload.rebuilds++
+	if block.GasUsed() > payload.peakGasUsed {
+		payload.peakGasUsed = block.GasUsed()
+	}
+	// A full block without any transaction, e.g. built from an idle txpool, is
+	// deemed equivalent to the empty block and skipped, even though it may
+	// differ in minor details like the rewards. It avoids the needless churn of
+	// the served blocks, unless they're explicitly configured to be stored. The
+	// starvation is still recorded, the empty block includes nothing either.
+	if len(block.Transactions()) == 0 && payload.skipEmpty {
+		log.Trace("Skipped transaction-less payload block", "number", block.Number(), "hash", block.Hash())
+		if payload.full == nil {
+			payload.starved = report.starved
+		}
+		payload.idle = true
+		payload.cond.Broadcast()
+		return
+	}
+	if payload.veto != nil && payload.veto(block) {
+		log.Debug("Discarded vetoed payload block", "number", block.Number(), "hash", block.Hash(), "fees", fees)
+		payload.notifyCandidate(block, fees, false)
+		payload.cond.Broadcast()
+		return
+	}
+	if payload.requireGain && (report.gain == nil || report.gain.Sign() <= 0) {
+		log.Warn("Discarded payload block without recipient gain", "number", block.Number(), "hash", block.Hash(), "fees", fees, "gain", report.gain)
+		payload.notifyCandidate(block, fees, false)
+		payload.cond.Broadcast()
+		return
+	}
+	// Ensure the newly provided full block is more valuable, namely has a
+	// higher transaction fee by default. The served block is kept if it's
+	// pinned, the forgone one is only logged.
+	better := payload.full == nil || payload.better(block, fees)
+	if better && payload.pinned {
+		_, served := payload.best()
+		log.Debug("Pinned payload forgoes better block", "number", block.Number(), "hash", block.Hash(), "fees", fees, "served", served)
+		better = false
+	}
+	if better {
+		if payload.diagnostics {
+			payload.updates = append(payload.updates, PayloadUpdate{
+				Elapsed: time.Since(payload.created),
+				Fees:    new(big.Int).Set(fees),
+				Added:   addedTxs(payload.full, block),
+			})
+		}
+		markPayloadFees(time.Since(payload.created), fees)
+
+		if n := replacedTxs(payload.signer, payload.full, block); n > 0 {
+			log.Debug("Picked up replaced transactions", "number", block.Number(), "hash", block.Hash(), "replaced", n)
+			payload.replaced += n
+		}
+		if payload.keepPrev {
+			payload.prev, payload.prevFees = payload.full, payload.fullFees
+		}
+		if payload.full != nil && payload.onSuperseded != nil {
+			go payload.onSuperseded(new(big.Int).Set(payload.fullFees), new(big.Int).Set(fees))
+		}
+		now := time.Now()
+		if payload.full == nil {
+			payload.timings.FirstFull = now
+			payloadFirstFullTimer.UpdateSince(payload.created)
+		}
+		payload.timings.LastUpdate = now
+
+		payload.full = block
+		payload.fullFees = fees
+		payload.fullGain = report.gain
+		payload.publish(block)
+		payload.fillStop, payload.stalled, payload.view = report.stop, report.stalled, report.view
+		payload.starved = report.starved
+		if payload.retain {
+			payload.receipts = report.receipts
+		}
+	}
+	if payload.maxCandidates > 1 {
+		payload.addCandidate(block, fees)
+	}
+	payload.notifyCandidate(block, fees, better)
+	payload.cond.Broadcast() // fire signal for notifying full block
+}
+
+// publish hands the accepted full block over to the subscribers of the built
+// blocks without blocking, it's dropped if the delivery falls behind.
+func (payload *Payload) publish(block *types.Block) {
+	if payload.built == nil {
+		return
+	}
+	select {
+	case payload.built <- block:
+	default:
+		log.Debug("Dropped built block notification", "number", block.Number(), "hash", block.Hash())
+	}
+}
+
+// notifyCandidate reports the built full block to the candidate callback if
+// it's set, without blocking the caller.
+func (payload *Payload) notifyCandidate(block *types.Block, fees *big.Int, accepted bool) {
+	if payload.onCandidate != nil {
+		go payload.onCandidate(block, new(big.Int).Set(fees), accepted)
+	}
+}
+
+// better reports whether the given block should replace the current full block.
+// A block reaching the minimum number of transactions is preferred over the one
+// falling short regardless of the fees, otherwise the fees decide. The ties are
+// broken by the lowest block hash if it's enabled, so that the replicas building
+// the same blocks converge on the same one. The lock must be held by the caller.
+func (payload *Payload) better(block *types.Block, fees *big.Int) bool {
+	if payload.minTxs > 0 {
+		have, want := len(payload.full.Transactions()) >= payload.minTxs, len(block.Transactions()) >= payload.minTxs
+		if have != want {
+			return want
+		}
+	}
+	cmp := payload.compare(newCandidateStats(block, fees), newCandidateStats(payload.full, payload.fullFees))
+	if cmp == 0 && payload.tieBreak {
+		return bytes.Compare(block.Hash().Bytes(), payload.full.Hash().Bytes()) < 0
+	}
+	return cmp > 0
+}
+
+// addCandidate inserts the block into the candidate set if it's distinct and
+// ranks within the best ones. The lock must be held by the caller.
+func (payload *Payload) addCandidate(block *types.Block, fees *big.Int) {
+	for _, c := range payload.candidates {
+		if c.block.Hash() == block.Hash() {
+			return
+		}
+	}
+	stats := newCandidateStats(block, fees)
+	index := sort.Search(len(payload.candidates), func(i int) bool {
+		c := payload.candidates[i]
+		return payload.compare(newCandidateStats(c.block, c.fees), stats) < 0
+	})
+	if index >= payload.maxCandidates {
+		return
+	}
+	payload.candidates = append(payload.candidates, nil)
+	copy(payload.candidates[index+1:], payload.candidates[index:])
+	payload.candidates[index] = &candidate{block: block, fees: fees}
+
+	if len(payload.candidates) > payload.maxCandidates {
+		payload.candidates = payload.candidates[:payload.maxCandidates]
+	}
+}
+
+// Candidates returns the best distinct full blocks built so far, sorted by the
+// valuation in descending order, namely the transaction fees by default. Unless
+// the candidate retention is enabled in the miner config, only the latest best
+// block is returned.
+func (payload *Payload) Candidates() []*beacon.ExecutableDataV1 {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if len(payload.candidates) == 0 {
+		if block, _ := payload.best(); block != nil {
+			return []*beacon.ExecutableDataV1{beacon.BlockToExecutableData(block)}
+		}
+		return nil
+	}
+	candidates := make([]*beacon.ExecutableDataV1, 0, len(payload.candidates))
+	for _, c := range payload.candidates {
+		candidates = append(candidates, beacon.BlockToExecutableData(c.block))
+	}
+	return candidates
+}
+
+// Diagnostics returns the diagnostic records of all accepted full-block updates
+// in order. Nothing is recorded unless the payload diagnostics are enabled in
+// the miner config.
+func (payload *Payload) Diagnostics() []PayloadUpdate {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	updates := make([]PayloadUpdate, len(payload.updates))
+	copy(updates, payload.updates)
+	return updates
+}
+
+// FillRatio returns the ratio of the gas used to the gas limit of the current
+// best block. Note it's measured against the block's gas limit rather than the
+// EIP-1559 gas target, and it's 0 for the empty block without gas used.
+func (payload *Payload) FillRatio() float64 {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	block, _ := payload.best()
+	if block == nil || block.GasUsed() == 0 || block.GasLimit() == 0 {
+		return 0
+	}
+	return float64(block.GasUsed()) / float64(block.GasLimit())
+}
+
+// PeakGasUsed returns the highest gas used across all the full blocks built for
+// the payload, including the ones discarded for lower fees. It reveals whether
+// the block ever got close to the gas limit within the build window.
+func (payload *Payload) PeakGasUsed() uint64 {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	return payload.peakGasUsed
+}
+
+// Report returns the consolidated summary of the payload building. It's meant to
+// be called after the payload is resolved, but it's safe to call at any time to
+// peek the progress. The block-related fields are zero if no block is ready yet.
+func (payload *Payload) Report() BuildReport {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	report := BuildReport{
+		ID:          payload.id,
+		Label:       payload.label,
+		Rebuilds:    payload.rebuilds,
+		PeakGasUsed: payload.peakGasUsed,
+		Fees:        new(big.Int),
+		Full:        payload.full != nil && !payload.forced,
+		FillStop:    payload.fillStop,
+		BuildTime:   payload.buildTime,
+		Err:         payload.err,
+	}
+	if block, fees := payload.best(); block != nil {
+		report.Parent = block.ParentHash()
+		report.Timestamp = block.Time()
+		report.GasUsed = block.GasUsed()
+		report.Fees.Set(fees)
+	}
+	return report
+}
+
+// Timings returns the timestamps of the lifecycle stages the payload reached so
+// far, for breaking down the latency of the slot.
+func (payload *Payload) Timings() PayloadTimings {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	return payload.timings
+}
+
+// record returns the retained outcome of the payload, nil if it isn't resolved.
+func (payload *Payload) record() *PayloadRecord {
+	report := payload.Report()
+
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if !payload.resolved {
+		return nil
+	}
+	block, _ := payload.best()
+	return &PayloadRecord{Report: report, Block: block}
+}
+
+// StalledAccounts returns the accounts whose transactions are stalled by nonce
+// gaps in the current best block, namely the next transaction has a higher nonce
+// than the expected one. It's only collected if the payload diagnostics are
+// enabled in the miner config.
+func (payload *Payload) StalledAccounts() []StalledAccount {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	return append([]StalledAccount(nil), payload.stalled...)
+}
+
+// Starved reports whether the current best block includes none of the pending
+// transactions although some are available, e.g. all of them fail or are
+// unaffordable. It's a suspicious condition worth investigating, such as a
+// corrupted state or a bad base fee. Note the transactions skipped by the
+// configured policies, e.g. the address blocklist, count as not included.
+func (payload *Payload) Starved() bool {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	return !payload.forced && payload.starved
+}
+
+// MempoolView returns the summary of the pending transactions the current best
+// block is filled from. It's only collected if the payload diagnostics are
+// enabled in the miner config, nil is returned otherwise or for the empty block.
+func (payload *Payload) MempoolView() *MempoolView {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if payload.full == nil || payload.forced {
+		return nil
+	}
+	return payload.view
+}
+
+// FillStopReason returns the condition which ended the transaction filling of
+// the current best block, one of the FillStop constants. It reveals whether the
+// block is limited by the gas limit or by the pending transactions. It's empty
+// if no full block is built yet.
+func (payload *Payload) FillStopReason() string {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	return payload.fillStop
+}
+
+// BuildCPUTime returns the time consumed by building the payload, accumulated
+// across all the block generations including the empty one. Note it's measured
+// in wall-clock time as an approximation, which includes the time the building
+// waited for being scheduled, e.g. behind the other sealing tasks.
+func (payload *Payload) BuildCPUTime() time.Duration {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	return payload.buildTime
+}
+
+// addBuildTime accumulates the time spent in a block generation.
+func (payload *Payload) addBuildTime(elapsed time.Duration) {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	payload.buildTime += elapsed
+}
+
+// AllocStats returns the approximate memory allocation of the full-block building
+// iterations so far, e.g. for spotting the GC pressure of aggressive recommit
+// intervals. It's only sampled if the profiling is enabled in the miner config
+// since reading the memory statistics stops the world, zero is returned
+// otherwise.
+func (payload *Payload) AllocStats() AllocStats {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	return payload.allocs
+}
+
+// addAllocs accumulates the allocation of a building iteration given the memory
+// statistics before and after it.
+func (payload *Payload) addAllocs(before, after *runtime.MemStats) {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	payload.allocs.Iterations++
+	payload.allocs.Mallocs += after.Mallocs - before.Mallocs
+	payload.allocs.Bytes += after.TotalAlloc - before.TotalAlloc
+}
+
+// UniqueSenders returns the number of the distinct senders in the current best
+// block, e.g. for detecting blocks dominated by a single spammer. It's zero for
+// the empty block. The result is cached per full block, and the recovered
+// senders are cached by the transactions themselves.
+func (payload *Payload) UniqueSenders() int {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if payload.full == nil || payload.forced {
+		return 0
+	}
+	if payload.sendersOf == payload.full {
+		return payload.senders
+	}
+	senders := make(map[common.Address]struct{})
+	for _, tx := range payload.full.Transactions() {
+		signer := payload.signer
+		if signer == nil {
+			signer = types.LatestSignerForChainID(tx.ChainId())
+		}
+		from, err := types.Sender(signer, tx)
+		if err != nil {
+			continue
+		}
+		senders[from] = struct{}{}
+	}
+	payload.senders, payload.sendersOf = len(senders), payload.full
+	return payload.senders
+}
+
+// Replacements returns the number of the transactions picked up by the payload
+// in place of the ones of its previous best block, replaced in the mempool with
+// the same nonce during the building.
+func (payload *Payload) Replacements() int {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	return payload.replaced
+}
+
+// DiffFromPrevious returns the changes of the current best block compared with
+// the immediately prior one, namely the empty block for the first full block,
+// e.g. for finding out what the last re-building brought. The prior block is
+// only retained if it's enabled in the miner config, the zero diff is returned
+// otherwise or if no full block is built yet.
+func (payload *Payload) DiffFromPrevious() BlockDiff {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if !payload.keepPrev || payload.full == nil {
+		return BlockDiff{}
+	}
+	diff := BlockDiff{
+		Added:    addedTxs(payload.prev, payload.full),
+		FeeDelta: new(big.Int).Set(payload.fullFees),
+	}
+	if payload.prev != nil {
+		diff.Removed = addedTxs(payload.full, payload.prev)
+		diff.FeeDelta.Sub(diff.FeeDelta, payload.prevFees)
+	}
+	return diff
+}
+
+// Receipts returns the receipts of the current best block, with the block
+// location fields filled, e.g. for indexing the block without re-executing it.
+// They are only retained if it's enabled in the miner config, nil is returned
+// otherwise or for the empty block.
+func (payload *Payload) Receipts() types.Receipts {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if payload.full == nil || payload.forced || payload.receipts == nil {
+		return nil
+	}
+	var (
+		hash     = payload.full.Hash()
+		receipts = make(types.Receipts, len(payload.receipts))
+	)
+	for i, r := range payload.receipts {
+		receipt := new(types.Receipt)
+		*receipt = *r
+
+		receipt.BlockHash = hash
+		receipt.BlockNumber = payload.full.Number()
+		receipt.TransactionIndex = uint(i)
+
+		receipt.Logs = make([]*types.Log, len(r.Logs))
+		for j, l := range r.Logs {
+			log := new(types.Log)
+			*log = *l
+			log.BlockHash = hash
+			receipt.Logs[j] = log
+		}
+		receipts[i] = receipt
+	}
+	return receipts
+}
+
+// TxFeeBreakdown returns the fees contributed by the transactions of the current
+// best block, sorted descending, e.g. for attributing the block value. It relies
+// on the retained receipts, nil is returned if they are not retained or for the
+// empty block.
+func (payload *Payload) TxFeeBreakdown() []TxFee {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if payload.full == nil || payload.forced || payload.receipts == nil {
+		return nil
+	}
+	var (
+		txs  = payload.full.Transactions()
+		fees = make([]TxFee, len(txs))
+	)
+	for i, tx := range txs {
+		tip, _ := tx.EffectiveGasTip(payload.full.BaseFee())
+		fees[i] = TxFee{
+			Hash: tx.Hash(),
+			Fee:  new(big.Int).Mul(tip, new(big.Int).SetUint64(payload.receipts[i].GasUsed)),
+		}
+	}
+	sort.SliceStable(fees, func(i, j int) bool {
+		return fees[i].Fee.Cmp(fees[j].Fee) > 0
+	})
+	return fees
+}
+
+// WorthProposing reports whether the current best block is worth proposing over
+// the given relay bid, namely its value is at least the bid plus the configured
+// margin. It's always worth proposing if there is no bid.
+func (payload *Payload) WorthProposing(relayBid *big.Int) bool {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if relayBid == nil {
+		return true
+	}
+	want := relayBid
+	if payload.margin != nil {
+		want = new(big.Int).Add(relayBid, payload.margin)
+	}
+	_, fees := payload.best()
+	return fees.Cmp(want) >= 0
+}
+
+// CurrentFees returns the transaction fees of the current best block, zero for
+// the empty block.
+func (payload *Payload) CurrentFees() *big.Int {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	_, fees := payload.best()
+	return new(big.Int).Set(fees)
+}
+
+// defaultFeesETHDigits is the default number of the significant digits of the
+// fees reported in ether, a bit less than the float64 precision so that the
+// rounding noise of the conversion is cut off.
+const defaultFeesETHDigits = 15
+
+// FeesETH returns the transaction fees of the current best block in ether,
+// rounded to the configured significant digits, e.g. for logging and display.
+// The same fees always yield the same float, but use CurrentFees for making
+// any decision since the float loses precision.
+func (payload *Payload) FeesETH() float64 {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	_, fees := payload.best()
+	return weiToEther(fees, payload.feesDigits)
+}
+
+// BidValue returns the value of the current best block as defined for the value
+// field of the relay bids, namely the balance increase of the fee recipient from
+// the parent state to the end of the block execution. Unlike the fees, it covers
+// the direct payments to the recipient, e.g. the coinbase transfers of searchers,
+// and the engine rewards credited before the merge, while the transactions sent
+// by the recipient itself reduce it by their cost. In the builder payout mode it
+// equals the paid amount. It's zero for the empty block.
+func (payload *Payload) BidValue() *big.Int {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if payload.full == nil || payload.forced {
+		return new(big.Int)
+	}
+	if payload.fullGain == nil {
+		return new(big.Int).Set(payload.fullFees) // not measured, e.g. set by tests
+	}
+	return new(big.Int).Set(payload.fullGain)
+}
+
+// weiToEther converts the wei amount to ether rounded to the given significant
+// digits, zero or negative means the default ones.
+func weiToEther(wei *big.Int, digits int) float64 {
+	if digits <= 0 {
+		digits = defaultFeesETHDigits
+	}
+	ether := new(big.Float).Quo(new(big.Float).SetInt(wei), new(big.Float).SetInt(big.NewInt(params.Ether)))
+	value, _ := strconv.ParseFloat(ether.Text('g', digits), 64)
+	return value
+}
+
+// FeePerGas returns the fee density of the current best block, namely the total
+// transaction tips divided by the gas used, in Wei. It's zero for the empty block.
+func (payload *Payload) FeePerGas() *big.Int {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if payload.full == nil || payload.forced || payload.full.GasUsed() == 0 {
+		return new(big.Int)
+	}
+	return new(big.Int).Div(payload.fullFees, new(big.Int).SetUint64(payload.full.GasUsed()))
+}
+
+// PropagationWeights are the weights of the components of the propagation risk
+// score, the encoded block size is weighed per MiB and the gas used per full
+// gas limit.
+type PropagationWeights struct {
+	Size float64
+	Gas  float64
+}
+
+// defaultPropagationWeights weighs a block of one MiB twice as a full one, as
+// the bandwidth rather than the execution dominates the propagation delay then.
+var defaultPropagationWeights = PropagationWeights{Size: 1, Gas: 0.5}
+
+// PropagationRiskScore returns a heuristic of the risk that the current best
+// block doesn't propagate in time, combining the encoded size and the gas used
+// with the configured weights. Higher is riskier, the score of the empty block
+// is near zero. It's only advisory, e.g. for picking a leaner block over a fat
+// one at comparable value, and not calibrated against the actual network. The
+// blob count isn't considered since the blob transactions aren't supported.
+func (payload *Payload) PropagationRiskScore() float64 {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	block, _ := payload.best()
+	if block == nil {
+		return 0
+	}
+	weights := defaultPropagationWeights
+	if payload.riskWeights != nil {
+		weights = *payload.riskWeights
+	}
+	score := weights.Size * float64(block.Size()) / (1 << 20)
+	if limit := block.GasLimit(); limit > 0 {
+		score += weights.Gas * float64(block.GasUsed()) / float64(limit)
+	}
+	return score
+}
+
+// RecomputeFees re-runs the valuation of the current best block with the given
+// calculator without rebuilding it, e.g. for trying a different metric. Nil
+// means the default transaction tip sum. Note the custom block subsidy isn't
+// added, only the calculator decides. Since the valuation works on receipts, it
+// requires Config.RetainReceipts, nil is returned otherwise. It's zero for the
+// empty block.
+func (payload *Payload) RecomputeFees(calc FeeCalculator) *big.Int {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if payload.full == nil || payload.forced {
+		return new(big.Int)
+	}
+	if !payload.retain {
+		return nil
+	}
+	if calc == nil {
+		return totalFees(payload.full, payload.receipts)
+	}
+	return calc.Fees(payload.full, payload.receipts)
+}
+
+// TipDistribution returns the effective tips per gas of the transactions in the
+// current best block, sorted in ascending order, e.g. for telling whether the
+// block value is dominated by a few high-tip transactions. It's cheap even for
+// large blocks, so it's computed on demand without being gated. It's empty for
+// the empty block.
+func (payload *Payload) TipDistribution() []*big.Int {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if payload.full == nil || payload.forced {
+		return nil
+	}
+	baseFee := payload.full.BaseFee()
+	tips := make([]*big.Int, 0, len(payload.full.Transactions()))
+	for _, tx := range payload.full.Transactions() {
+		tip, err := tx.EffectiveGasTip(baseFee)
+		if err != nil {
+			continue // can't happen for the included ones
+		}
+		tips = append(tips, tip)
+	}
+	sort.Slice(tips, func(i, j int) bool { return tips[i].Cmp(tips[j]) < 0 })
+	return tips
+}
+
+// CloneBest returns an independent copy of the current best block without
+// terminating the background building, falling back to the empty block if no
+// full block is built yet. The header and the body lists are copied, while the
+// transactions are shared as they are immutable. The copy is unaffected by the
+// subsequent updates of the payload. Nil is returned if the empty block is not
+// ready yet.
+func (payload *Payload) CloneBest() *types.Block {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	block, _ := payload.best()
+	if block == nil {
+		return nil
+	}
+	return types.NewBlockWithHeader(block.Header()).WithBody(block.Transactions(), block.Uncles())
+}
+
+// LogsBloom returns the logs bloom of the current best block, falling back to
+// the empty block's one if no full block is built yet.
+func (payload *Payload) LogsBloom() types.Bloom {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	block, _ := payload.best()
+	if block == nil {
+		return types.Bloom{}
+	}
+	return block.Bloom()
+}
+
+// TimeRemaining returns the time left until the background building reaches its
+// deadline, e.g. for deciding whether it's worth waiting for another re-build
+// or resolving now. Zero is returned if the building is already stopped.
+func (payload *Payload) TimeRemaining() time.Duration {
+	select {
+	case <-payload.stop:
+		return 0
+	default:
+	}
+	if payload.deadline.IsZero() {
+		return 0
+	}
+	if remaining := time.Until(payload.deadline); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// Fork returns the consensus-layer name of the fork the payload targets, e.g.
+// for picking the bid encoding. It's empty if the fork is not determined.
+func (payload *Payload) Fork() string {
+	return payload.fork
+}
+
+// forkName returns the consensus-layer name of the fork active at the given
+// block number. Note the post-merge forks are scheduled by block number in
+// this chain config.
+func forkName(config *params.ChainConfig, number *big.Int) string {
+	switch {
+	case config.IsCancun(number):
+		return "deneb"
+	case config.IsShanghai(number):
+		return "capella"
+	default:
+		return "bellatrix"
+	}
+}
+
+// ForceEmpty is the safety lever for the incident response, e.g. a suspicious
+// transaction is spotted in the full block. It makes the payload resolve to the
+// empty block from now on regardless of the full blocks built, and terminates
+// the background building so that no further update is accepted. It can't be
+// reverted.
+func (payload *Payload) ForceEmpty() {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if !payload.forced {
+		log.Warn("Forcing payload to resolve the empty block", "id", payload.id)
+	}
+	payload.forced = true
+	payload.terminate()
+}
+
+// PinCurrent freezes the block served by Resolve at the current best one, e.g.
+// once a relay has committed to a bid. The background building keeps running
+// and the better blocks are still vetted and logged, but they don't replace the
+// served block until Unpin is called.
+func (payload *Payload) PinCurrent() {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	payload.pinned = true
+}
+
+// Unpin lifts the pinning of the served block, the subsequent better blocks
+// replace it again. Note the blocks forgone while pinned are not restored. It
+// has no effect once the block is committed to a bid.
+func (payload *Payload) Unpin() {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if payload.committed {
+		return
+	}
+	payload.pinned = false
+}
+
+// CommitBid freezes the payload at the current best block for good once it's
+// bid to a relay, returning the committed block and its value. The subsequent
+// resolving returns exactly this block, so the consensus client can't pull a
+// block other than the bid one. The trade-off is that the later improvements
+// are forgone, hence the background building is terminated right away, unlike
+// PinCurrent which can be lifted. Only ForceEmpty overrides the commitment, the
+// incident response takes precedence over the bid. Nil is returned if the empty
+// block isn't available yet, nothing is committed then.
+func (payload *Payload) CommitBid() (*types.Block, *big.Int) {
+	payload.waitEmpty()
+
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	block, fees := payload.best()
+	if block == nil {
+		return nil, nil
+	}
+	payload.committed, payload.pinned = true, true
+	payload.terminate()
+	return block, new(big.Int).Set(fees)
+}
+
+// Err returns the reason why the background building was given up, e.g. due to
+// producing invalid blocks repeatedly. The payload can still be resolved with
+// the blocks built before. Nil is returned if it's not given up.
+func (payload *Payload) Err() error {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	return payload.err
+}
+
+// abort records the reason and terminates the background building.
+func (payload *Payload) abort(err error) {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	payload.err = err
+	payload.terminate()
+}
+
+// ParentStateRoot returns the state root of the parent header the payload is
+// built on, e.g. for cross-checking against the canonical chain that no stale
+// state is used. Note the state overrides, if any, are not reflected.
+func (payload *Payload) ParentStateRoot() common.Hash {
+	return payload.parentRoot
 }
 
-// newPayload initializes the payload object.
-func newPayload(empty *types.Block) *Payload {
-	lock := new(sync.Mutex)
-	return &Payload{
-		empty: empty,
-		stop:  make(chan struct{}),
-		lock:  lock,
-		cond:  sync.NewCond(lock),
+// Timestamp returns the timestamp of the payload blocks, which is exactly the
+// requested one.
+func (payload *Payload) Timestamp() uint64 {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if payload.empty == nil {
+		return 0
 	}
+	return payload.empty.Time()
 }
 
-// update updates the full-block with latest built version.
-func (payload *Payload) update(block *types.Block, fees *big.Int) {
+// Label returns the caller-supplied label of the payload.
+func (payload *Payload) Label() string {
+	return payload.label
+}
+
+// String implements fmt.Stringer.
+func (payload *Payload) String() string {
 	payload.lock.Lock()
 	defer payload.lock.Unlock()
 
-	select {
-	case <-payload.stop:
-		return // reject stale update
-	default:
+	block, fees := payload.best()
+	if block == nil {
+		return fmt.Sprintf("Payload{label: %q, fork: %s, pending}", payload.label, payload.fork)
 	}
-	// Ensure the newly provided full block has a higher transaction fee.
-	// In post-merge stage, there is no uncle reward anymore and transaction
-	// fee(apart from the mev revenue) is the only indicator for comparison.
-	if payload.full == nil || fees.Cmp(payload.fullFees) > 0 {
-		payload.full = block
-		payload.fullFees = fees
+	return fmt.Sprintf("Payload{label: %q, fork: %s, number: %d, parent: %x, txs: %d, fees: %v}",
+		payload.label, payload.fork, block.NumberU64(), block.ParentHash(), len(block.Transactions()), fees)
+}
+
+// BuildBid packages the current best block into a relay bid, which is signed by
+// the supplied function over the RLP encoding of the header and the value.
+func (payload *Payload) BuildBid(sign func([]byte) []byte) (*Bid, error) {
+	payload.lock.Lock()
+	block, fees := payload.best()
+	payload.lock.Unlock()
+
+	if block == nil {
+		return nil, errPayloadNotReady
 	}
-	payload.cond.Broadcast() // fire signal for notifying full block
+	header, value := block.Header(), new(big.Int).Set(fees)
+	msg, err := rlp.EncodeToBytes([]interface{}{header, value})
+	if err != nil {
+		return nil, err
+	}
+	return &Bid{Header: header, Value: value, Signature: sign(msg)}, nil
 }
 
 // Resolve returns the latest built payload and also terminates the background
 // thread for updating payload. It's safe to be called multiple times.
 func (payload *Payload) Resolve() *beacon.ExecutableDataV1 {
+	snapshot := payload.ResolveSnapshot()
+	if snapshot == nil {
+		return nil
+	}
+	return snapshot.Data
+}
+
+// ResolveWithValue is identical to Resolve, but it also returns the value of the
+// resolved block, namely the transaction fees of the full block or zero for the
+// empty one. The block and its value are read atomically, so they always belong
+// to the same update. Nil values are returned if the empty block is still not
+// ready.
+func (payload *Payload) ResolveWithValue() (*beacon.ExecutableDataV1, *big.Int) {
+	snapshot := payload.ResolveSnapshot()
+	if snapshot == nil {
+		return nil, nil
+	}
+	return snapshot.Data, snapshot.Value
+}
+
+// ResolveSnapshot is identical to Resolve, but it returns the executable data
+// along with the payload identifier, the block value and whether it's the full
+// block. Nil is returned if the empty block is still not ready.
+func (payload *Payload) ResolveSnapshot() *PayloadSnapshot {
+	payload.waitEmpty()
+
 	payload.lock.Lock()
 	defer payload.lock.Unlock()
 
-	select {
-	case <-payload.stop:
-	default:
-		close(payload.stop)
+	payload.resolved = true
+	payload.terminate()
+	return payload.snapshot()
+}
+
+// Snapshot returns the current best block of the payload along with its details
+// without terminating the building, nil if the empty block is still not ready.
+// The snapshot can be serialized for the submission by another process.
+func (payload *Payload) Snapshot() *PayloadSnapshot {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	return payload.snapshot()
+}
+
+// snapshot assembles the snapshot of the current best block. The lock must be
+// held by the caller.
+func (payload *Payload) snapshot() *PayloadSnapshot {
+	block, fees := payload.best()
+	if block == nil {
+		return nil // the empty block is still not ready
 	}
-	if payload.full != nil {
-		return beacon.BlockToExecutableData(payload.full)
+	return &PayloadSnapshot{
+		ID:    payload.id,
+		Data:  beacon.BlockToExecutableData(block),
+		Value: new(big.Int).Set(fees),
+		Full:  block == payload.full,
+		Label: payload.label,
+		Fork:  payload.fork,
 	}
-	return beacon.BlockToExecutableData(payload.empty)
 }
 
 // ResolveEmpty is basically identical to Resolve, but it expects empty block only.
 // It's only used in tests.
 func (payload *Payload) ResolveEmpty() *beacon.ExecutableDataV1 {
+	payload.waitEmpty()
+
 	payload.lock.Lock()
 	defer payload.lock.Unlock()
 
+	if payload.empty == nil {
+		return nil
+	}
 	return beacon.BlockToExecutableData(payload.empty)
 }
 
@@ -113,7 +1841,7 @@ func (payload *Payload) ResolveFull() *beacon.ExecutableDataV1 {
 	payload.lock.Lock()
 	defer payload.lock.Unlock()
 
-	if payload.full == nil {
+	if payload.full == nil && !payload.idle {
 		select {
 		case <-payload.stop:
 			return nil
@@ -121,48 +1849,812 @@ func (payload *Payload) ResolveFull() *beacon.ExecutableDataV1 {
 		}
 		payload.cond.Wait()
 	}
+	if payload.full == nil {
+		if payload.idle {
+			return beacon.BlockToExecutableData(payload.empty) // equivalent to the skipped full block
+		}
+		return nil // terminated before any full block was built
+	}
 	return beacon.BlockToExecutableData(payload.full)
 }
 
+// terminate closes the stop channel for aborting the background thread and
+// wakes up all the waiters. It's safe to be called multiple times. The lock
+// must be held by the caller.
+func (payload *Payload) terminate() {
+	select {
+	case <-payload.stop:
+	default:
+		close(payload.stop)
+		payload.timings.Stopped = time.Now()
+		payload.cond.Broadcast()
+		if payload.interrupt != nil {
+			atomic.StoreInt32(payload.interrupt, commitInterruptResolve)
+		}
+	}
+}
+
+// setInterrupt registers the interrupt signal of the in-flight building, which
+// is fired once the payload is terminated, so that the building can be aborted
+// as early as possible with the partial block. Nil unregisters it.
+func (payload *Payload) setInterrupt(interrupt *int32) {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	payload.interrupt = interrupt
+	if interrupt == nil {
+		return
+	}
+	select {
+	case <-payload.stop:
+		atomic.StoreInt32(interrupt, commitInterruptResolve)
+	default:
+	}
+}
+
+// recordExit records the cause of the termination of the background building.
+// The stop of the payload is recorded as cancelled, unless it's resolved.
+func (payload *Payload) recordExit(cause string) {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	if payload.timings.Stopped.IsZero() {
+		payload.timings.Stopped = time.Now() // the deadline expiry
+	}
+	if cause == payloadExitCancelled && payload.resolved {
+		cause = payloadExitResolved
+	}
+	payload.exit = cause
+	payloadExitMeters[payload.exit].Mark(1)
+}
+
+// stopBuilding terminates the background thread for updating payload without
+// resolving it. The latest built block is retained and can still be resolved.
+func (payload *Payload) stopBuilding() {
+	payload.lock.Lock()
+	defer payload.lock.Unlock()
+
+	payload.terminate()
+}
+
 // buildPayload builds the payload according to the provided parameters.
 func (w *worker) buildPayload(args *BuildPayloadArgs) (*Payload, error) {
+	// Capture a shallow copy of the arguments, the background building keeps
+	// reading them after returning, so the caller is free to reuse its own.
+	captured := *args
+	args = &captured
+
+	parent := w.chain.GetHeaderByHash(args.Parent)
+	if err := args.Validate(w.chainConfig, parent); err != nil {
+		return nil, err
+	}
+	// Warn about the timestamp far off the local clock, which often indicates
+	// the clock issues leading to rejected blocks. It's not rejected since some
+	// flows legitimately build slightly ahead.
+	if tolerance := w.config.TimestampSkew; tolerance > 0 {
+		if skew := timestampSkew(args.Timestamp, time.Now()); skew > tolerance || skew < -tolerance {
+			log.Warn("Payload timestamp deviates from local clock", "timestamp", args.Timestamp, "skew", common.PrettyDuration(skew), "tolerance", common.PrettyDuration(tolerance))
+		}
+	}
+	// Reject the timestamps way ahead of the local clock though, the blocks
+	// wouldn't be accepted by the network until then anyway.
+	if limit := w.config.MaxFutureTimestamp; limit > 0 {
+		if skew := timestampSkew(args.Timestamp, time.Now()); skew > limit {
+			return nil, fmt.Errorf("%w: timestamp %d, ahead %v, limit %v", errFutureTimestamp, args.Timestamp, common.PrettyDuration(skew), common.PrettyDuration(limit))
+		}
+	}
+	if len(args.Ommers) > 0 {
+		td, ttd := w.chain.GetTd(parent.Hash(), parent.Number.Uint64()), w.chainConfig.TerminalTotalDifficulty
+		if td != nil && ttd != nil && td.Cmp(ttd) >= 0 {
+			return nil, errOmmersPostMerge
+		}
+	}
+	if args.StateOverrides != nil && !w.config.AllowStateOverrides {
+		return nil, errStateOverrideDisabled
+	}
+	if len(args.DisabledPrecompiles) > 0 && !w.config.AllowPrecompileOff {
+		return nil, errPrecompileOffDisabled
+	}
+	if args.Coinbase != (common.Address{}) && w.builderKey != nil && args.Coinbase != w.builderAddr {
+		return nil, fmt.Errorf("%w: coinbase %x, builder %x", errCoinbaseConflict, args.Coinbase, w.builderAddr)
+	}
+	// Fetch the deposits once, so that all the blocks of the payload include
+	// exactly the same ones at the top.
+	if source := w.config.DepositSource; source != nil {
+		deposits, err := source.Deposits(parent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve deposits: %w", err)
+		}
+		args.deposits = deposits
+	}
+	// Abort the in-flight building of the payloads on other parents if it's
+	// allowed, they're most likely obsolete with the new fork choice.
+	if w.config.InterruptSealing {
+		w.interruptSealing(args.Parent)
+	}
 	// Build the initial version with no transaction included. It should be fast
 	// enough to run. The empty payload can at least make sure there is something
 	// to deliver for not missing slot.
-	empty, _, err := w.getSealingBlock(args.Parent, args.Timestamp, args.FeeRecipient, args.Random, true)
+	start := time.Now()
+	empty, _, err := w.getSealingBlock(w.sealingParams(args, true))
 	if err != nil {
 		return nil, err
 	}
+	elapsed := time.Since(start)
+	// Ensure the fee recipient is able to receive the payout if it's required.
+	if mode := w.config.FeeRecipientCheck; mode != "" {
+		if err := w.checkFeeRecipient(empty.Header(), args.FeeRecipient); err != nil {
+			if mode == FeeRecipientCheckError {
+				return nil, err
+			}
+			log.Warn("Fee recipient may not receive the payout", "recipient", args.FeeRecipient, "err", err)
+		}
+	}
 	// Construct a payload object for return.
 	payload := newPayload(empty)
+	payload.timings.Started = start
+	payload.buildTime = elapsed
+	payload.id = args.Id()
+	payload.fork = forkName(w.chainConfig, empty.Number())
+	payload.label = args.Label
+	payload.parentRoot = parent.Root
+	markPayloadBuild(args.Label)
+	payload.diagnostics = w.config.PayloadDiagnostics
+	payload.maxCandidates = w.payloadCandidates
+	payload.minTxs = w.config.MinTxs
+	payload.tieBreak = w.config.TieBreakByHash
+	payload.feesDigits = w.config.FeesETHDigits
+	payload.riskWeights = w.config.PropagationWeights
+	payload.skipEmpty = !w.config.StoreEmptyFull
+	payload.veto = args.BlockVeto
+	payload.requireGain = args.RequireRecipientGain
+	payload.onCandidate = args.OnCandidate
+	payload.onSuperseded = args.OnSuperseded
+	payload.built = w.builtBlockCh
+	payload.retain = w.config.RetainReceipts
+	payload.keepPrev = w.config.RetainPrevious
+	payload.margin = w.config.ProposeMargin
+	payload.signer = types.MakeSigner(w.chainConfig, empty.Number())
+	if w.compareCandidates != nil {
+		payload.compare = w.compareCandidates
+	}
+	// The process is terminated if SECONDS_PER_SLOT (12s in the Mainnet
+	// configuration) have passed since the point in time identified by the
+	// timestamp parameter.
+	payload.deadline = time.Now().Add(w.payloadLifetime)
+	w.trackPayload(payload)
 
 	// Spin up a routine for updating the payload in background. This strategy
 	// can maximum the revenue for including transactions with highest fee.
 	go func() {
+		defer w.untrackPayload(payload)
+
 		// Setup the timer for re-building the payload. The initial clock is kept
-		// for triggering process immediately.
-		timer := time.NewTimer(0)
+		// for triggering process immediately, unless the first full build is
+		// deferred to spread the upfront work.
+		timer := time.NewTimer(w.config.FirstBuildDelay)
 		defer timer.Stop()
 
-		// Setup the timer for terminating the process if SECONDS_PER_SLOT (12s in
-		// the Mainnet configuration) have passed since the point in time identified
-		// by the timestamp parameter.
-		endTimer := time.NewTimer(time.Second * 12)
+		// Setup the timer for terminating the process at the deadline.
+		window := time.Until(payload.deadline)
+		endTimer := time.NewTimer(window)
+
+		// Setup the timer for the final re-build shortly before the deadline, in
+		// order to capture the transactions arrived late in the slot regardless
+		// of the recommit spacing.
+		var finalCh <-chan time.Time
+		if lead := w.config.FinalRebuildLead; lead > 0 && lead < window {
+			finalTimer := time.NewTimer(window - lead)
+			defer finalTimer.Stop()
+			finalCh = finalTimer.C
+		}
+
+		// In the event-driven mode, the payload is only re-built if the txpool
+		// signals new transactions, at most once per recommit interval. The
+		// fallback timer is kept just in case some events are missed.
+		var (
+			txsCh     chan core.NewTxsEvent
+			lastBuild time.Time
+			scheduled bool
+			splice    *spliceCache
+			warned    bool
+			invalids  int
+			rebuilds  int
+			relaxed   bool
+		)
+		// build runs a full-block building iteration with the given parameters.
+		// The building is given up with errTooManyInvalidBlocks if the invalid
+		// blocks are produced repeatedly.
+		build := func(params *generateParams) (*types.Block, *big.Int, error) {
+			params.interrupt = new(int32)
+
+			var before runtime.MemStats
+			if w.config.ProfileAllocs {
+				runtime.ReadMemStats(&before)
+			}
+			start := time.Now()
+			payload.setInterrupt(params.interrupt)
+			block, fees, err := w.getSealingBlockRetry(params, payload.stop)
+			payload.setInterrupt(nil)
+			payload.addBuildTime(time.Since(start))
+			if w.config.ProfileAllocs {
+				var after runtime.MemStats
+				runtime.ReadMemStats(&after)
+				payload.addAllocs(&before, &after)
+			}
+			payloadIterationTimer.UpdateSince(start)
+
+			if err == nil && w.config.ValidateBeforeStore {
+				if err = w.validateSealingBlock(block); err != nil {
+					log.Warn("Discarded invalid payload block", "number", block.Number(), "hash", block.Hash(), "err", err)
+					payloadInvalidMeter.Mark(1)
+
+					// Something is badly wrong if the invalid blocks are produced
+					// repeatedly, stop burning resources and keep the served ones.
+					if invalids++; invalids >= maxInvalidPayloadBlocks {
+						log.Error("Payload building is given up due to repeated invalid blocks", "number", block.Number(), "count", invalids, "err", err)
+						err = fmt.Errorf("%w: %v", errTooManyInvalidBlocks, err)
+						payload.abort(err)
+					}
+				} else {
+					invalids = 0
+				}
+			}
+			return block, fees, err
+		}
+		if w.config.SpliceRebuild {
+			splice = new(spliceCache)
+		}
+		if w.config.EventDrivenRebuild {
+			// The first build is already scheduled, don't let the events bring
+			// it forward.
+			scheduled = true
 
+			txsCh = make(chan core.NewTxsEvent, txChanSize)
+			sub := w.eth.TxPool().SubscribeNewTxsEvent(txsCh)
+			defer sub.Unsubscribe()
+		}
 		for {
 			select {
 			case <-timer.C:
-				block, fees, err := w.getSealingBlock(args.Parent, args.Timestamp, args.FeeRecipient, args.Random, false)
+				params := w.sealingParams(args, false)
+				params.splice = splice
+				params.report = new(fillReport)
+				params.diagnose = w.config.PayloadDiagnostics
+
+				block, fees, err := build(params)
+				if errors.Is(err, errTooManyInvalidBlocks) {
+					payload.recordExit(payloadExitInvalid)
+					return
+				}
 				if err == nil {
-					payload.update(block, fees)
+					payload.updateFull(block, fees, params.report)
+					markPayloadUpdate(args.Label)
+
+					// Fall back to a relaxed build once if the strict one is poor,
+					// the update keeps the better of the two.
+					if threshold := w.config.RelaxOnLowValue; threshold != nil && !relaxed && fees.Cmp(threshold) < 0 {
+						relaxed = true
+						if err := w.relaxedRebuild(payload, params, build); errors.Is(err, errTooManyInvalidBlocks) {
+							payload.recordExit(payloadExitInvalid)
+							return
+						}
+					}
+
+					// The missing transactions can't be forced, but warn once if
+					// the txpool apparently has enough of them.
+					if minTxs := w.config.MinTxs; !warned && len(block.Transactions()) < minTxs {
+						if pending, _ := w.eth.TxPool().Stats(); pending >= minTxs {
+							log.Warn("Payload falls short of minimum transactions", "number", block.Number(), "txs", len(block.Transactions()), "min", minTxs, "pending", pending)
+							warned = true
+						}
+					}
+				}
+				if w.iterHook != nil {
+					result := iterationResult{err: err}
+					if err == nil {
+						result.fees, result.txs = fees, len(block.Transactions())
+					}
+					w.iterHook(result)
+				}
+				// Stop re-building once the iteration cap is reached, the best
+				// block built so far is still resolvable.
+				if rebuilds++; w.config.MaxRebuilds > 0 && rebuilds >= w.config.MaxRebuilds {
+					log.Debug("Payload building reached maximum iterations", "iterations", rebuilds)
+					payload.stopBuilding()
+					payload.recordExit(payloadExitRebuilds)
+					return
+				}
+				lastBuild, scheduled = time.Now(), false
+				if txsCh != nil {
+					timer.Reset(eventRecommitFallback)
+				} else {
+					timer.Reset(w.recommit)
+				}
+			case <-txsCh:
+				// Coalesce the events, re-schedule the timer only once until
+				// the next build. The timer channel is always drained when
+				// it's fired, so it's safe to drain it here if it's expired.
+				if scheduled {
+					continue
+				}
+				if !timer.Stop() {
+					<-timer.C
 				}
-				timer.Reset(w.recommit)
+				timer.Reset(time.Until(lastBuild.Add(w.recommit)))
+				scheduled = true
+			case <-finalCh:
+				// Bring the next build forward, and prevent the events from
+				// postponing it again.
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(0)
+				finalCh, scheduled = nil, true
 			case <-payload.stop:
+				payload.recordExit(payloadExitCancelled)
 				return
 			case <-endTimer.C:
+				payload.recordExit(payloadExitDeadline)
 				return
 			}
 		}
 	}()
 	return payload, nil
 }
+
+// timestampSkew returns the deviation of the given timestamp from the local time,
+// positive if the timestamp is ahead.
+func timestampSkew(timestamp uint64, now time.Time) time.Duration {
+	return time.Unix(int64(timestamp), 0).Sub(now)
+}
+
+// getSealingBlockRetry is identical to getSealingBlock, but it retries with the
+// bounded backoffs if the state is transiently unavailable, rather than giving
+// up the iteration until the next recommit. The retrying is aborted once the
+// given channel is closed.
+func (w *worker) getSealingBlockRetry(params *generateParams, stop chan struct{}) (*types.Block, *big.Int, error) {
+	block, fees, err := w.getSealingBlock(params)
+	for _, backoff := range stateRetryBackoffs {
+		if !errors.Is(err, errStateUnavailable) {
+			break
+		}
+		log.Debug("Retrying payload building with unavailable state", "backoff", backoff, "err", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return nil, nil, err
+		}
+		block, fees, err = w.getSealingBlock(params)
+	}
+	return block, fees, err
+}
+
+// buildPayloadMulti builds the same payload for each of the given fee recipients,
+// e.g. for verifying the payout routing in relay testing. It's not meant to be
+// used for production proposing. The builds share a single snapshot of the
+// pending transactions unless the base arguments specify one, so that they see
+// the same transaction set without contending for the txpool.
+func (w *worker) buildPayloadMulti(base BuildPayloadArgs, recipients []common.Address) ([]*Payload, error) {
+	if base.Pending == nil {
+		base.Pending = w.snapshotPending()
+	}
+	payloads := make([]*Payload, 0, len(recipients))
+	for _, recipient := range recipients {
+		args := base
+		args.FeeRecipient = recipient
+
+		payload, err := w.buildPayload(&args)
+		if err != nil {
+			for _, payload := range payloads {
+				payload.stopBuilding()
+			}
+			return nil, fmt.Errorf("failed to build payload for %v: %w", recipient, err)
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, nil
+}
+
+// checkFeeRecipient probes whether the fee recipient is able to receive value
+// transfers on top of the parent state of the given header.
+func (w *worker) checkFeeRecipient(header *types.Header, recipient common.Address) error {
+	parent := w.chain.GetHeaderByHash(header.ParentHash)
+	if parent == nil {
+		return errors.New("missing parent")
+	}
+	statedb, err := w.chain.StateAt(parent.Root)
+	if err != nil {
+		return err
+	}
+	return w.probeFeeRecipient(statedb, header, recipient)
+}
+
+// probeFeeRecipient simulates a plain value transfer to the fee recipient and
+// returns an error if it's a contract reverting the transfer. The given state
+// is mutated and shouldn't be used afterwards.
+func (w *worker) probeFeeRecipient(statedb *state.StateDB, header *types.Header, recipient common.Address) error {
+	if statedb.GetCodeSize(recipient) == 0 {
+		return nil
+	}
+	var (
+		from  = common.Address{}
+		value = big.NewInt(1)
+	)
+	statedb.AddBalance(from, value)
+
+	evm := vm.NewEVM(core.NewEVMBlockContext(header, w.chain, nil), vm.TxContext{Origin: from, GasPrice: new(big.Int)}, statedb, w.chainConfig, vm.Config{NoBaseFee: true})
+	if _, _, err := evm.Call(vm.AccountRef(from), recipient, nil, feeRecipientProbeGas, value); err != nil {
+		return fmt.Errorf("%w: %v", errFeeRecipientRejects, err)
+	}
+	return nil
+}
+
+// validateSealingBlock re-validates the sealing block through the full block
+// processing path as it would be imported, in order to catch any mismatch
+// between the sealing and the import, e.g. the state root or the receipts.
+func (w *worker) validateSealingBlock(block *types.Block) error {
+	if w.validateHook != nil {
+		if err := w.validateHook(block); err != nil {
+			return err
+		}
+	}
+	if err := w.engine.VerifyHeader(w.chain, block.Header(), false); err != nil {
+		return err
+	}
+	if err := w.chain.Validator().ValidateBody(block); err != nil {
+		return err
+	}
+	parent := w.chain.GetBlock(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil {
+		return consensus.ErrUnknownAncestor
+	}
+	statedb, err := w.chain.StateAt(parent.Root())
+	if err != nil {
+		return err
+	}
+	receipts, _, usedGas, err := w.chain.Processor().Process(block, statedb, *w.chain.GetVMConfig())
+	if err != nil {
+		return err
+	}
+	return w.chain.Validator().ValidateState(block, statedb, receipts, usedGas)
+}
+
+// notifyIncluded invokes the callback for each transaction of the block in the
+// background. The receipts are copied with the block location fields filled.
+func notifyIncluded(block *types.Block, receipts []*types.Receipt, callback func(*types.Transaction, *types.Receipt)) {
+	receipts = copyReceipts(receipts)
+	for i, receipt := range receipts {
+		receipt.BlockHash = block.Hash()
+		receipt.BlockNumber = block.Number()
+		receipt.TransactionIndex = uint(i)
+	}
+	go func() {
+		for i, tx := range block.Transactions() {
+			callback(tx, receipts[i])
+		}
+	}()
+}
+
+// sealingParams converts the payload building arguments to the parameters for
+// generating the sealing block.
+func (w *worker) sealingParams(args *BuildPayloadArgs, noTxs bool) *generateParams {
+	params := &generateParams{
+		timestamp:  args.Timestamp,
+		forceTime:  true,
+		parentHash: args.Parent,
+		coinbase:   args.FeeRecipient,
+		random:     args.Random,
+		noUncle:    true,
+		noExtra:    true,
+		noTxs:      noTxs,
+		extra:      w.payloadExtra,
+		excluded:   w.excluded,
+		allowed:    w.allowed,
+		valuer:     args.TxValuer,
+		appendTxs:  args.AppendTxs,
+		reserveGas: args.ReserveGas,
+		onIncluded: args.OnTxIncluded,
+		pending:    args.Pending,
+		seedTx:     args.SeedTx,
+		deposits:   args.deposits,
+		uncles:     args.Ommers,
+		bundles:    args.Bundles,
+		gasTarget:  args.GasUsedTarget,
+		txTypes:    w.config.AllowedTxTypes,
+		minTxAge:   w.config.MinTxAge,
+		minPrice:   args.MinGasPrice,
+		relayFloor: args.RelayMinGasPrice,
+		senderCap:  w.config.MaxTxsPerSender,
+		overrides:  args.StateOverrides,
+	}
+	if scorer := w.config.AccountScorer; scorer != nil {
+		params.scorer = scorer.Score
+	}
+	if args.OrderSeed != 0 {
+		params.scorer = seededScorer(args.OrderSeed)
+	}
+	if args.Coinbase != (common.Address{}) {
+		params.coinbase = args.Coinbase
+	}
+	if len(args.DisabledPrecompiles) > 0 {
+		params.disabled = make(map[common.Address]struct{})
+		for _, addr := range args.DisabledPrecompiles {
+			params.disabled[addr] = struct{}{}
+		}
+	}
+	if args.ElasticityMultiplier != 0 || args.BaseFeeChangeDenominator != 0 {
+		config := *w.chainConfig
+		if args.ElasticityMultiplier != 0 {
+			config.EIP1559Elasticity = args.ElasticityMultiplier
+		}
+		if args.BaseFeeChangeDenominator != 0 {
+			config.EIP1559Denominator = args.BaseFeeChangeDenominator
+		}
+		params.feeConfig = &config
+	}
+	// Collect the fees with the builder account and pay the profit out to the
+	// fee recipient at the end if it's configured. The empty block is left as
+	// it is, no profit to pay.
+	if w.builderKey != nil && !noTxs && args.FeeRecipient != w.builderAddr {
+		recipient := args.FeeRecipient
+		params.coinbase, params.payout = w.builderAddr, &recipient
+	}
+	return params
+}
+
+// relaxedParams returns a copy of the strict parameters with the optional inclusion
+// filters dropped, namely the gas price floor, the affordability margin and the
+// minimum transaction age. The policy filters, e.g. the address blocklist, are
+// always kept.
+func relaxedParams(strict *generateParams) *generateParams {
+	relaxed := *strict
+	relaxed.minPrice, relaxed.minTxAge, relaxed.relaxed = nil, 0, true
+	relaxed.splice = nil // the cached prefix is built with the strict filters
+	relaxed.report = new(fillReport)
+	return &relaxed
+}
+
+// relaxedRebuild builds the full block of the payload once more with the relaxed
+// parameters via the given building iteration and offers it to the payload. It's
+// skipped if the payload is already terminated. The error of the building is
+// returned.
+func (w *worker) relaxedRebuild(payload *Payload, strict *generateParams, build func(*generateParams) (*types.Block, *big.Int, error)) error {
+	select {
+	case <-payload.stop:
+		return nil
+	default:
+	}
+	params := relaxedParams(strict)
+	block, fees, err := build(params)
+	if err != nil {
+		log.Debug("Failed to build relaxed payload block", "err", err)
+		return err
+	}
+	log.Debug("Built relaxed payload block", "number", block.Number(), "hash", block.Hash(), "fees", fees, "txs", len(block.Transactions()))
+	payload.updateFull(block, fees, params.report)
+	return nil
+}
+
+// seededScorer returns a sender scorer deriving the pseudo-random scores from
+// the given seed, which shuffles the senders paying equal tips deterministically.
+func seededScorer(seed uint64) func(common.Address) int64 {
+	var enc [8]byte
+	binary.BigEndian.PutUint64(enc[:], seed)
+
+	return func(addr common.Address) int64 {
+		hash := sha256.Sum256(append(enc[:], addr[:]...))
+		return int64(binary.BigEndian.Uint64(hash[:8]))
+	}
+}
+
+// markPayloadBuild marks the creation of a payload in the metrics, both the
+// overall one and the one of the given label.
+func markPayloadBuild(label string) {
+	payloadBuildMeter.Mark(1)
+	if label != "" {
+		metrics.GetOrRegisterMeter("miner/payload/build/"+label, nil).Mark(1)
+	}
+}
+
+// markPayloadUpdate marks a full-block re-building in the metrics, both the
+// overall one and the one of the given label.
+func markPayloadUpdate(label string) {
+	payloadUpdateMeter.Mark(1)
+	if label != "" {
+		metrics.GetOrRegisterMeter("miner/payload/update/"+label, nil).Mark(1)
+	}
+}
+
+// newFeesHistograms creates the histograms for sampling the full block fees, one
+// for each elapsed second up to the given number and an extra for the rest.
+func newFeesHistograms(buckets int) []metrics.Histogram {
+	histograms := make([]metrics.Histogram, buckets+1)
+	for i := 0; i < buckets; i++ {
+		histograms[i] = metrics.NewRegisteredHistogram(fmt.Sprintf("miner/payload/fees/%ds", i), nil, metrics.NewExpDecaySample(1028, 0.015))
+	}
+	histograms[buckets] = metrics.NewRegisteredHistogram(fmt.Sprintf("miner/payload/fees/%ds+", buckets), nil, metrics.NewExpDecaySample(1028, 0.015))
+	return histograms
+}
+
+// feesBucket returns the index of the fees histogram for the given elapsed time.
+func feesBucket(elapsed time.Duration) int {
+	bucket := int(elapsed / time.Second)
+	if bucket < 0 {
+		return 0
+	}
+	if bucket > payloadFeesBuckets {
+		return payloadFeesBuckets
+	}
+	return bucket
+}
+
+// markPayloadFees samples the fees of a newly installed best block.
+func markPayloadFees(elapsed time.Duration, fees *big.Int) {
+	if !metrics.Enabled {
+		return
+	}
+	gwei := new(big.Int).Div(fees, big.NewInt(params.GWei))
+	if !gwei.IsInt64() {
+		return
+	}
+	payloadFeesHistograms[feesBucket(elapsed)].Update(gwei.Int64())
+}
+
+// addedTxs returns the hashes of the transactions included in the block but
+// absent from the previous one. All transactions are returned if there is no
+// previous block.
+func addedTxs(prev *types.Block, block *types.Block) []common.Hash {
+	known := make(map[common.Hash]struct{})
+	if prev != nil {
+		for _, tx := range prev.Transactions() {
+			known[tx.Hash()] = struct{}{}
+		}
+	}
+	var added []common.Hash
+	for _, tx := range block.Transactions() {
+		if _, ok := known[tx.Hash()]; !ok {
+			added = append(added, tx.Hash())
+		}
+	}
+	return added
+}
+
+// replacedTxs returns the number of the transactions included in the block which
+// replace the ones of the previous block, namely are from the same sender with the
+// same nonce but a different hash, e.g. after a fee bump.
+func replacedTxs(signer types.Signer, prev *types.Block, block *types.Block) int {
+	if prev == nil {
+		return 0
+	}
+	type slot struct {
+		from  common.Address
+		nonce uint64
+	}
+	sender := func(tx *types.Transaction) (common.Address, error) {
+		if signer == nil {
+			return types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+		}
+		return types.Sender(signer, tx)
+	}
+	known := make(map[slot]common.Hash)
+	for _, tx := range prev.Transactions() {
+		if from, err := sender(tx); err == nil {
+			known[slot{from, tx.Nonce()}] = tx.Hash()
+		}
+	}
+	var replaced int
+	for _, tx := range block.Transactions() {
+		from, err := sender(tx)
+		if err != nil {
+			continue
+		}
+		if hash, ok := known[slot{from, tx.Nonce()}]; ok && hash != tx.Hash() {
+			replaced++
+		}
+	}
+	return replaced
+}
+
+// trackPayload registers the payload as having an active background builder.
+func (w *worker) trackPayload(payload *Payload) {
+	w.payloadsMu.Lock()
+	defer w.payloadsMu.Unlock()
+
+	w.payloads[payload] = struct{}{}
+}
+
+// untrackPayload deregisters the payload and marks its background builder as
+// exited. It must be called by the builder itself upon termination. The resolved
+// payload is retained among the recent ones if it's enabled.
+func (w *worker) untrackPayload(payload *Payload) {
+	if limit := cap(w.recent); limit > 0 {
+		if record := payload.record(); record != nil {
+			w.recentMu.Lock()
+			if len(w.recent) < limit {
+				w.recent = append(w.recent, record)
+			} else {
+				w.recent[w.recentNext] = record // evict the oldest one
+			}
+			w.recentNext = (w.recentNext + 1) % limit
+			w.recentMu.Unlock()
+		}
+	}
+	w.payloadsMu.Lock()
+	defer w.payloadsMu.Unlock()
+
+	delete(w.payloads, payload)
+	close(payload.done)
+}
+
+// RecentPayloads returns the last n resolved payloads, the most recent first.
+// Fewer are returned if not so many are retained, the number is bounded by the
+// RecentPayloads in the miner config. The payloads are ordered by the exit of
+// their background builders, which shortly follows the resolution.
+func (w *worker) RecentPayloads(n int) []*PayloadRecord {
+	w.recentMu.Lock()
+	defer w.recentMu.Unlock()
+
+	if n > len(w.recent) {
+		n = len(w.recent)
+	}
+	if n <= 0 {
+		return nil
+	}
+	records := make([]*PayloadRecord, 0, n)
+	for i := 1; i <= n; i++ {
+		records = append(records, w.recent[(w.recentNext-i+len(w.recent))%len(w.recent)])
+	}
+	return records
+}
+
+// ActivePayloads returns the ids of the payloads being built, sorted in the
+// byte order. The resolved or cancelled payloads are excluded even if their
+// builders haven't exited yet.
+func (w *worker) ActivePayloads() []beacon.PayloadID {
+	w.payloadsMu.Lock()
+	defer w.payloadsMu.Unlock()
+
+	ids := make([]beacon.PayloadID, 0, len(w.payloads))
+	for payload := range w.payloads {
+		select {
+		case <-payload.stop:
+			continue // terminated, the builder is exiting
+		default:
+		}
+		ids = append(ids, payload.id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+	return ids
+}
+
+// stopPayloadBuilding terminates the background builders of all in-flight
+// payloads and waits for them to exit, at most payloadStopTimeout. The best
+// blocks built so far are retained, so the payloads can still be resolved
+// after the shutdown.
+func (w *worker) stopPayloadBuilding() {
+	w.payloadsMu.Lock()
+	payloads := make([]*Payload, 0, len(w.payloads))
+	for payload := range w.payloads {
+		payloads = append(payloads, payload)
+	}
+	w.payloadsMu.Unlock()
+
+	for _, payload := range payloads {
+		payload.stopBuilding()
+	}
+	timeout := time.NewTimer(payloadStopTimeout)
+	defer timeout.Stop()
+
+	for _, payload := range payloads {
+		select {
+		case <-payload.done:
+		case <-timeout.C:
+			log.Warn("Timed out waiting for payload builders to exit", "timeout", payloadStopTimeout)
+			return
+		}
+	}
+}
@@ -17,15 +17,31 @@
 package miner
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"math/big"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/consensus/misc"
+	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/beacon"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
 func TestBuildPayload(t *testing.T) {
@@ -42,11 +58,21 @@ func TestBuildPayload(t *testing.T) {
 		Timestamp:    timestamp,
 		Random:       common.Hash{},
 		FeeRecipient: recipient,
+		Label:        "validator-set-a",
 	}
 	payload, err := w.buildPayload(args)
 	if err != nil {
 		t.Fatalf("Failed to build payload %v", err)
 	}
+	if !strings.Contains(payload.String(), `"validator-set-a"`) {
+		t.Fatalf("Payload label is missing, have %s", payload)
+	}
+	if payload.Fork() != "bellatrix" || !strings.Contains(payload.String(), "bellatrix") {
+		t.Fatalf("Unexpected payload fork, have %s", payload.Fork())
+	}
+	if root := payload.ParentStateRoot(); root != b.chain.CurrentBlock().Root() {
+		t.Fatalf("Unexpected parent state root, have %x, want %x", root, b.chain.CurrentBlock().Root())
+	}
 	verify := func(data *beacon.ExecutableDataV1, txs int) {
 		if data.ParentHash != b.chain.CurrentBlock().Hash() {
 			t.Fatal("Unexpect parent hash")
@@ -70,6 +96,13 @@ func TestBuildPayload(t *testing.T) {
 	full := payload.ResolveFull()
 	verify(full, len(pendingTxs))
 
+	if want := float64(full.GasUsed) / float64(full.GasLimit); payload.FillRatio() != want {
+		t.Fatalf("Unexpected fill ratio, have %v, want %v", payload.FillRatio(), want)
+	}
+	if payload.BuildCPUTime() <= 0 {
+		t.Fatalf("Build time is not accounted, have %v", payload.BuildCPUTime())
+	}
+
 	// Ensure resolve can be called multiple times and the
 	// result should be unchanged
 	dataOne := payload.Resolve()
@@ -78,3 +111,4334 @@ func TestBuildPayload(t *testing.T) {
 		t.Fatal("Unexpected payload data")
 	}
 }
+
+// sweepRandomness builds a payload on top of the given parent for each of the
+// randomness values, and verifies the value ends up as the mix digest of both
+// the empty and full blocks while leaving the rest of the execution untouched.
+func sweepRandomness(t *testing.T, w *worker, parent common.Hash, randoms []common.Hash) {
+	t.Helper()
+
+	var (
+		timestamp = uint64(time.Now().Unix())
+		reference *beacon.ExecutableDataV1
+	)
+	for i, random := range randoms {
+		payload, err := w.buildPayload(&BuildPayloadArgs{
+			Parent:       parent,
+			Timestamp:    timestamp,
+			Random:       random,
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		})
+		if err != nil {
+			t.Fatalf("random %d: failed to build payload %v", i, err)
+		}
+		empty, full := payload.ResolveEmpty(), payload.ResolveFull()
+		payload.stopBuilding()
+
+		for _, data := range []*beacon.ExecutableDataV1{empty, full} {
+			if data.Random != random {
+				t.Fatalf("random %d: unexpected payload random, have %x, want %x", i, data.Random, random)
+			}
+		}
+		for _, block := range []*types.Block{payload.empty, payload.full} {
+			if block.MixDigest() != random {
+				t.Fatalf("random %d: unexpected mix digest, have %x, want %x", i, block.MixDigest(), random)
+			}
+		}
+		// The randomness must not affect anything else of the plain transfers
+		if reference == nil {
+			reference = full
+			continue
+		}
+		if full.StateRoot != reference.StateRoot || full.ReceiptsRoot != reference.ReceiptsRoot || full.GasUsed != reference.GasUsed {
+			t.Fatalf("random %d: execution is affected by the randomness", i)
+		}
+		if len(full.Transactions) != len(reference.Transactions) {
+			t.Fatalf("random %d: unexpected transaction set, have %d, want %d", i, len(full.Transactions), len(reference.Transactions))
+		}
+	}
+}
+
+func TestBuildPayloadRandomness(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	sweepRandomness(t, w, b.chain.CurrentBlock().Hash(), []common.Hash{
+		{},
+		{0x01},
+		common.HexToHash("0x01"),
+		crypto.Keccak256Hash([]byte("prevrandao")),
+		common.HexToHash("0xffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+	})
+}
+
+// timeShiftingEngine is a consensus engine moving the header timestamps while
+// preparing them.
+type timeShiftingEngine struct {
+	consensus.Engine
+}
+
+func (e timeShiftingEngine) Prepare(chain consensus.ChainHeaderReader, header *types.Header) error {
+	header.Time++
+	return e.Engine.Prepare(chain, header)
+}
+
+func TestBuildPayloadTimestamp(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	parent := b.chain.CurrentBlock()
+	for _, timestamp := range []uint64{parent.Time() + 1, parent.Time() + 12, uint64(time.Now().Unix())} {
+		payload, err := w.buildPayload(&BuildPayloadArgs{
+			Parent:       parent.Hash(),
+			Timestamp:    timestamp,
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		})
+		if err != nil {
+			t.Fatalf("Failed to build payload %v", err)
+		}
+		full := payload.ResolveFull()
+		if have := payload.Resolve().Timestamp; have != timestamp || full.Timestamp != timestamp {
+			t.Fatalf("Unexpected payload timestamp, have %d, full %d, want %d", have, full.Timestamp, timestamp)
+		}
+		if have := payload.Timestamp(); have != timestamp {
+			t.Fatalf("Unexpected payload timestamp, have %d, want %d", have, timestamp)
+		}
+	}
+	// The timestamp must never be clamped silently
+	if _, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       parent.Hash(),
+		Timestamp:    parent.Time(),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}); err == nil {
+		t.Fatal("Payload built with stale timestamp")
+	}
+	w.engine = timeShiftingEngine{w.engine}
+	_, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+		Parent:       parent.Hash(),
+		Timestamp:    parent.Time() + 1,
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}, true))
+	if !errors.Is(err, errTimestampAdjusted) {
+		t.Fatalf("Unexpected error, have %v, want %v", err, errTimestampAdjusted)
+	}
+}
+
+func TestStopPayloadBuilding(t *testing.T) {
+	var (
+		db        = rawdb.NewMemoryDatabase()
+		recipient = common.HexToAddress("0xdeadbeef")
+	)
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), db, 0)
+	defer w.close()
+
+	var payloads []*Payload
+	for i := 0; i < 4; i++ {
+		args := &BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()) + uint64(i),
+			Random:       common.Hash{byte(i)},
+			FeeRecipient: recipient,
+		}
+		payload, err := w.buildPayload(args)
+		if err != nil {
+			t.Fatalf("Failed to build payload %v", err)
+		}
+		payloads = append(payloads, payload)
+	}
+	w.stopPayloadBuilding()
+
+	for i, payload := range payloads {
+		select {
+		case <-payload.done:
+		default:
+			t.Fatalf("payload %d: background builder is still running", i)
+		}
+		if payload.Resolve() == nil {
+			t.Fatalf("payload %d: failed to resolve after stop", i)
+		}
+	}
+	w.payloadsMu.Lock()
+	defer w.payloadsMu.Unlock()
+	if len(w.payloads) != 0 {
+		t.Fatalf("active payloads mismatch: have %d, want 0", len(w.payloads))
+	}
+}
+
+func TestActivePayloads(t *testing.T) {
+	var (
+		db        = rawdb.NewMemoryDatabase()
+		recipient = common.HexToAddress("0xdeadbeef")
+	)
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), db, 0)
+	defer w.close()
+
+	var payloads []*Payload
+	for i := 0; i < 3; i++ {
+		args := &BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()) + uint64(i),
+			Random:       common.Hash{byte(i)},
+			FeeRecipient: recipient,
+		}
+		payload, err := w.buildPayload(args)
+		if err != nil {
+			t.Fatalf("Failed to build payload %v", err)
+		}
+		payloads = append(payloads, payload)
+	}
+	defer w.stopPayloadBuilding()
+
+	if ids := w.ActivePayloads(); len(ids) != 3 {
+		t.Fatalf("active payloads mismatch: have %d, want 3", len(ids))
+	}
+	// Resolve the first payload, it must disappear immediately
+	payloads[0].Resolve()
+
+	ids := w.ActivePayloads()
+	if len(ids) != 2 {
+		t.Fatalf("active payloads mismatch: have %d, want 2", len(ids))
+	}
+	for _, id := range ids {
+		if id == payloads[0].id {
+			t.Fatalf("resolved payload %v is still active", id)
+		}
+	}
+	if bytes.Compare(ids[0][:], ids[1][:]) > 0 {
+		t.Fatalf("active payloads are not sorted")
+	}
+}
+
+func TestPayloadExitCause(t *testing.T) {
+	for _, test := range []struct {
+		setup func(*worker)
+		stop  func(*Payload)
+		want  string
+	}{
+		{func(w *worker) {}, func(payload *Payload) { payload.Resolve() }, payloadExitResolved},
+		{func(w *worker) {}, func(payload *Payload) { payload.stopBuilding() }, payloadExitCancelled},
+		{func(w *worker) { w.payloadLifetime = 50 * time.Millisecond }, func(payload *Payload) {}, payloadExitDeadline},
+		{func(w *worker) {
+			w.recommit = 10 * time.Millisecond
+			w.config.ValidateBeforeStore = true
+			w.validateHook = func(*types.Block) error { return errors.New("invalid block") }
+		}, func(payload *Payload) {}, payloadExitInvalid},
+		{func(w *worker) {
+			w.recommit = 10 * time.Millisecond
+			w.config.MaxRebuilds = 2
+		}, func(payload *Payload) {}, payloadExitRebuilds},
+	} {
+		config := *testConfig
+		w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+		test.setup(w)
+
+		payload, err := w.buildPayload(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()),
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		})
+		if err != nil {
+			t.Fatalf("Failed to build payload %v", err)
+		}
+		test.stop(payload)
+		select {
+		case <-payload.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: background builder is still running", test.want)
+		}
+		payload.lock.Lock()
+		if payload.exit != test.want {
+			t.Errorf("Unexpected exit cause, have %q, want %q", payload.exit, test.want)
+		}
+		payload.lock.Unlock()
+
+		if payload.Timings().Stopped.IsZero() {
+			t.Errorf("%s: stop time is not recorded", test.want)
+		}
+		if remaining := payload.TimeRemaining(); remaining != 0 {
+			t.Errorf("%s: unexpected remaining time %v", test.want, remaining)
+		}
+		w.close()
+	}
+}
+
+func TestPayloadDiagnostics(t *testing.T) {
+	newBlock := func(txs []*types.Transaction) *types.Block {
+		return types.NewBlock(&types.Header{Number: big.NewInt(1)}, txs, nil, nil, trie.NewStackTrie(nil))
+	}
+	payload := newPayload(newBlock(nil))
+	payload.diagnostics = true
+
+	payload.update(newBlock(pendingTxs), big.NewInt(1))
+	payload.update(newBlock(pendingTxs), big.NewInt(1)) // rejected, no fee increase
+	payload.update(newBlock(append(pendingTxs, newTxs...)), big.NewInt(2))
+
+	updates := payload.Diagnostics()
+	if len(updates) != 2 {
+		t.Fatalf("update records mismatch: have %d, want 2", len(updates))
+	}
+	if !reflect.DeepEqual(updates[0].Added, []common.Hash{pendingTxs[0].Hash()}) {
+		t.Fatalf("first update mismatch: have %v", updates[0].Added)
+	}
+	if !reflect.DeepEqual(updates[1].Added, []common.Hash{newTxs[0].Hash()}) {
+		t.Fatalf("second update mismatch: have %v", updates[1].Added)
+	}
+}
+
+func TestPayloadTipDistribution(t *testing.T) {
+	signer := types.LatestSigner(params.TestChainConfig)
+	var txs []*types.Transaction
+	for _, tip := range []int64{3, 1, 2} {
+		txs = append(txs, types.MustSignNewTx(testBankKey, signer, &types.DynamicFeeTx{
+			ChainID:   params.TestChainConfig.ChainID,
+			Nonce:     uint64(len(txs)),
+			GasTipCap: big.NewInt(tip * params.GWei),
+			GasFeeCap: big.NewInt(params.InitialBaseFee + 2*params.GWei),
+			Gas:       params.TxGas,
+		}))
+	}
+	header := &types.Header{Number: big.NewInt(1), BaseFee: big.NewInt(params.InitialBaseFee)}
+	payload := newPayload(types.NewBlockWithHeader(header))
+	if tips := payload.TipDistribution(); len(tips) != 0 {
+		t.Fatalf("Unexpected tips of empty block %v", tips)
+	}
+	// The tips are capped by the fee cap minus the base fee
+	payload.update(types.NewBlock(header, txs, nil, nil, trie.NewStackTrie(nil)), big.NewInt(1))
+	want := []*big.Int{big.NewInt(params.GWei), big.NewInt(2 * params.GWei), big.NewInt(2 * params.GWei)}
+	if tips := payload.TipDistribution(); !reflect.DeepEqual(tips, want) {
+		t.Fatalf("Unexpected tip distribution, have %v, want %v", tips, want)
+	}
+}
+
+func TestPayloadPropagationRiskScore(t *testing.T) {
+	newBlock := func(txs []*types.Transaction, gasUsed uint64, extra int) *types.Block {
+		header := &types.Header{Number: big.NewInt(1), GasLimit: 30_000_000, GasUsed: gasUsed, Extra: make([]byte, extra)}
+		return types.NewBlock(header, txs, nil, nil, trie.NewStackTrie(nil))
+	}
+	payload := newPayload(newBlock(nil, 0, 0))
+	last := payload.PropagationRiskScore()
+
+	// The score grows with the size and the gas used of the served block
+	for i, block := range []*types.Block{
+		newBlock(pendingTxs, 21000, 0),
+		newBlock(append(append([]*types.Transaction{}, pendingTxs...), newTxs...), 21000, 0),
+		newBlock(append(append([]*types.Transaction{}, pendingTxs...), newTxs...), 42000, 0),
+		newBlock(append(append([]*types.Transaction{}, pendingTxs...), newTxs...), 42000, 1<<16),
+	} {
+		payload.update(block, big.NewInt(int64(i+1)))
+		score := payload.PropagationRiskScore()
+		if score <= last {
+			t.Fatalf("block %d: score not increased, have %v, last %v", i, score, last)
+		}
+		last = score
+	}
+	// The weights are configurable, zero weighs the component out
+	payload.riskWeights = &PropagationWeights{Size: 0, Gas: 1}
+	if score, want := payload.PropagationRiskScore(), 42000.0/30_000_000; score != want {
+		t.Fatalf("Unexpected weighted score, have %v, want %v", score, want)
+	}
+}
+
+func TestPayloadMinTxs(t *testing.T) {
+	newBlock := func(txs []*types.Transaction) *types.Block {
+		return types.NewBlock(&types.Header{Number: big.NewInt(1)}, txs, nil, nil, trie.NewStackTrie(nil))
+	}
+	var (
+		short = newBlock(pendingTxs)
+		long  = newBlock(append(append([]*types.Transaction{}, pendingTxs...), newTxs...))
+	)
+	payload := newPayload(newBlock(nil))
+	payload.minTxs = 2
+
+	payload.update(short, big.NewInt(2))
+	payload.update(long, big.NewInt(1)) // accepted, reaching the minimum
+	if full := payload.ResolveFull(); full.BlockHash != long.Hash() {
+		t.Fatalf("Block reaching minimum transactions is not preferred")
+	}
+	payload.update(short, big.NewInt(3)) // rejected, falling short of the minimum
+	if full := payload.ResolveFull(); full.BlockHash != long.Hash() {
+		t.Fatalf("Block falling short of minimum transactions is preferred")
+	}
+}
+
+func TestPayloadTieBreakByHash(t *testing.T) {
+	var (
+		a = types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), Time: 1})
+		b = types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), Time: 2})
+	)
+	lower, higher := a, b
+	if bytes.Compare(a.Hash().Bytes(), b.Hash().Bytes()) > 0 {
+		lower, higher = b, a
+	}
+	// The lowest hash wins regardless of the arrival order
+	for _, order := range [][]*types.Block{{lower, higher}, {higher, lower}} {
+		payload := newPayload(types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)}))
+		payload.tieBreak = true
+		for _, block := range order {
+			payload.update(block, big.NewInt(1))
+		}
+		if full := payload.ResolveFull(); full.BlockHash != lower.Hash() {
+			t.Fatalf("Unexpected tie winner, have %v, want %v", full.BlockHash, lower.Hash())
+		}
+	}
+	// The first arrival wins without the tie breaking
+	payload := newPayload(types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)}))
+	payload.update(higher, big.NewInt(1))
+	payload.update(lower, big.NewInt(1))
+	if full := payload.ResolveFull(); full.BlockHash != higher.Hash() {
+		t.Fatalf("Unexpected tie winner, have %v, want %v", full.BlockHash, higher.Hash())
+	}
+}
+
+func TestPayloadDiffFromPrevious(t *testing.T) {
+	newBlock := func(txs []*types.Transaction) *types.Block {
+		return types.NewBlock(&types.Header{Number: big.NewInt(1)}, txs, nil, nil, trie.NewStackTrie(nil))
+	}
+	var (
+		first  = newBlock(pendingTxs)
+		second = newBlock(newTxs)
+	)
+	payload := newPayload(newBlock(nil))
+	payload.keepPrev = true
+
+	payload.update(first, big.NewInt(1))
+	diff := payload.DiffFromPrevious()
+	if len(diff.Added) != 1 || diff.Added[0] != pendingTxs[0].Hash() || len(diff.Removed) != 0 || diff.FeeDelta.Cmp(big.NewInt(1)) != 0 {
+		t.Fatalf("Unexpected diff from empty block %+v", diff)
+	}
+	payload.update(second, big.NewInt(3))
+	diff = payload.DiffFromPrevious()
+	if len(diff.Added) != 1 || diff.Added[0] != newTxs[0].Hash() {
+		t.Fatalf("Unexpected added transactions %v", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0] != pendingTxs[0].Hash() {
+		t.Fatalf("Unexpected removed transactions %v", diff.Removed)
+	}
+	if diff.FeeDelta.Cmp(big.NewInt(2)) != 0 {
+		t.Fatalf("Unexpected fee delta, have %v, want 2", diff.FeeDelta)
+	}
+	// Nothing is retained without the flag
+	payload = newPayload(newBlock(nil))
+	payload.update(first, big.NewInt(1))
+	payload.update(second, big.NewInt(3))
+	if diff := payload.DiffFromPrevious(); diff.Added != nil || diff.Removed != nil || diff.FeeDelta != nil {
+		t.Fatalf("Unexpected diff without retaining %+v", diff)
+	}
+}
+
+func TestPayloadCustomValuation(t *testing.T) {
+	newBlock := func(txs []*types.Transaction) *types.Block {
+		return types.NewBlock(&types.Header{Number: big.NewInt(1)}, txs, nil, nil, trie.NewStackTrie(nil))
+	}
+	var (
+		short = newBlock(pendingTxs)
+		long  = newBlock(append(append([]*types.Transaction{}, pendingTxs...), newTxs...))
+	)
+	// Value the blocks by the transaction count instead of the fees
+	payload := newPayload(newBlock(nil))
+	payload.compare = func(a, b *candidateStats) int { return a.txs - b.txs }
+
+	payload.update(long, big.NewInt(1))
+	payload.update(short, big.NewInt(2)) // rejected, fewer transactions
+	if full := payload.ResolveFull(); full.BlockHash != long.Hash() {
+		t.Fatalf("Custom valuation is not applied")
+	}
+}
+
+func TestPayloadBuildObjective(t *testing.T) {
+	newBlock := func(gasUsed uint64, txs []*types.Transaction) *types.Block {
+		return types.NewBlock(&types.Header{Number: big.NewInt(1), GasUsed: gasUsed}, txs, nil, nil, trie.NewStackTrie(nil))
+	}
+	var (
+		rich  = newBlock(21000, pendingTxs)                                                       // highest fees
+		full  = newBlock(42000, append(append([]*types.Transaction{}, pendingTxs...), newTxs...)) // most transactions
+		heavy = newBlock(1000000, pendingTxs)                                                     // most gas used
+	)
+	tests := []struct {
+		objective BuildObjective
+		want      *types.Block
+	}{
+		{BuildMaxFees, rich},
+		{BuildMaxTxs, full},
+		{BuildMaxGasUsed, heavy},
+	}
+	for _, tt := range tests {
+		payload := newPayload(newBlock(0, nil))
+		payload.compare = tt.objective.comparator()
+
+		payload.update(full, big.NewInt(2))
+		payload.update(rich, big.NewInt(3))
+		payload.update(heavy, big.NewInt(1))
+		if have := payload.ResolveFull(); have.BlockHash != tt.want.Hash() {
+			t.Errorf("objective %v: unexpected block retained", tt.objective)
+		}
+	}
+	if BuildObjective(255).comparator() != nil {
+		t.Fatalf("Unknown objective accepted")
+	}
+}
+
+func TestPayloadFeesETH(t *testing.T) {
+	newBlock := func(txs []*types.Transaction) *types.Block {
+		return types.NewBlock(&types.Header{Number: big.NewInt(1)}, txs, nil, nil, trie.NewStackTrie(nil))
+	}
+	feesETH := func(fees *big.Int, digits int) float64 {
+		payload := newPayload(newBlock(nil))
+		payload.feesDigits = digits
+		payload.update(newBlock(pendingTxs), fees)
+		return payload.FeesETH()
+	}
+	// Equal fees always yield the same float, regardless of how they're derived
+	fees, _ := new(big.Int).SetString("123456789012345678", 10)
+	same := new(big.Int).Add(new(big.Int).Mul(big.NewInt(123456789), big.NewInt(1000000000)), big.NewInt(12345678))
+	if a, b := feesETH(fees, 0), feesETH(same, 0); a != b {
+		t.Fatalf("Unstable fees in ether, %v != %v", a, b)
+	}
+	// The rounding noise beyond the significant digits is cut off
+	if a, b := feesETH(fees, 0), feesETH(new(big.Int).Add(fees, common.Big1), 0); a != b {
+		t.Fatalf("Fees in ether jitter by a wei, %v != %v", a, b)
+	}
+	if have := feesETH(fees, 3); have != 0.123 {
+		t.Fatalf("Unexpected rounded fees, have %v, want 0.123", have)
+	}
+}
+
+func TestBuildPayloadExcludeAddresses(t *testing.T) {
+	var (
+		db        = rawdb.NewMemoryDatabase()
+		recipient = common.HexToAddress("0xdeadbeef")
+	)
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), db, 0)
+	defer w.close()
+
+	// All the pending transactions are sent to the test user
+	w.excluded = map[common.Address]struct{}{testUserAddress: {}}
+
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: recipient,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	full := payload.ResolveFull()
+	for _, enc := range full.Transactions {
+		var tx types.Transaction
+		if err := tx.UnmarshalBinary(enc); err != nil {
+			t.Fatalf("Failed to decode transaction %v", err)
+		}
+		if to := tx.To(); to != nil && *to == testUserAddress {
+			t.Fatalf("Excluded transaction included, hash %v", tx.Hash())
+		}
+	}
+	if len(full.Transactions) != 0 {
+		t.Fatalf("Unexpected transaction set, have %d, want 0", len(full.Transactions))
+	}
+}
+
+func TestBuildPayloadExcludeTouches(t *testing.T) {
+	config := *testConfig
+	config.AllowStateOverrides = true
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	var (
+		signer    = types.LatestSigner(params.TestChainConfig)
+		excluded  = common.HexToAddress("0xbad")
+		precomp   = common.BytesToAddress([]byte{0x01})
+		noop      = common.HexToAddress("0xc0de")
+		prober    = common.HexToAddress("0xc0de01")
+		caller    = common.HexToAddress("0xc0de02")
+		overrides = StateOverride{
+			noop:   AccountOverride{Code: []byte{byte(vm.STOP)}},
+			prober: AccountOverride{Code: append(append([]byte{byte(vm.PUSH20)}, excluded.Bytes()...), byte(vm.BALANCE), byte(vm.POP), byte(vm.STOP))},
+			caller: AccountOverride{Code: append(append([]byte{
+				byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH20),
+			}, excluded.Bytes()...), byte(vm.GAS), byte(vm.CALL), byte(vm.STOP))},
+		}
+		pending = &PendingSnapshot{remotes: make(map[common.Address]types.Transactions)}
+		want    = make(map[common.Hash]bool)
+	)
+	// Exclude a precompiled contract too, it's warm in the access list of all
+	// the transactions but not touched by any
+	w.excluded = map[common.Address]struct{}{excluded: {}, precomp: {}}
+
+	for _, test := range []struct {
+		to      common.Address
+		list    types.AccessList
+		include bool
+	}{
+		{noop, nil, true},
+		{noop, types.AccessList{{Address: excluded}}, true}, // declared only
+		{prober, nil, false},
+		{caller, nil, false},
+	} {
+		key, _ := crypto.GenerateKey()
+		addr := crypto.PubkeyToAddress(key.PublicKey)
+		to := test.to
+		tx := types.MustSignNewTx(key, signer, &types.AccessListTx{
+			ChainID:    params.TestChainConfig.ChainID,
+			To:         &to,
+			Gas:        100000,
+			GasPrice:   big.NewInt(2 * params.InitialBaseFee),
+			AccessList: test.list,
+		})
+		overrides[addr] = AccountOverride{Balance: big.NewInt(params.Ether)}
+		pending.remotes[addr] = types.Transactions{tx}
+		if test.include {
+			want[tx.Hash()] = true
+		}
+	}
+	block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+		Parent:         b.chain.CurrentBlock().Hash(),
+		Timestamp:      uint64(time.Now().Unix()),
+		FeeRecipient:   common.HexToAddress("0xdeadbeef"),
+		StateOverrides: overrides,
+		Pending:        pending,
+	}, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if len(block.Transactions()) != len(want) {
+		t.Fatalf("Unexpected transaction set, have %d, want %d", len(block.Transactions()), len(want))
+	}
+	for _, tx := range block.Transactions() {
+		if !want[tx.Hash()] {
+			t.Fatalf("Transaction touching excluded address included, hash %v", tx.Hash())
+		}
+	}
+}
+
+func TestBuildPayloadAllowedSenders(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}
+	// All the pending transactions are sent from the test bank
+	for _, test := range []struct {
+		allowed common.Address
+		want    int
+	}{
+		{testUserAddress, 0},
+		{testBankAddress, len(pendingTxs)},
+	} {
+		w.allowed = map[common.Address]struct{}{test.allowed: {}}
+
+		block, _, err := w.getSealingBlock(w.sealingParams(args, false))
+		if err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		if len(block.Transactions()) != test.want {
+			t.Fatalf("Unexpected transaction set with allowed %x, have %d, want %d", test.allowed, len(block.Transactions()), test.want)
+		}
+	}
+}
+
+func TestBuildPayloadEventDriven(t *testing.T) {
+	var (
+		db        = rawdb.NewMemoryDatabase()
+		recipient = common.HexToAddress("0xdeadbeef")
+		config    = *testConfig
+	)
+	config.EventDrivenRebuild = true
+
+	w, backend := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), db, 0)
+	defer w.close()
+
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       backend.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: recipient,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	if full := payload.ResolveFull(); len(full.Transactions) != len(pendingTxs) {
+		t.Fatalf("Unexpected transaction set, have %d, want %d", len(full.Transactions), len(pendingTxs))
+	}
+	// The new transaction should be picked up before the fallback timer fires
+	backend.txPool.AddLocals(newTxs)
+
+	deadline := time.Now().Add(eventRecommitFallback - time.Second)
+	for time.Now().Before(deadline) {
+		payload.lock.Lock()
+		txs := len(payload.full.Transactions())
+		payload.lock.Unlock()
+
+		if txs == len(pendingTxs)+len(newTxs) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("Payload is not re-built upon new transactions")
+}
+
+func TestPayloadCandidates(t *testing.T) {
+	newBlock := func(n int64) *types.Block {
+		return types.NewBlock(&types.Header{Number: big.NewInt(1), Time: uint64(n)}, nil, nil, nil, trie.NewStackTrie(nil))
+	}
+	payload := newPayload(newBlock(0))
+	payload.maxCandidates = 3
+
+	for _, fee := range []int64{2, 5, 1, 4, 3} {
+		payload.update(newBlock(fee), big.NewInt(fee))
+	}
+	payload.update(newBlock(5), big.NewInt(5)) // duplicate, should be ignored
+
+	candidates := payload.Candidates()
+	if len(candidates) != 3 {
+		t.Fatalf("Candidate number mismatch, have %d, want 3", len(candidates))
+	}
+	for i, want := range []uint64{5, 4, 3} {
+		if candidates[i].Timestamp != want {
+			t.Fatalf("Candidate %d mismatch, have %d, want %d", i, candidates[i].Timestamp, want)
+		}
+	}
+	if best := payload.Resolve(); !reflect.DeepEqual(best, candidates[0]) {
+		t.Fatal("Best candidate is not resolved")
+	}
+}
+
+func TestPayloadFeePerGas(t *testing.T) {
+	payload := newPayload(types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)}))
+	if fee := payload.FeePerGas(); fee.Sign() != 0 {
+		t.Fatalf("Unexpected fee per gas of empty block, have %v", fee)
+	}
+	payload.update(types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), GasUsed: 42000}), big.NewInt(84000))
+	if fee := payload.FeePerGas(); fee.Cmp(big.NewInt(2)) != 0 {
+		t.Fatalf("Unexpected fee per gas, have %v, want 2", fee)
+	}
+	// A fuller block with lower fees is discarded, but counted in the peak
+	payload.update(types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), GasUsed: 63000}), big.NewInt(63000))
+	if fee := payload.FeePerGas(); fee.Cmp(big.NewInt(2)) != 0 {
+		t.Fatalf("Unexpected fee per gas, have %v, want 2", fee)
+	}
+	if peak := payload.PeakGasUsed(); peak != 63000 {
+		t.Fatalf("Unexpected peak gas used, have %d, want 63000", peak)
+	}
+}
+
+func TestPayloadLogsBloom(t *testing.T) {
+	payload := newPayload(types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), Bloom: types.Bloom{0x01}}))
+	if bloom := payload.LogsBloom(); bloom != (types.Bloom{0x01}) {
+		t.Fatalf("Unexpected logs bloom of empty block, have %x", bloom)
+	}
+	payload.update(types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), Bloom: types.Bloom{0x02}}), big.NewInt(1))
+	if bloom := payload.LogsBloom(); bloom != (types.Bloom{0x02}) {
+		t.Fatalf("Unexpected logs bloom of full block, have %x", bloom)
+	}
+}
+
+func TestForkName(t *testing.T) {
+	config := *params.TestChainConfig
+	config.ShanghaiBlock, config.CancunBlock = big.NewInt(10), big.NewInt(20)
+
+	tests := []struct {
+		number uint64
+		fork   string
+	}{
+		{9, "bellatrix"},
+		{10, "capella"},
+		{19, "capella"},
+		{20, "deneb"},
+	}
+	for _, test := range tests {
+		if fork := forkName(&config, new(big.Int).SetUint64(test.number)); fork != test.fork {
+			t.Errorf("Unexpected fork at block %d, have %s, want %s", test.number, fork, test.fork)
+		}
+	}
+}
+
+func TestResolveSnapshot(t *testing.T) {
+	args := &BuildPayloadArgs{Timestamp: 1, FeeRecipient: common.HexToAddress("0xdeadbeef")}
+	payload := newPayload(types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)}))
+	payload.id = args.Id()
+
+	payload.update(types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), GasUsed: 21000}), big.NewInt(42))
+	snapshot := payload.ResolveSnapshot()
+	if snapshot.ID != args.Id() {
+		t.Fatalf("Unexpected payload id, have %x, want %x", snapshot.ID, args.Id())
+	}
+	if !snapshot.Full || snapshot.Value.Cmp(big.NewInt(42)) != 0 {
+		t.Fatalf("Unexpected snapshot, full %v, value %v", snapshot.Full, snapshot.Value)
+	}
+	if !reflect.DeepEqual(snapshot.Data, payload.Resolve()) {
+		t.Fatal("Snapshot data mismatches the resolved payload")
+	}
+	// The empty block is reported if no full block is built
+	payload = newPayload(types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)}))
+	if snapshot := payload.ResolveSnapshot(); snapshot.Full || snapshot.Value.Sign() != 0 {
+		t.Fatalf("Unexpected snapshot, full %v, value %v", snapshot.Full, snapshot.Value)
+	}
+}
+
+func TestPayloadSnapshotEncoding(t *testing.T) {
+	header := &types.Header{Number: big.NewInt(1), BaseFee: big.NewInt(params.InitialBaseFee)}
+	payload := newPayload(types.NewBlockWithHeader(header))
+	payload.id = beacon.PayloadID{0x1}
+	payload.label, payload.fork = "test", "london"
+
+	header = &types.Header{
+		Number:     big.NewInt(1),
+		BaseFee:    big.NewInt(params.InitialBaseFee),
+		GasUsed:    21000,
+		Difficulty: common.Big0,
+		UncleHash:  types.EmptyUncleHash,
+		TxHash:     types.EmptyRootHash,
+	}
+	payload.update(types.NewBlockWithHeader(header), big.NewInt(42))
+
+	// Taking the snapshot doesn't terminate the building
+	snapshot := payload.Snapshot()
+	select {
+	case <-payload.stop:
+		t.Fatal("Payload terminated by snapshot")
+	default:
+	}
+	if !snapshot.Full || snapshot.Label != "test" || snapshot.Fork != "london" {
+		t.Fatalf("Unexpected snapshot, full %v, label %q, fork %q", snapshot.Full, snapshot.Label, snapshot.Fork)
+	}
+	enc, err := snapshot.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode snapshot %v", err)
+	}
+	dec, err := DecodePayloadSnapshot(enc)
+	if err != nil {
+		t.Fatalf("Failed to decode snapshot %v", err)
+	}
+	if dec.ID != snapshot.ID || dec.Value.Cmp(snapshot.Value) != 0 || !dec.Full || dec.Label != snapshot.Label || dec.Fork != snapshot.Fork {
+		t.Fatalf("Unexpected decoded snapshot, have %+v, want %+v", dec, snapshot)
+	}
+	block, err := beacon.ExecutableDataToBlock(*dec.Data)
+	if err != nil {
+		t.Fatalf("Failed to reconstruct block %v", err)
+	}
+	if block.Hash() != snapshot.Data.BlockHash {
+		t.Fatalf("Unexpected reconstructed block, have %x, want %x", block.Hash(), snapshot.Data.BlockHash)
+	}
+	// The unknown fields are ignored, the unknown versions are rejected
+	var fields map[string]interface{}
+	if err := json.Unmarshal(enc, &fields); err != nil {
+		t.Fatalf("Failed to decode fields %v", err)
+	}
+	fields["extension"] = "ignored"
+	extended, _ := json.Marshal(fields)
+	if _, err := DecodePayloadSnapshot(extended); err != nil {
+		t.Fatalf("Failed to decode extended snapshot %v", err)
+	}
+	fields["version"] = payloadSnapshotVersion + 1
+	future, _ := json.Marshal(fields)
+	if _, err := DecodePayloadSnapshot(future); err == nil {
+		t.Fatal("Expected unsupported version error")
+	}
+	if _, err := DecodePayloadSnapshot([]byte(`{"version":1}`)); err == nil {
+		t.Fatal("Expected incomplete snapshot error")
+	}
+}
+
+func TestPayloadCloneBest(t *testing.T) {
+	newBlock := func(txs []*types.Transaction) *types.Block {
+		return types.NewBlock(&types.Header{Number: big.NewInt(1)}, txs, nil, nil, trie.NewStackTrie(nil))
+	}
+	empty := newBlock(nil)
+	payload := newPayload(empty)
+	if clone := payload.CloneBest(); clone.Hash() != empty.Hash() {
+		t.Fatalf("Unexpected clone of empty block, have %v, want %v", clone.Hash(), empty.Hash())
+	}
+	full := newBlock(pendingTxs)
+	payload.update(full, big.NewInt(1))
+	clone := payload.CloneBest()
+
+	// The clone is unaffected by the subsequent updates
+	payload.update(newBlock(append(append([]*types.Transaction{}, pendingTxs...), newTxs...)), big.NewInt(2))
+	if clone.Hash() != full.Hash() || len(clone.Transactions()) != len(pendingTxs) {
+		t.Fatalf("Clone is mutated, have %v, want %v", clone.Hash(), full.Hash())
+	}
+	if clone == full {
+		t.Fatal("Clone is not independent")
+	}
+}
+
+func TestInterruptSealing(t *testing.T) {
+	var (
+		db        = rawdb.NewMemoryDatabase()
+		recipient = common.HexToAddress("0xdeadbeef")
+	)
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), db, 0)
+	defer w.close()
+
+	// Simulate a new payload request on another parent arriving in the middle
+	// of filling
+	w.fillHook = func() { w.interruptSealing(common.Hash{0x01}) }
+
+	start := time.Now()
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: recipient,
+	}
+	_, _, err := w.getSealingBlock(w.sealingParams(args, false))
+	if !errors.Is(err, errBlockInterruptedByPayload) {
+		t.Fatalf("Unexpected error, have %v, want %v", err, errBlockInterruptedByPayload)
+	}
+	if elapsed := time.Since(start); elapsed >= w.newpayloadTimeout {
+		t.Fatalf("Sealing is not aborted promptly, elapsed %v", elapsed)
+	}
+	// The interrupt should be cleared once the generation is aborted
+	w.fillHook = nil
+	if _, _, err := w.getSealingBlock(w.sealingParams(args, false)); err != nil {
+		t.Fatalf("Failed to generate block after interruption %v", err)
+	}
+}
+
+func TestInterruptSealingObsoleteOnly(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 1)
+	defer w.close()
+
+	// Hold both generations in the middle of filling until they're registered
+	var (
+		entered = make(chan struct{}, 2)
+		release = make(chan struct{})
+	)
+	w.fillHook = func() {
+		entered <- struct{}{}
+		<-release
+	}
+	// The generations of the payloads are run side by side, bypassing the main
+	// loop which would take them one by one.
+	generate := func(parent common.Hash) <-chan error {
+		errc := make(chan error, 1)
+		go func() {
+			_, _, err := w.generateWork(w.sealingParams(&BuildPayloadArgs{
+				Parent:       parent,
+				Timestamp:    uint64(time.Now().Unix()),
+				FeeRecipient: common.HexToAddress("0xdeadbeef"),
+			}, false))
+			errc <- err
+		}()
+		return errc
+	}
+	head := b.chain.CurrentBlock().Hash()
+	obsolete, current := generate(b.chain.Genesis().Hash()), generate(head)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-entered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Payload generation is not started")
+		}
+	}
+	// A new payload request on the head aborts the generation on the stale parent
+	w.interruptSealing(head)
+	close(release)
+
+	if err := <-obsolete; !errors.Is(err, errBlockInterruptedByPayload) {
+		t.Fatalf("Unexpected error of obsolete generation, have %v, want %v", err, errBlockInterruptedByPayload)
+	}
+	if err := <-current; err != nil {
+		t.Fatalf("Generation on the head is interrupted %v", err)
+	}
+}
+
+func TestSpliceRebuild(t *testing.T) {
+	var (
+		db        = rawdb.NewMemoryDatabase()
+		recipient = common.HexToAddress("0xdeadbeef")
+	)
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), db, 0)
+	defer w.close()
+
+	addTxs := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := b.txPool.AddLocal(b.newRandomTx(i%4 == 0)); err != nil {
+				t.Fatalf("Failed to add transaction %v", err)
+			}
+		}
+	}
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: recipient,
+	}
+	cache := new(spliceCache)
+	build := func(splice *spliceCache) *types.Block {
+		params := w.sealingParams(args, false)
+		params.splice = splice
+
+		block, _, err := w.getSealingBlock(params)
+		if err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		return block
+	}
+	// Build the initial version, checkpoints should be recorded along the way
+	addTxs(2*spliceCheckpointInterval + 3)
+	build(cache)
+	if len(cache.checkpoints) != 2 {
+		t.Fatalf("Checkpoint number mismatch, have %d, want 2", len(cache.checkpoints))
+	}
+	// Rebuild with new transactions on top of the unchanged prefix
+	for i := 0; i < 3; i++ {
+		addTxs(spliceCheckpointInterval / 2)
+
+		spliced, scratch := build(cache), build(nil)
+		if spliced.Hash() != scratch.Hash() {
+			t.Fatalf("Spliced block mismatch, have %x (root %x), want %x (root %x)", spliced.Hash(), spliced.Root(), scratch.Hash(), scratch.Root())
+		}
+		if len(spliced.Transactions()) != len(cache.txs) {
+			t.Fatalf("Cached transactions mismatch, have %d, want %d", len(cache.txs), len(spliced.Transactions()))
+		}
+	}
+}
+
+func TestSpliceRebuildMempoolView(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	addTxs := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := b.txPool.AddLocal(b.newRandomTx(false)); err != nil {
+				t.Fatalf("Failed to add transaction %v", err)
+			}
+		}
+	}
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}
+	cache := new(spliceCache)
+	build := func() *fillReport {
+		params := w.sealingParams(args, false)
+		params.splice, params.diagnose, params.report = cache, true, new(fillReport)
+
+		if _, _, err := w.getSealingBlock(params); err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		return params.report
+	}
+	addTxs(spliceCheckpointInterval + 3)
+	initial := build().view
+	if initial == nil || len(cache.checkpoints) != 1 {
+		t.Fatalf("Unexpected initial build, view %+v, checkpoints %d", initial, len(cache.checkpoints))
+	}
+	// Rebuild on top of the checkpoint, the view must reflect the current pool
+	addTxs(spliceCheckpointInterval / 2)
+	if view := build().view; view == nil || view.Txs != initial.Txs+spliceCheckpointInterval/2 {
+		t.Fatalf("Unexpected mempool view of the spliced build, have %+v, want %d transactions", view, initial.Txs+spliceCheckpointInterval/2)
+	}
+}
+
+func TestSpliceRebuildStalled(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	for i := 0; i < spliceCheckpointInterval+3; i++ {
+		if err := b.txPool.AddLocal(b.newRandomTx(false)); err != nil {
+			t.Fatalf("Failed to add transaction %v", err)
+		}
+	}
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}
+	cache := new(spliceCache)
+	build := func() *fillReport {
+		params := w.sealingParams(args, false)
+		params.splice, params.diagnose, params.report = cache, true, new(fillReport)
+
+		if _, _, err := w.getSealingBlock(params); err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		return params.report
+	}
+	build()
+	if len(cache.checkpoints) != 1 {
+		t.Fatalf("Checkpoint number mismatch, have %d, want 1", len(cache.checkpoints))
+	}
+	// Pretend an account was stalled by the previous build, the rebuild must
+	// only report its own findings
+	cache.checkpoints[0].stalled = []StalledAccount{{Address: common.HexToAddress("0xdead"), Nonce: 1, Next: 3}}
+	if stalled := build().stalled; len(stalled) != 0 {
+		t.Fatalf("Stale stalled accounts reported: %+v", stalled)
+	}
+}
+
+func TestProbeFeeRecipient(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	var (
+		accepting = common.HexToAddress("0xaa")
+		reverting = common.HexToAddress("0xbb")
+		header    = &types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(0), GasLimit: params.GenesisGasLimit, BaseFee: big.NewInt(params.InitialBaseFee)}
+	)
+	for _, c := range []struct {
+		recipient common.Address
+		code      []byte
+		fail      bool
+	}{
+		{testUserAddress, nil, false},
+		{accepting, []byte{byte(vm.STOP)}, false},
+		{reverting, []byte{byte(vm.PUSH1), 0, byte(vm.DUP1), byte(vm.REVERT)}, true},
+	} {
+		statedb, _ := b.chain.State()
+		if c.code != nil {
+			statedb.SetCode(c.recipient, c.code)
+		}
+		err := w.probeFeeRecipient(statedb, header, c.recipient)
+		if c.fail != errors.Is(err, errFeeRecipientRejects) {
+			t.Fatalf("recipient %x: unexpected probe result %v", c.recipient, err)
+		}
+	}
+}
+
+func TestValidateSealingBlock(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if err := w.validateSealingBlock(block); err != nil {
+		t.Fatalf("Failed to validate sealing block %v", err)
+	}
+	// Tamper the state root, the validation should catch it
+	header := block.Header()
+	header.Root = common.Hash{0x01}
+	if err := w.validateSealingBlock(block.WithSeal(header)); err == nil {
+		t.Fatal("Invalid state root is not detected")
+	}
+}
+
+func TestBuildPayloadAppendTxs(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		AppendTxs:    newTxs,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	if empty := payload.ResolveEmpty(); len(empty.Transactions) != 0 {
+		t.Fatalf("Unexpected transactions in empty block, have %d", len(empty.Transactions))
+	}
+	var (
+		full = payload.ResolveFull()
+		want = append(append([]*types.Transaction{}, pendingTxs...), newTxs...)
+	)
+	if len(full.Transactions) != len(want) {
+		t.Fatalf("Unexpected transaction set, have %d, want %d", len(full.Transactions), len(want))
+	}
+	for i, tx := range want {
+		enc, _ := tx.MarshalBinary()
+		if !bytes.Equal(full.Transactions[i], enc) {
+			t.Fatalf("Transaction %d mismatch, want %v", i, tx.Hash())
+		}
+	}
+}
+
+func TestPayloadBuildBid(t *testing.T) {
+	payload := newPayload(types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)}))
+	payload.update(types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), GasUsed: 21000}), big.NewInt(42))
+
+	var msg []byte
+	bid, err := payload.BuildBid(func(data []byte) []byte {
+		msg = data
+		sig, _ := crypto.Sign(crypto.Keccak256(data), testBankKey)
+		return sig
+	})
+	if err != nil {
+		t.Fatalf("Failed to build bid %v", err)
+	}
+	if bid.Value.Cmp(big.NewInt(42)) != 0 || bid.Header.GasUsed != 21000 {
+		t.Fatalf("Unexpected bid, value %v, gas used %d", bid.Value, bid.Header.GasUsed)
+	}
+	want, _ := rlp.EncodeToBytes([]interface{}{bid.Header, bid.Value})
+	if !bytes.Equal(msg, want) {
+		t.Fatal("Unexpected bid signing message")
+	}
+	pub, err := crypto.SigToPub(crypto.Keccak256(msg), bid.Signature)
+	if err != nil || crypto.PubkeyToAddress(*pub) != testBankAddress {
+		t.Fatalf("Invalid bid signature %v", err)
+	}
+}
+
+func TestResolveBeforeEmptyReady(t *testing.T) {
+	var (
+		payload = newPayload(nil)
+		empty   = types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)})
+	)
+	if payload.String() == "" || payload.FillRatio() != 0 || payload.Candidates() != nil {
+		t.Fatal("Unexpected accessor results before the empty block is ready")
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		payload.setEmpty(empty)
+	}()
+	data := payload.Resolve()
+	if data == nil || data.BlockHash != empty.Hash() {
+		t.Fatalf("Unexpected payload resolved, have %v", data)
+	}
+}
+
+func TestBuildPayloadAllowedTxTypes(t *testing.T) {
+	config := *testConfig
+	config.AllowedTxTypes = 1 << types.LegacyTxType
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// The pending access list transaction should be skipped
+	block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	for _, tx := range block.Transactions() {
+		if tx.Type() != types.LegacyTxType {
+			t.Fatalf("Disallowed transaction type included, hash %v, type %d", tx.Hash(), tx.Type())
+		}
+	}
+	if len(block.Transactions()) != 0 {
+		t.Fatalf("Unexpected transaction set, have %d, want 0", len(block.Transactions()))
+	}
+}
+
+func TestBuildPayloadBuilderPayout(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	config := *testConfig
+	config.BuilderKey = key
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// Add a few transactions tipping enough to cover the payout
+	for i := 0; i < 2; i++ {
+		if err := b.txPool.AddLocal(b.newRandomTx(false)); err != nil {
+			t.Fatalf("Failed to add transaction %v", err)
+		}
+	}
+	var (
+		builder   = crypto.PubkeyToAddress(key.PublicKey)
+		recipient = common.HexToAddress("0xdeadbeef")
+	)
+	block, fees, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: recipient,
+	}, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if block.Coinbase() != builder {
+		t.Fatalf("Unexpected coinbase, have %v, want %v", block.Coinbase(), builder)
+	}
+	txs := block.Transactions()
+	if len(txs) != len(pendingTxs)+3 {
+		t.Fatalf("Unexpected transaction set, have %d, want %d", len(txs), len(pendingTxs)+3)
+	}
+	payout := txs[len(txs)-1]
+	if from, _ := types.Sender(types.LatestSigner(params.TestChainConfig), payout); from != builder {
+		t.Fatalf("Unexpected payout sender, have %v, want %v", from, builder)
+	}
+	if to := payout.To(); to == nil || *to != recipient {
+		t.Fatalf("Unexpected payout recipient, have %v, want %v", to, recipient)
+	}
+	if fees.Sign() <= 0 || fees.Cmp(payout.Value()) != 0 {
+		t.Fatalf("Unexpected payload value, have %v, want %v", fees, payout.Value())
+	}
+	// The empty block has nothing to pay out
+	empty, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: recipient,
+	}, true))
+	if err != nil {
+		t.Fatalf("Failed to generate empty block %v", err)
+	}
+	if empty.Coinbase() != recipient {
+		t.Fatalf("Unexpected empty block coinbase, have %v, want %v", empty.Coinbase(), recipient)
+	}
+}
+
+func TestBuildPayloadCoinbase(t *testing.T) {
+	var (
+		coinbase  = common.HexToAddress("0xc0ffee")
+		recipient = common.HexToAddress("0xdeadbeef")
+	)
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// The header coinbase collects the fees instead of the fee recipient
+	for _, noTxs := range []bool{true, false} {
+		block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()),
+			FeeRecipient: recipient,
+			Coinbase:     coinbase,
+		}, noTxs))
+		if err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		if block.Coinbase() != coinbase {
+			t.Fatalf("Unexpected coinbase, have %v, want %v", block.Coinbase(), coinbase)
+		}
+	}
+	// The separate coinbase must be the builder account if it's configured
+	key, _ := crypto.GenerateKey()
+	w.builderKey, w.builderAddr = key, crypto.PubkeyToAddress(key.PublicKey)
+
+	_, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: recipient,
+		Coinbase:     coinbase,
+	})
+	if !errors.Is(err, errCoinbaseConflict) {
+		t.Fatalf("Unexpected error, have %v, want %v", err, errCoinbaseConflict)
+	}
+	// The builder account is written to both blocks, while the profit is paid
+	// out to the fee recipient
+	for i := 0; i < 2; i++ {
+		if err := b.txPool.AddLocal(b.newRandomTx(false)); err != nil {
+			t.Fatalf("Failed to add transaction %v", err)
+		}
+	}
+	for _, noTxs := range []bool{true, false} {
+		block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()),
+			FeeRecipient: recipient,
+			Coinbase:     w.builderAddr,
+		}, noTxs))
+		if err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		if block.Coinbase() != w.builderAddr {
+			t.Fatalf("Unexpected coinbase, have %v, want %v", block.Coinbase(), w.builderAddr)
+		}
+		if noTxs {
+			continue
+		}
+		txs := block.Transactions()
+		if to := txs[len(txs)-1].To(); to == nil || *to != recipient {
+			t.Fatalf("Unexpected payout recipient, have %v, want %v", to, recipient)
+		}
+	}
+}
+
+type testScorer map[common.Address]int64
+
+func (s testScorer) Score(addr common.Address) int64 { return s[addr] }
+
+func TestBuildPayloadAccountScorer(t *testing.T) {
+	config := *testConfig
+	config.AccountScorer = testScorer{testBankAddress: -1}
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// Fund the user account first for sending transactions
+	signer := types.LatestSigner(params.TestChainConfig)
+	fund := types.MustSignNewTx(testBankKey, signer, &types.LegacyTx{
+		Nonce:    b.txPool.Nonce(testBankAddress),
+		To:       &testUserAddress,
+		Value:    big.NewInt(params.Ether / 10),
+		Gas:      params.TxGas,
+		GasPrice: big.NewInt(params.InitialBaseFee),
+	})
+	if err := b.txPool.AddLocal(fund); err != nil {
+		t.Fatalf("Failed to add funding transaction %v", err)
+	}
+	block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    b.chain.CurrentBlock().Time() + 1,
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if _, err := b.chain.InsertChain([]*types.Block{block}); err != nil {
+		t.Fatalf("Failed to insert block %v", err)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if pending, _ := b.txPool.Stats(); pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Transaction pool is not reset")
+		}
+	}
+	// Equally priced transactions, the demoted bank account's one arrives first
+	var txs []*types.Transaction
+	for _, key := range []*ecdsa.PrivateKey{testBankKey, testUserKey} {
+		tx := types.MustSignNewTx(key, signer, &types.LegacyTx{
+			Nonce:    b.txPool.Nonce(crypto.PubkeyToAddress(key.PublicKey)),
+			To:       &common.Address{0x01},
+			Gas:      params.TxGas,
+			GasPrice: big.NewInt(params.InitialBaseFee),
+		})
+		if err := b.txPool.AddLocal(tx); err != nil {
+			t.Fatalf("Failed to add transaction %v", err)
+		}
+		txs = append(txs, tx)
+	}
+	block, _, err = w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    b.chain.CurrentBlock().Time() + 1,
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if len(block.Transactions()) != 2 {
+		t.Fatalf("Unexpected transaction set, have %d, want 2", len(block.Transactions()))
+	}
+	if have, want := block.Transactions()[0].Hash(), txs[1].Hash(); have != want {
+		t.Fatalf("Unexpected first transaction, have %v, want %v", have, want)
+	}
+}
+
+func TestBuildPayloadStateOverrides(t *testing.T) {
+	config := *testConfig
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// The unfunded user account can only send transactions with the overrides
+	tx := types.MustSignNewTx(testUserKey, types.LatestSigner(params.TestChainConfig), &types.LegacyTx{
+		Nonce:    0,
+		To:       &testBankAddress,
+		Value:    big.NewInt(1000),
+		Gas:      params.TxGas,
+		GasPrice: big.NewInt(params.InitialBaseFee),
+	})
+	args := &BuildPayloadArgs{
+		Parent:         b.chain.CurrentBlock().Hash(),
+		Timestamp:      uint64(time.Now().Unix()),
+		FeeRecipient:   common.HexToAddress("0xdeadbeef"),
+		AppendTxs:      []*types.Transaction{tx},
+		StateOverrides: StateOverride{testUserAddress: {Balance: big.NewInt(params.Ether)}},
+	}
+	if _, err := w.buildPayload(args); !errors.Is(err, errStateOverrideDisabled) {
+		t.Fatalf("Unexpected error, have %v, want %v", err, errStateOverrideDisabled)
+	}
+	config.AllowStateOverrides = true
+
+	block, _, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if txs := block.Transactions(); len(txs) == 0 || txs[len(txs)-1].Hash() != tx.Hash() {
+		t.Fatal("Transaction enabled by the overrides is not included")
+	}
+	// The real state must be untouched
+	statedb, err := b.chain.State()
+	if err != nil {
+		t.Fatalf("Failed to retrieve state %v", err)
+	}
+	if balance := statedb.GetBalance(testUserAddress); balance.Sign() != 0 {
+		t.Fatalf("Real state is mutated, user balance %v", balance)
+	}
+}
+
+func TestGetSealingBlockInterrupt(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}
+	params := w.sealingParams(args, false)
+	params.interrupt = new(int32)
+
+	// The signal fired by the payload termination aborts the filling, the
+	// partial block is returned instead of an error.
+	payload := newPayload(nil)
+	payload.setInterrupt(params.interrupt)
+	payload.stopBuilding()
+
+	block, _, err := w.getSealingBlock(params)
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if len(block.Transactions()) != 0 {
+		t.Fatalf("Unexpected transactions in interrupted block, have %d", len(block.Transactions()))
+	}
+	// The uninterrupted building includes the pending transactions
+	block, _, err = w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if len(block.Transactions()) != len(pendingTxs) {
+		t.Fatalf("Unexpected transaction set, have %d, want %d", len(block.Transactions()), len(pendingTxs))
+	}
+}
+
+func TestBuildPayloadMinTxAge(t *testing.T) {
+	config := *testConfig
+	config.MinTxAge = 100 * time.Millisecond
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// Age the pending transactions, then add a fresh one on top
+	if wait := config.MinTxAge - time.Since(pendingTxs[0].Time()); wait > 0 {
+		time.Sleep(wait)
+	}
+	fresh := b.newRandomTx(false)
+	if err := b.txPool.AddLocal(fresh); err != nil {
+		t.Fatalf("Failed to add transaction %v", err)
+	}
+	block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if len(block.Transactions()) != len(pendingTxs) {
+		t.Fatalf("Unexpected transaction set, have %d, want %d", len(block.Transactions()), len(pendingTxs))
+	}
+	for _, tx := range block.Transactions() {
+		if tx.Hash() == fresh.Hash() {
+			t.Fatal("Fresh transaction is included")
+		}
+	}
+}
+
+func TestBuildPayloadReserveGas(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// Queue two more transactions, the last one is appended explicitly as well
+	var txs []*types.Transaction
+	for i := 0; i < 2; i++ {
+		tx := b.newRandomTx(false)
+		if err := b.txPool.AddLocal(tx); err != nil {
+			t.Fatalf("Failed to add transaction %v", err)
+		}
+		txs = append(txs, tx)
+	}
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		AppendTxs:    txs[1:],
+	}
+	// Without the reservation the txpool fill includes the appended one already
+	if _, _, err := w.getSealingBlock(w.sealingParams(args, false)); err == nil {
+		t.Fatal("Appended transaction is included twice")
+	}
+	empty, _, err := w.getSealingBlock(w.sealingParams(args, true))
+	if err != nil {
+		t.Fatalf("Failed to generate empty block %v", err)
+	}
+	args.ReserveGas = empty.GasLimit() - 2*params.TxGas
+
+	block, _, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	want := []common.Hash{pendingTxs[0].Hash(), txs[0].Hash(), txs[1].Hash()}
+	if len(block.Transactions()) != len(want) {
+		t.Fatalf("Unexpected transaction set, have %d, want %d", len(block.Transactions()), len(want))
+	}
+	for i, tx := range block.Transactions() {
+		if tx.Hash() != want[i] {
+			t.Fatalf("Transaction %d mismatch, have %v, want %v", i, tx.Hash(), want[i])
+		}
+	}
+}
+
+func TestPayloadInvalidBlocksBreaker(t *testing.T) {
+	config := *testConfig
+	config.ValidateBeforeStore = true
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	var validated int32
+	w.recommit = 10 * time.Millisecond
+	w.validateHook = func(block *types.Block) error {
+		atomic.AddInt32(&validated, 1)
+		return errors.New("systemic failure")
+	}
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	select {
+	case <-payload.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Payload building is not given up")
+	}
+	if err := payload.Err(); !errors.Is(err, errTooManyInvalidBlocks) {
+		t.Fatalf("Unexpected payload error, have %v, want %v", err, errTooManyInvalidBlocks)
+	}
+	if n := atomic.LoadInt32(&validated); n != maxInvalidPayloadBlocks {
+		t.Fatalf("Unexpected validation count, have %d, want %d", n, maxInvalidPayloadBlocks)
+	}
+	// The empty block is still served
+	if data := payload.Resolve(); data == nil || len(data.Transactions) != 0 {
+		t.Fatal("Empty block is not served")
+	}
+}
+
+func TestBuildPayloadOnTxIncluded(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	included := make(chan *types.Receipt, len(pendingTxs))
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		OnTxIncluded: func(tx *types.Transaction, receipt *types.Receipt) {
+			if receipt.TxHash != tx.Hash() {
+				t.Errorf("Receipt mismatch, have %v, want %v", receipt.TxHash, tx.Hash())
+			}
+			included <- receipt
+		},
+	}
+	block, _, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	for i := range block.Transactions() {
+		select {
+		case receipt := <-included:
+			if receipt.BlockHash != block.Hash() || receipt.TransactionIndex != uint(i) {
+				t.Fatalf("Unexpected receipt location, hash %v, index %d", receipt.BlockHash, receipt.TransactionIndex)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Transaction %d is not notified", i)
+		}
+	}
+	// The empty block notifies nothing
+	if _, _, err := w.getSealingBlock(w.sealingParams(args, true)); err != nil {
+		t.Fatalf("Failed to generate empty block %v", err)
+	}
+	select {
+	case <-included:
+		t.Fatal("Unexpected notification for empty block")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBuildPayloadPendingSnapshot(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	snapshot := w.snapshotPending()
+	if snapshot.Len() != len(pendingTxs) {
+		t.Fatalf("Unexpected snapshot size, have %d, want %d", snapshot.Len(), len(pendingTxs))
+	}
+	// The transactions arriving afterwards are invisible for the snapshot
+	if err := b.txPool.AddLocal(b.newRandomTx(false)); err != nil {
+		t.Fatalf("Failed to add transaction %v", err)
+	}
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		Pending:      snapshot,
+	}
+	var hashes []common.Hash
+	for i := 0; i < 2; i++ {
+		block, _, err := w.getSealingBlock(w.sealingParams(args, false))
+		if err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		if len(block.Transactions()) != len(pendingTxs) {
+			t.Fatalf("Unexpected transaction set, have %d, want %d", len(block.Transactions()), len(pendingTxs))
+		}
+		hashes = append(hashes, block.Hash())
+	}
+	if hashes[0] != hashes[1] {
+		t.Fatalf("Blocks built from the same snapshot mismatch, %v != %v", hashes[0], hashes[1])
+	}
+}
+
+func TestBuildPayloadMaxRebuilds(t *testing.T) {
+	config := *testConfig
+	config.MaxRebuilds = 3
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	var builds int32
+	w.recommit = 10 * time.Millisecond
+	w.fillHook = func() { atomic.AddInt32(&builds, 1) }
+
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	select {
+	case <-payload.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Payload building is not stopped")
+	}
+	if n := atomic.LoadInt32(&builds); n != int32(config.MaxRebuilds) {
+		t.Fatalf("Unexpected build iterations, have %d, want %d", n, config.MaxRebuilds)
+	}
+	// The best block is still resolvable
+	if data := payload.Resolve(); data == nil || len(data.Transactions) != len(pendingTxs) {
+		t.Fatal("Full block is not resolvable")
+	}
+}
+
+func TestBuildPayloadFirstBuildDelay(t *testing.T) {
+	config := *testConfig
+	config.FirstBuildDelay = 300 * time.Millisecond
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	first := make(chan time.Time, 1)
+	w.fillHook = func() {
+		select {
+		case first <- time.Now():
+		default:
+		}
+	}
+	start := time.Now()
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	defer payload.stopBuilding()
+
+	select {
+	case at := <-first:
+		if elapsed := at.Sub(start); elapsed < config.FirstBuildDelay {
+			t.Fatalf("First full build is too early, elapsed %v, delay %v", elapsed, config.FirstBuildDelay)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("First full build is not triggered")
+	}
+}
+
+func TestPayloadReport(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		Label:        "report",
+	}
+	payload, err := w.buildPayload(args)
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	full := payload.ResolveFull()
+	payload.stopBuilding()
+
+	report := payload.Report()
+	if report.ID != args.Id() || report.Label != args.Label {
+		t.Fatalf("Unexpected payload identity, id %v, label %q", report.ID, report.Label)
+	}
+	if report.Parent != args.Parent || report.Timestamp != args.Timestamp {
+		t.Fatalf("Unexpected payload attributes, parent %x, timestamp %d", report.Parent, report.Timestamp)
+	}
+	if !report.Full || report.Rebuilds == 0 {
+		t.Fatalf("Unexpected build progress, full %v, rebuilds %d", report.Full, report.Rebuilds)
+	}
+	if report.GasUsed != full.GasUsed || report.PeakGasUsed < report.GasUsed {
+		t.Fatalf("Unexpected gas used, have %d (peak %d), want %d", report.GasUsed, report.PeakGasUsed, full.GasUsed)
+	}
+	if report.Fees.Sign() <= 0 || report.FillStop != FillStopTxsExhausted || report.Err != nil {
+		t.Fatalf("Unexpected build outcome, fees %v, fill stop %q, err %v", report.Fees, report.FillStop, report.Err)
+	}
+}
+
+func TestBuildPayloadFinalRebuild(t *testing.T) {
+	config := *testConfig
+	config.FinalRebuildLead = 12*time.Second - 500*time.Millisecond
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// Space the regular re-builds beyond the deadline, only the final one can
+	// capture the late transaction.
+	w.recommit = time.Hour
+
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	defer payload.stopBuilding()
+
+	waitRebuilds := func(n int) {
+		for start := time.Now(); payload.Report().Rebuilds < n; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("Payload is not re-built, have %d, want %d", payload.Report().Rebuilds, n)
+			}
+		}
+	}
+	waitRebuilds(1)
+
+	late := b.newRandomTx(false)
+	if err := b.txPool.AddLocal(late); err != nil {
+		t.Fatalf("Failed to add transaction %v", err)
+	}
+	waitRebuilds(2)
+
+	full := payload.ResolveFull()
+	enc, _ := late.MarshalBinary()
+	for _, tx := range full.Transactions {
+		if bytes.Equal(tx, enc) {
+			return
+		}
+	}
+	t.Fatal("Late transaction is not captured by the final re-build")
+}
+
+func TestBuildPayloadOrderSeed(t *testing.T) {
+	config := *testConfig
+	config.AllowStateOverrides = true
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// Fund a few senders paying the same tip, only the seed decides the order
+	var (
+		signer    = types.LatestSigner(params.TestChainConfig)
+		overrides = make(StateOverride)
+		pending   = &PendingSnapshot{remotes: make(map[common.Address]types.Transactions)}
+	)
+	for i := 0; i < 8; i++ {
+		key, _ := crypto.GenerateKey()
+		addr := crypto.PubkeyToAddress(key.PublicKey)
+		overrides[addr] = AccountOverride{Balance: big.NewInt(params.Ether)}
+		for nonce := uint64(0); nonce < 2; nonce++ {
+			tx := types.MustSignNewTx(key, signer, &types.LegacyTx{
+				Nonce:    nonce,
+				To:       &testUserAddress,
+				Value:    big.NewInt(1000),
+				Gas:      params.TxGas,
+				GasPrice: big.NewInt(params.InitialBaseFee),
+			})
+			pending.remotes[addr] = append(pending.remotes[addr], tx)
+		}
+	}
+	order := func(seed uint64) []common.Hash {
+		block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+			Parent:         b.chain.CurrentBlock().Hash(),
+			Timestamp:      uint64(time.Now().Unix()),
+			FeeRecipient:   common.HexToAddress("0xdeadbeef"),
+			StateOverrides: overrides,
+			Pending:        pending,
+			OrderSeed:      seed,
+		}, false))
+		if err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		nonces := make(map[common.Address]uint64)
+		var hashes []common.Hash
+		for _, tx := range block.Transactions() {
+			from, _ := types.Sender(signer, tx)
+			if tx.Nonce() != nonces[from] {
+				t.Fatalf("Nonce ordering violated, sender %x, have %d, want %d", from, tx.Nonce(), nonces[from])
+			}
+			nonces[from]++
+			hashes = append(hashes, tx.Hash())
+		}
+		if len(hashes) != 16 {
+			t.Fatalf("Unexpected transaction set, have %d, want 16", len(hashes))
+		}
+		return hashes
+	}
+	same := func(a, b []common.Hash) bool {
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+	first := order(1)
+	if !same(first, order(1)) {
+		t.Fatal("Transaction order mismatch with the same seed")
+	}
+	// Different seeds explore the orderings, it's practically impossible for
+	// all of them to collide with 8 senders.
+	for seed := uint64(2); same(first, order(seed)); seed++ {
+		if seed == 5 {
+			t.Fatal("Different seeds produce the same order")
+		}
+	}
+}
+
+func TestPayloadTimeRemaining(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	if remaining := payload.TimeRemaining(); remaining <= 0 || remaining > 12*time.Second {
+		t.Fatalf("Unexpected remaining time %v", remaining)
+	}
+	payload.Resolve()
+	if remaining := payload.TimeRemaining(); remaining != 0 {
+		t.Fatalf("Unexpected remaining time after stopped, have %v, want 0", remaining)
+	}
+}
+
+func TestBuildPayloadMinGasPrice(t *testing.T) {
+	config := *testConfig
+	config.AllowStateOverrides = true
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	var (
+		signer    = types.LatestSigner(params.TestChainConfig)
+		floor     = big.NewInt(2 * params.InitialBaseFee)
+		overrides = make(StateOverride)
+		pending   = &PendingSnapshot{remotes: make(map[common.Address]types.Transactions)}
+		want      = make(map[common.Hash]bool)
+	)
+	for _, test := range []struct {
+		data    types.TxData
+		include bool
+	}{
+		{&types.LegacyTx{To: &testUserAddress, Gas: params.TxGas, GasPrice: big.NewInt(params.InitialBaseFee)}, false},
+		{&types.LegacyTx{To: &testUserAddress, Gas: params.TxGas, GasPrice: big.NewInt(3 * params.InitialBaseFee)}, true},
+		{&types.AccessListTx{ChainID: params.TestChainConfig.ChainID, To: &testUserAddress, Gas: params.TxGas, GasPrice: big.NewInt(params.InitialBaseFee)}, false},
+		{&types.DynamicFeeTx{ChainID: params.TestChainConfig.ChainID, To: &testUserAddress, Gas: params.TxGas, GasFeeCap: big.NewInt(3 * params.InitialBaseFee), GasTipCap: big.NewInt(1)}, true},
+	} {
+		key, _ := crypto.GenerateKey()
+		addr := crypto.PubkeyToAddress(key.PublicKey)
+		tx := types.MustSignNewTx(key, signer, test.data)
+
+		overrides[addr] = AccountOverride{Balance: big.NewInt(params.Ether)}
+		pending.remotes[addr] = types.Transactions{tx}
+		if test.include {
+			want[tx.Hash()] = true
+		}
+	}
+	block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+		Parent:         b.chain.CurrentBlock().Hash(),
+		Timestamp:      uint64(time.Now().Unix()),
+		FeeRecipient:   common.HexToAddress("0xdeadbeef"),
+		StateOverrides: overrides,
+		Pending:        pending,
+		MinGasPrice:    floor,
+	}, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if len(block.Transactions()) != len(want) {
+		t.Fatalf("Unexpected transaction set, have %d, want %d", len(block.Transactions()), len(want))
+	}
+	for _, tx := range block.Transactions() {
+		if !want[tx.Hash()] {
+			t.Fatalf("Underpriced transaction included, hash %v", tx.Hash())
+		}
+	}
+}
+
+func TestBuildPayloadRelayMinGasPrice(t *testing.T) {
+	config := *testConfig
+	config.AllowStateOverrides = true
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	var (
+		signer    = types.LatestSigner(params.TestChainConfig)
+		parent    = b.chain.CurrentBlock()
+		baseFee   = misc.CalcBaseFee(params.TestChainConfig, parent.Header())
+		floor     = new(big.Int).Mul(baseFee, big.NewInt(2))
+		chainID   = params.TestChainConfig.ChainID
+		overrides = make(StateOverride)
+		pending   = &PendingSnapshot{remotes: make(map[common.Address]types.Transactions)}
+		want      = make(map[common.Hash]bool)
+	)
+	// times returns the given multiple of the base fee
+	times := func(n int64) *big.Int {
+		return new(big.Int).Mul(baseFee, big.NewInt(n))
+	}
+	for _, test := range []struct {
+		data    types.TxData
+		include bool
+	}{
+		{&types.LegacyTx{To: &testUserAddress, Gas: params.TxGas, GasPrice: baseFee}, false},
+		{&types.LegacyTx{To: &testUserAddress, Gas: params.TxGas, GasPrice: floor}, true},
+		{&types.AccessListTx{ChainID: chainID, To: &testUserAddress, Gas: params.TxGas, GasPrice: times(3)}, true},
+		// The fee cap above the floor doesn't help if the effective price is below
+		{&types.DynamicFeeTx{ChainID: chainID, To: &testUserAddress, Gas: params.TxGas, GasFeeCap: times(3), GasTipCap: big.NewInt(1)}, false},
+		// The tip above the floor doesn't help if the fee cap is below
+		{&types.DynamicFeeTx{ChainID: chainID, To: &testUserAddress, Gas: params.TxGas, GasFeeCap: new(big.Int).Sub(floor, big.NewInt(1)), GasTipCap: times(3)}, false},
+		{&types.DynamicFeeTx{ChainID: chainID, To: &testUserAddress, Gas: params.TxGas, GasFeeCap: times(3), GasTipCap: baseFee}, true},
+	} {
+		key, _ := crypto.GenerateKey()
+		addr := crypto.PubkeyToAddress(key.PublicKey)
+		tx := types.MustSignNewTx(key, signer, test.data)
+
+		overrides[addr] = AccountOverride{Balance: big.NewInt(params.Ether)}
+		pending.remotes[addr] = types.Transactions{tx}
+		if test.include {
+			want[tx.Hash()] = true
+		}
+	}
+	block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+		Parent:           parent.Hash(),
+		Timestamp:        uint64(time.Now().Unix()),
+		FeeRecipient:     common.HexToAddress("0xdeadbeef"),
+		StateOverrides:   overrides,
+		Pending:          pending,
+		RelayMinGasPrice: floor,
+	}, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if len(block.Transactions()) != len(want) {
+		t.Fatalf("Unexpected transaction set, have %d, want %d", len(block.Transactions()), len(want))
+	}
+	for _, tx := range block.Transactions() {
+		if !want[tx.Hash()] {
+			t.Fatalf("Transaction below relay floor included, hash %v", tx.Hash())
+		}
+	}
+}
+
+func TestBuildPayloadAffordabilityMargin(t *testing.T) {
+	config := *testConfig
+	config.AllowStateOverrides = true
+	config.AffordabilityMargin = 50
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	var (
+		signer    = types.LatestSigner(params.TestChainConfig)
+		parent    = b.chain.CurrentBlock()
+		baseFee   = misc.CalcBaseFee(params.TestChainConfig, parent.Header())
+		overrides = make(StateOverride)
+		pending   = &PendingSnapshot{remotes: make(map[common.Address]types.Transactions)}
+		want      = make(map[common.Hash]bool)
+	)
+	// percent returns the given percentage of the base fee
+	percent := func(n int64) *big.Int {
+		fee := new(big.Int).Mul(baseFee, big.NewInt(n))
+		return fee.Div(fee, big.NewInt(100))
+	}
+	for _, test := range []struct {
+		data    types.TxData
+		include bool
+	}{
+		{&types.LegacyTx{To: &testUserAddress, Gas: params.TxGas, GasPrice: percent(120)}, false},
+		{&types.LegacyTx{To: &testUserAddress, Gas: params.TxGas, GasPrice: percent(150)}, true},
+		{&types.DynamicFeeTx{ChainID: params.TestChainConfig.ChainID, To: &testUserAddress, Gas: params.TxGas, GasFeeCap: percent(149), GasTipCap: big.NewInt(1)}, false},
+		{&types.DynamicFeeTx{ChainID: params.TestChainConfig.ChainID, To: &testUserAddress, Gas: params.TxGas, GasFeeCap: percent(200), GasTipCap: big.NewInt(1)}, true},
+	} {
+		key, _ := crypto.GenerateKey()
+		addr := crypto.PubkeyToAddress(key.PublicKey)
+		tx := types.MustSignNewTx(key, signer, test.data)
+
+		overrides[addr] = AccountOverride{Balance: big.NewInt(params.Ether)}
+		pending.remotes[addr] = types.Transactions{tx}
+		if test.include {
+			want[tx.Hash()] = true
+		}
+	}
+	block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+		Parent:         parent.Hash(),
+		Timestamp:      uint64(time.Now().Unix()),
+		FeeRecipient:   common.HexToAddress("0xdeadbeef"),
+		StateOverrides: overrides,
+		Pending:        pending,
+	}, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if len(block.Transactions()) != len(want) {
+		t.Fatalf("Unexpected transaction set, have %d, want %d", len(block.Transactions()), len(want))
+	}
+	for _, tx := range block.Transactions() {
+		if !want[tx.Hash()] {
+			t.Fatalf("Transaction within the margin included, hash %v", tx.Hash())
+		}
+	}
+}
+
+func TestBuildPayloadGasUsedTarget(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+	b.txPool.AddLocals(newTxs)
+
+	for i, test := range []struct {
+		target uint64
+		txs    int
+		stop   string
+	}{
+		{0, 2, FillStopTxsExhausted},
+		{params.TxGas, 1, FillStopGasLimit},
+		{params.TxGas + params.TxGas/2, 1, FillStopGasLimit},
+		{2 * params.TxGas, 2, FillStopGasLimit},
+		{b.chain.CurrentBlock().GasLimit() * 2, 2, FillStopTxsExhausted},
+	} {
+		genParams := w.sealingParams(&BuildPayloadArgs{
+			Parent:        b.chain.CurrentBlock().Hash(),
+			Timestamp:     uint64(time.Now().Unix()),
+			FeeRecipient:  common.HexToAddress("0xdeadbeef"),
+			GasUsedTarget: test.target,
+		}, false)
+		genParams.report = new(fillReport)
+		block, _, err := w.getSealingBlock(genParams)
+		if err != nil {
+			t.Fatalf("test %d: failed to generate block %v", i, err)
+		}
+		if len(block.Transactions()) != test.txs {
+			t.Errorf("test %d: unexpected transaction count, have %d, want %d", i, len(block.Transactions()), test.txs)
+		}
+		if test.target > 0 && block.GasUsed() > test.target {
+			t.Errorf("test %d: gas used %d exceeds the target %d", i, block.GasUsed(), test.target)
+		}
+		if genParams.report.stop != test.stop {
+			t.Errorf("test %d: unexpected fill stop, have %s, want %s", i, genParams.report.stop, test.stop)
+		}
+	}
+}
+
+func TestBuildPayloadRelaxOnLowValue(t *testing.T) {
+	build := func(threshold *big.Int) *Payload {
+		config := *testConfig
+		config.RelaxOnLowValue = threshold
+
+		w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+		t.Cleanup(w.close)
+		iterations := watchIterations(w)
+
+		// The pending transactions are all below the gas price floor
+		payload, err := w.buildPayload(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()),
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+			MinGasPrice:  big.NewInt(2 * params.InitialBaseFee),
+		})
+		if err != nil {
+			t.Fatalf("Failed to build payload %v", err)
+		}
+		t.Cleanup(payload.stopBuilding)
+
+		select {
+		case result := <-iterations:
+			if result.err != nil || result.txs != 0 {
+				t.Fatalf("Unexpected strict iteration, txs %d, err %v", result.txs, result.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Payload building iteration is not finished")
+		}
+		return payload
+	}
+	// The strict build is kept without the fallback
+	payload := build(nil)
+	payload.lock.Lock()
+	if payload.full != nil {
+		t.Fatalf("Unexpected full block with %d transactions", len(payload.full.Transactions()))
+	}
+	payload.lock.Unlock()
+
+	// The relaxed build picks up the transactions below the floor
+	payload = build(big.NewInt(1))
+	payload.lock.Lock()
+	if payload.full == nil || len(payload.full.Transactions()) != len(pendingTxs) {
+		t.Fatal("Relaxed full block is not kept")
+	}
+	payload.lock.Unlock()
+}
+
+func TestBuildPayloadRelaxOnce(t *testing.T) {
+	config := *testConfig
+	config.RelaxOnLowValue = big.NewInt(params.Ether) // never reached
+	config.MaxRebuilds = 3
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	var builds int32
+	w.recommit = 10 * time.Millisecond
+	w.fillHook = func() { atomic.AddInt32(&builds, 1) }
+
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	select {
+	case <-payload.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Payload building is not stopped")
+	}
+	// The poor strict builds are followed by a single relaxed one
+	if n := atomic.LoadInt32(&builds); n != int32(config.MaxRebuilds)+1 {
+		t.Fatalf("Unexpected build number, have %d, want %d", n, config.MaxRebuilds+1)
+	}
+}
+
+func TestBuildPayloadEqualTipOrder(t *testing.T) {
+	config := *testConfig
+	config.AllowStateOverrides = true
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	var (
+		signer    = types.LatestSigner(params.TestChainConfig)
+		overrides = make(StateOverride)
+		txs       []*types.Transaction
+	)
+	for i := 0; i < 8; i++ {
+		key, _ := crypto.GenerateKey()
+		addr := crypto.PubkeyToAddress(key.PublicKey)
+		overrides[addr] = AccountOverride{Balance: big.NewInt(params.Ether)}
+		txs = append(txs, types.MustSignNewTx(key, signer, &types.LegacyTx{
+			To:       &testUserAddress,
+			Gas:      params.TxGas,
+			GasPrice: big.NewInt(2 * params.InitialBaseFee),
+		}))
+	}
+	var first []common.Hash
+	for round := 0; round < 4; round++ {
+		// Rebuild the snapshot every round, the ordering must not depend on
+		// the map iteration
+		pending := &PendingSnapshot{remotes: make(map[common.Address]types.Transactions)}
+		for _, tx := range txs {
+			from, _ := types.Sender(signer, tx)
+			pending.remotes[from] = types.Transactions{tx}
+		}
+		block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+			Parent:         b.chain.CurrentBlock().Hash(),
+			Timestamp:      uint64(time.Now().Unix()),
+			FeeRecipient:   common.HexToAddress("0xdeadbeef"),
+			StateOverrides: overrides,
+			Pending:        pending,
+		}, false))
+		if err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		var order []common.Hash
+		for _, tx := range block.Transactions() {
+			order = append(order, tx.Hash())
+		}
+		if len(order) != len(txs) {
+			t.Fatalf("Unexpected transaction count, have %d, want %d", len(order), len(txs))
+		}
+		if first == nil {
+			first = order
+		} else if !reflect.DeepEqual(order, first) {
+			t.Fatalf("round %d: unstable transaction order", round)
+		}
+	}
+}
+
+func TestPayloadBlockVeto(t *testing.T) {
+	var (
+		db        = rawdb.NewMemoryDatabase()
+		recipient = common.HexToAddress("0xdeadbeef")
+	)
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), db, 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: recipient,
+	}
+	empty, _, err := w.getSealingBlock(w.sealingParams(args, true))
+	if err != nil {
+		t.Fatalf("Failed to generate empty block %v", err)
+	}
+	short, shortFees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate short block %v", err)
+	}
+	b.txPool.AddLocals(newTxs)
+	long, longFees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate long block %v", err)
+	}
+	// Veto the more valuable block, it must never be stored
+	payload := newPayload(empty)
+	payload.veto = func(block *types.Block) bool { return block.Hash() == long.Hash() }
+
+	payload.update(short, shortFees)
+	payload.update(long, longFees)
+	if full := payload.ResolveFull(); full.BlockHash != short.Hash() {
+		t.Fatalf("Unexpected full block, have %x, want %x", full.BlockHash, short.Hash())
+	}
+	if fees := payload.CurrentFees(); fees.Cmp(shortFees) != 0 {
+		t.Fatalf("Unexpected fees, have %v, want %v", fees, shortFees)
+	}
+	// The waiters for the full block are woken up by the vetoed ones too
+	vetoed := newPayload(empty)
+	vetoed.veto = func(*types.Block) bool { return true }
+
+	woken := make(chan struct{})
+	go func() {
+		vetoed.ResolveFull()
+		close(woken)
+	}()
+	for timeout := time.After(5 * time.Second); ; {
+		vetoed.update(long, longFees)
+		select {
+		case <-woken:
+			return
+		case <-timeout:
+			t.Fatal("Waiter is not woken up by vetoed block")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestPayloadRequireRecipientGain(t *testing.T) {
+	var (
+		db        = rawdb.NewMemoryDatabase()
+		recipient = common.HexToAddress("0xdeadbeef")
+	)
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), db, 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: recipient,
+	}
+	empty, _, err := w.getSealingBlock(w.sealingParams(args, true))
+	if err != nil {
+		t.Fatalf("Failed to generate empty block %v", err)
+	}
+	genParams := w.sealingParams(args, false)
+	genParams.report = new(fillReport)
+	paying, payingFees, err := w.getSealingBlock(genParams)
+	if err != nil {
+		t.Fatalf("Failed to generate paying block %v", err)
+	}
+	paid := genParams.report
+	if paid.gain == nil || paid.gain.Sign() <= 0 {
+		t.Fatalf("Unexpected recipient gain, have %v, want positive", paid.gain)
+	}
+	b.txPool.AddLocals(newTxs)
+	unpaid, unpaidFees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate unpaid block %v", err)
+	}
+	// The more valuable block doesn't increase the recipient balance, it must
+	// never be stored
+	payload := newPayload(empty)
+	payload.requireGain = true
+
+	payload.updateFull(unpaid, unpaidFees, &fillReport{gain: new(big.Int)})
+	if payload.full != nil {
+		t.Fatalf("Block without recipient gain is accepted")
+	}
+	payload.updateFull(paying, payingFees, paid)
+	if full := payload.ResolveFull(); full.BlockHash != paying.Hash() {
+		t.Fatalf("Unexpected full block, have %x, want %x", full.BlockHash, paying.Hash())
+	}
+	// The waiters for the full block are woken up by the discarded ones too
+	unpaying := newPayload(empty)
+	unpaying.requireGain = true
+
+	woken := make(chan struct{})
+	go func() {
+		unpaying.ResolveFull()
+		close(woken)
+	}()
+	for timeout := time.After(5 * time.Second); ; {
+		unpaying.updateFull(unpaid, unpaidFees, &fillReport{gain: new(big.Int)})
+		select {
+		case <-woken:
+			return
+		case <-timeout:
+			t.Fatal("Waiter is not woken up by block without recipient gain")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestPayloadOnCandidate(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}
+	empty, _, err := w.getSealingBlock(w.sealingParams(args, true))
+	if err != nil {
+		t.Fatalf("Failed to generate empty block %v", err)
+	}
+	short, shortFees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate short block %v", err)
+	}
+	b.txPool.AddLocals(newTxs)
+	long, longFees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate long block %v", err)
+	}
+	type decision struct {
+		hash     common.Hash
+		accepted bool
+	}
+	decisions := make(chan decision, 4)
+
+	payload := newPayload(empty)
+	payload.veto = func(block *types.Block) bool { return block.Hash() == short.Hash() }
+	payload.onCandidate = func(block *types.Block, fees *big.Int, accepted bool) {
+		decisions <- decision{block.Hash(), accepted}
+	}
+	payload.update(long, longFees)
+	if d := <-decisions; d.hash != long.Hash() || !d.accepted {
+		t.Fatalf("Unexpected first decision %v", d)
+	}
+
+	payload.update(short, shortFees) // vetoed
+	payload.update(long, longFees)   // not better than itself
+	payload.stopBuilding()
+	payload.update(short, shortFees) // stale, not reported
+
+	have := map[decision]int{}
+	for i := 0; i < 2; i++ {
+		select {
+		case d := <-decisions:
+			have[d]++
+		case <-time.After(time.Second):
+			t.Fatal("Candidate decision not reported")
+		}
+	}
+	want := map[decision]int{{short.Hash(), false}: 1, {long.Hash(), false}: 1}
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("Unexpected decisions, have %v, want %v", have, want)
+	}
+	select {
+	case d := <-decisions:
+		t.Fatalf("Unexpected decision %v", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBuildPayloadBaseFeeOverride(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	parent := b.chain.CurrentBlock()
+	if parent.GasUsed() != 0 || parent.BaseFee() == nil {
+		t.Fatalf("Unexpected parent, gas used %d, base fee %v", parent.GasUsed(), parent.BaseFee())
+	}
+	var tests = []struct {
+		elasticity  uint64
+		denominator uint64
+		want        *big.Int // an empty parent lowers the base fee by 1/denominator
+	}{
+		{0, 0, new(big.Int).Sub(parent.BaseFee(), new(big.Int).Div(parent.BaseFee(), big.NewInt(8)))},
+		{6, 0, new(big.Int).Sub(parent.BaseFee(), new(big.Int).Div(parent.BaseFee(), big.NewInt(8)))},
+		{0, 50, new(big.Int).Sub(parent.BaseFee(), new(big.Int).Div(parent.BaseFee(), big.NewInt(50)))},
+		{6, 250, new(big.Int).Sub(parent.BaseFee(), new(big.Int).Div(parent.BaseFee(), big.NewInt(250)))},
+	}
+	for i, test := range tests {
+		args := &BuildPayloadArgs{
+			Parent:                   parent.Hash(),
+			Timestamp:                parent.Time() + 1,
+			FeeRecipient:             common.HexToAddress("0xdeadbeef"),
+			ElasticityMultiplier:     test.elasticity,
+			BaseFeeChangeDenominator: test.denominator,
+		}
+		block, _, err := w.getSealingBlock(w.sealingParams(args, true))
+		if err != nil {
+			t.Fatalf("test %d: failed to generate block %v", i, err)
+		}
+		if block.BaseFee().Cmp(test.want) != 0 {
+			t.Errorf("test %d: unexpected base fee, have %v, want %v", i, block.BaseFee(), test.want)
+		}
+	}
+}
+
+func TestBuildPayloadBuiltBlocks(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// Subscribe a stalled consumer besides the active one, it must not hold up
+	// the building
+	var (
+		built   = make(chan *types.Block, 1)
+		stalled = make(chan *types.Block)
+		sub     = w.builtBlockFeed.Subscribe(built)
+		stall   = w.builtBlockFeed.Subscribe(stalled)
+	)
+	defer sub.Unsubscribe()
+	defer stall.Unsubscribe()
+
+	for i := 0; i < 2; i++ {
+		payload, err := w.buildPayload(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()) + uint64(i),
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		})
+		if err != nil {
+			t.Fatalf("Failed to build payload %v", err)
+		}
+		full := payload.ResolveFull()
+		payload.Resolve()
+
+		if i == 0 {
+			select {
+			case block := <-built:
+				if block.Hash() != full.BlockHash {
+					t.Fatalf("Unexpected built block, have %x, want %x", block.Hash(), full.BlockHash)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Built block not delivered")
+			}
+		}
+	}
+}
+
+func TestPayloadOnSuperseded(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}
+	empty, _, err := w.getSealingBlock(w.sealingParams(args, true))
+	if err != nil {
+		t.Fatalf("Failed to generate empty block %v", err)
+	}
+	short, shortFees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate short block %v", err)
+	}
+	b.txPool.AddLocals(newTxs)
+	long, longFees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate long block %v", err)
+	}
+	superseded := make(chan [2]*big.Int, 4)
+
+	payload := newPayload(empty)
+	payload.onSuperseded = func(old, new *big.Int) {
+		superseded <- [2]*big.Int{old, new}
+	}
+	payload.update(short, shortFees) // the first full block
+	payload.update(short, shortFees) // not better
+	payload.update(long, longFees)   // supersedes the short one
+	payload.update(short, shortFees) // not better
+
+	select {
+	case fees := <-superseded:
+		if fees[0].Cmp(shortFees) != 0 || fees[1].Cmp(longFees) != 0 {
+			t.Fatalf("Unexpected fees, have %v -> %v, want %v -> %v", fees[0], fees[1], shortFees, longFees)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Supersession not reported")
+	}
+	select {
+	case fees := <-superseded:
+		t.Fatalf("Unexpected supersession %v -> %v", fees[0], fees[1])
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBuildPayloadDisabledPrecompiles(t *testing.T) {
+	var (
+		sha256Addr = common.BytesToAddress([]byte{0x2})
+		callerAddr = common.HexToAddress("0x100")
+
+		// Call the sha256 precompile and revert if nothing is returned
+		callerCode = []byte{
+			byte(vm.PUSH1), 0x20, byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x00,
+			byte(vm.PUSH1), 0x02, byte(vm.GAS), byte(vm.STATICCALL), byte(vm.POP),
+			byte(vm.RETURNDATASIZE), byte(vm.PUSH1), 0x16, byte(vm.JUMPI),
+			byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x00, byte(vm.REVERT),
+			byte(vm.JUMPDEST), byte(vm.STOP),
+		}
+		callTx = types.MustSignNewTx(testUserKey, types.LatestSigner(params.TestChainConfig), &types.LegacyTx{
+			To:       &callerAddr,
+			Gas:      100000,
+			GasPrice: big.NewInt(params.InitialBaseFee),
+		})
+	)
+	config := *testConfig
+	config.AllowStateOverrides = true
+	config.PrivateTxs = testPrivateTxs{testUserAddress: types.Transactions{callTx}}
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		StateOverrides: StateOverride{
+			callerAddr:      {Code: callerCode},
+			testUserAddress: {Balance: big.NewInt(params.Ether)},
+		},
+	}
+	status := func(args *BuildPayloadArgs) uint64 {
+		genParams := w.sealingParams(args, false)
+		genParams.report = new(fillReport)
+		block, _, err := w.getSealingBlock(genParams)
+		if err != nil {
+			t.Fatalf("Failed to generate full block %v", err)
+		}
+		for i, tx := range block.Transactions() {
+			if tx.Hash() == callTx.Hash() {
+				return genParams.report.receipts[i].Status
+			}
+		}
+		t.Fatal("Precompile caller not included")
+		return 0
+	}
+	if s := status(args); s != types.ReceiptStatusSuccessful {
+		t.Fatalf("Unexpected status with precompile enabled, have %d", s)
+	}
+	args.DisabledPrecompiles = []common.Address{sha256Addr}
+	if s := status(args); s != types.ReceiptStatusFailed {
+		t.Fatalf("Unexpected status with precompile disabled, have %d", s)
+	}
+	// Disabling the precompiles must be allowed explicitly
+	if _, err := w.buildPayload(args); !errors.Is(err, errPrecompileOffDisabled) {
+		t.Fatalf("Unexpected error, have %v, want %v", err, errPrecompileOffDisabled)
+	}
+}
+
+func TestPayloadUniqueSenders(t *testing.T) {
+	config := *testConfig
+	config.AllowStateOverrides = true
+	config.PrivateTxs = testPrivateTxs{testUserAddress: types.Transactions{
+		types.MustSignNewTx(testUserKey, types.LatestSigner(params.TestChainConfig), &types.LegacyTx{
+			To:       &testBankAddress,
+			Gas:      params.TxGas,
+			GasPrice: big.NewInt(params.InitialBaseFee),
+		}),
+	}}
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// Fund the test user for sending the private transaction
+	args := &BuildPayloadArgs{
+		Parent:         b.chain.CurrentBlock().Hash(),
+		Timestamp:      uint64(time.Now().Unix()),
+		FeeRecipient:   common.HexToAddress("0xdeadbeef"),
+		StateOverrides: StateOverride{testUserAddress: {Balance: big.NewInt(params.Ether)}},
+	}
+	empty, _, err := w.getSealingBlock(w.sealingParams(args, true))
+	if err != nil {
+		t.Fatalf("Failed to generate empty block %v", err)
+	}
+	full, fees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate full block %v", err)
+	}
+	if len(full.Transactions()) != len(pendingTxs)+1 {
+		t.Fatalf("Unexpected transaction set, have %d, want %d", len(full.Transactions()), len(pendingTxs)+1)
+	}
+	b.txPool.AddLocals(newTxs)
+	more, moreFees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate full block %v", err)
+	}
+	payload := newPayload(empty)
+	if n := payload.UniqueSenders(); n != 0 {
+		t.Fatalf("Unexpected senders of empty block, have %d, want 0", n)
+	}
+	// The senders are counted once no matter how many transactions they sent
+	payload.update(full, fees)
+	if n := payload.UniqueSenders(); n != 2 {
+		t.Fatalf("Unexpected senders, have %d, want 2", n)
+	}
+	payload.update(more, moreFees)
+	if n := payload.UniqueSenders(); n != 2 || len(more.Transactions()) != len(full.Transactions())+len(newTxs) {
+		t.Fatalf("Unexpected senders, have %d, want 2", n)
+	}
+}
+
+func TestPayloadReplacements(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}
+	empty, _, err := w.getSealingBlock(w.sealingParams(args, true))
+	if err != nil {
+		t.Fatalf("Failed to generate empty block %v", err)
+	}
+	full, fees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate full block %v", err)
+	}
+	payload := newPayload(empty)
+	payload.update(full, fees)
+
+	// Bump the fee of the pending transaction between the iterations
+	replacement := types.MustSignNewTx(testBankKey, types.LatestSigner(params.TestChainConfig), &types.AccessListTx{
+		ChainID:  params.TestChainConfig.ChainID,
+		Nonce:    0,
+		To:       &testUserAddress,
+		Value:    big.NewInt(1000),
+		Gas:      params.TxGas,
+		GasPrice: big.NewInt(2 * params.InitialBaseFee),
+	})
+	if err := b.txPool.AddLocal(replacement); err != nil {
+		t.Fatalf("Failed to replace transaction %v", err)
+	}
+	bumped, bumpedFees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate full block %v", err)
+	}
+	payload.update(bumped, bumpedFees)
+
+	block := payload.ResolveFull()
+	if len(block.Transactions) != 1 {
+		t.Fatalf("Unexpected transaction set, have %d, want 1", len(block.Transactions))
+	}
+	var tx types.Transaction
+	if err := tx.UnmarshalBinary(block.Transactions[0]); err != nil {
+		t.Fatalf("Failed to decode transaction %v", err)
+	}
+	if tx.Hash() != replacement.Hash() {
+		t.Fatalf("Unexpected transaction, have %x, want %x", tx.Hash(), replacement.Hash())
+	}
+	if n := payload.Replacements(); n != 1 {
+		t.Fatalf("Unexpected replacements, have %d, want 1", n)
+	}
+}
+
+func TestBuildPayloadStateRetry(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// Fail the state retrieval of the first two full-block attempts, the first
+	// call is made for the empty block
+	var calls int32
+	w.stateHook = func() error {
+		if n := atomic.AddInt32(&calls, 1); n == 2 || n == 3 {
+			return errors.New("state flushing")
+		}
+		return nil
+	}
+	// Space the regular re-builds beyond the test, only the retries can deliver
+	// the full block.
+	w.recommit = time.Hour
+
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	defer payload.stopBuilding()
+
+	start := time.Now()
+	full := payload.ResolveFull()
+	if full == nil || len(full.Transactions) != len(pendingTxs) {
+		t.Fatal("Full block is not recovered by the retries")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Full block is recovered too late, elapsed %v", elapsed)
+	}
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Fatalf("Unexpected state retrievals, have %d, want 4", n)
+	}
+}
+
+// watchIterations subscribes to the outcomes of the payload building iterations
+// of the given worker. The outcomes are dropped if the channel is full.
+func watchIterations(w *worker) <-chan iterationResult {
+	ch := make(chan iterationResult, 64)
+	w.iterHook = func(result iterationResult) {
+		select {
+		case ch <- result:
+		default:
+		}
+	}
+	return ch
+}
+
+func TestBuildPayloadIterations(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	w.recommit = 50 * time.Millisecond
+	iterations := watchIterations(w)
+
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	defer payload.stopBuilding()
+
+	next := func() iterationResult {
+		select {
+		case result := <-iterations:
+			if result.err != nil {
+				t.Fatalf("Payload building iteration failed %v", result.err)
+			}
+			return result
+		case <-time.After(5 * time.Second):
+			t.Fatal("Payload building iteration is not finished")
+		}
+		return iterationResult{}
+	}
+	first := next()
+	if first.txs != len(pendingTxs) || first.fees.Sign() <= 0 {
+		t.Fatalf("Unexpected first iteration, txs %d, fees %v", first.txs, first.fees)
+	}
+	// The new transactions are picked up by one of the subsequent iterations
+	b.txPool.AddLocals(newTxs)
+	for {
+		if result := next(); result.txs == len(pendingTxs)+len(newTxs) {
+			if result.fees.Cmp(first.fees) <= 0 {
+				t.Fatalf("Fees are not improved, have %v, previous %v", result.fees, first.fees)
+			}
+			break
+		}
+	}
+}
+
+func TestBuildPayloadEmptyFull(t *testing.T) {
+	build := func(store bool) *Payload {
+		config := *testConfig
+		config.StoreEmptyFull = store
+
+		w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+		defer w.close()
+
+		// All the pending transactions are sent to the test user, so that the
+		// full blocks are built without any transaction
+		w.excluded = map[common.Address]struct{}{testUserAddress: {}}
+		w.recommit = 50 * time.Millisecond
+		iterations := watchIterations(w)
+
+		payload, err := w.buildPayload(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()),
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		})
+		if err != nil {
+			t.Fatalf("Failed to build payload %v", err)
+		}
+		defer payload.stopBuilding()
+
+		for i := 0; i < 3; i++ {
+			select {
+			case result := <-iterations:
+				if result.err != nil || result.txs != 0 {
+					t.Fatalf("Unexpected iteration, txs %d, err %v", result.txs, result.err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Payload building iteration is not finished")
+			}
+		}
+		return payload
+	}
+	// The transaction-less full blocks are skipped by default
+	payload := build(false)
+	payload.lock.Lock()
+	if payload.full != nil {
+		t.Fatalf("Transaction-less full blocks are stored")
+	}
+	payload.lock.Unlock()
+	if data := payload.Resolve(); data.BlockHash != payload.empty.Hash() {
+		t.Fatalf("Unexpected payload, have %x, want empty block %x", data.BlockHash, payload.empty.Hash())
+	}
+	// They're stored if it's configured
+	payload = build(true)
+	payload.lock.Lock()
+	if payload.full == nil || payload.rebuilds < 3 {
+		t.Fatalf("Transaction-less full blocks are not stored, rebuilds %d", payload.rebuilds)
+	}
+	payload.lock.Unlock()
+}
+
+func TestPayloadAllocStats(t *testing.T) {
+	build := func(profile bool) AllocStats {
+		config := *testConfig
+		config.ProfileAllocs = profile
+
+		w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+		defer w.close()
+		iterations := watchIterations(w)
+
+		payload, err := w.buildPayload(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()),
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		})
+		if err != nil {
+			t.Fatalf("Failed to build payload %v", err)
+		}
+		defer payload.stopBuilding()
+
+		select {
+		case <-iterations:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Payload building iteration is not finished")
+		}
+		return payload.AllocStats()
+	}
+	if stats := build(false); stats != (AllocStats{}) {
+		t.Fatalf("Allocations sampled without profiling %+v", stats)
+	}
+	if stats := build(true); stats.Iterations == 0 || stats.Mallocs == 0 || stats.Bytes == 0 {
+		t.Fatalf("Allocations are not sampled %+v", stats)
+	}
+}
+
+func TestPayloadReceipts(t *testing.T) {
+	build := func(retain bool) (*beacon.ExecutableDataV1, types.Receipts) {
+		config := *testConfig
+		config.RetainReceipts = retain
+
+		w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+		defer w.close()
+
+		payload, err := w.buildPayload(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()),
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		})
+		if err != nil {
+			t.Fatalf("Failed to build payload %v", err)
+		}
+		defer payload.stopBuilding()
+
+		return payload.ResolveFull(), payload.Receipts()
+	}
+	if _, receipts := build(false); receipts != nil {
+		t.Fatalf("Receipts retained without being enabled, have %d", len(receipts))
+	}
+	full, receipts := build(true)
+	if len(receipts) != len(full.Transactions) {
+		t.Fatalf("Unexpected receipts, have %d, want %d", len(receipts), len(full.Transactions))
+	}
+	for i, receipt := range receipts {
+		var tx types.Transaction
+		if err := tx.UnmarshalBinary(full.Transactions[i]); err != nil {
+			t.Fatalf("Failed to decode transaction %v", err)
+		}
+		if receipt.TxHash != tx.Hash() || receipt.BlockHash != full.BlockHash || receipt.TransactionIndex != uint(i) {
+			t.Fatalf("Receipt %d mismatch, tx %v, block %v, index %d", i, receipt.TxHash, receipt.BlockHash, receipt.TransactionIndex)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			t.Fatalf("Receipt %d reports failure", i)
+		}
+	}
+}
+
+func TestPayloadRecomputeFees(t *testing.T) {
+	for _, retain := range []bool{false, true} {
+		config := *testConfig
+		config.RetainReceipts = retain
+
+		w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+		payload, err := w.buildPayload(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()),
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		})
+		if err != nil {
+			t.Fatalf("Failed to build payload %v", err)
+		}
+		payload.ResolveFull()
+		payload.stopBuilding()
+		w.close()
+
+		payload.lock.Lock()
+		stored, gas := new(big.Int).Set(payload.fullFees), payload.full.GasUsed()
+		payload.lock.Unlock()
+
+		// The receipts are required for the recomputation
+		if !retain {
+			if fees := payload.RecomputeFees(nil); fees != nil {
+				t.Fatalf("Fees recomputed without receipts, have %v", fees)
+			}
+			continue
+		}
+		if fees := payload.RecomputeFees(nil); fees == nil || fees.Cmp(stored) != 0 {
+			t.Fatalf("Unexpected recomputed fees, have %v, want %v", fees, stored)
+		}
+		want := new(big.Int).SetUint64(gas * 7)
+		if fees := payload.RecomputeFees(testFeeCalculator{rate: 7}); fees == nil || fees.Cmp(want) != 0 {
+			t.Fatalf("Unexpected custom fees, have %v, want %v", fees, want)
+		}
+	}
+}
+
+func TestPayloadTxFeeBreakdown(t *testing.T) {
+	// Send a private transaction paying a higher tip than the pending one
+	signer := types.LatestSigner(params.TestChainConfig)
+	rich := types.MustSignNewTx(testUserKey, signer, &types.LegacyTx{
+		To:       &testBankAddress,
+		Gas:      params.TxGas,
+		GasPrice: big.NewInt(2 * params.InitialBaseFee),
+	})
+	config := *testConfig
+	config.PrivateTxs = testPrivateTxs{testUserAddress: types.Transactions{rich}}
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}
+	empty, _, err := w.getSealingBlock(w.sealingParams(args, true))
+	if err != nil {
+		t.Fatalf("Failed to generate empty block %v", err)
+	}
+	genParams := w.sealingParams(args, false)
+	genParams.report = new(fillReport)
+	genParams.overrides = StateOverride{testUserAddress: {Balance: big.NewInt(params.Ether)}}
+	full, fees, err := w.getSealingBlock(genParams)
+	if err != nil {
+		t.Fatalf("Failed to generate full block %v", err)
+	}
+	payload := newPayload(empty)
+	payload.retain = true
+	if breakdown := payload.TxFeeBreakdown(); breakdown != nil {
+		t.Fatalf("Unexpected breakdown of empty block, have %d", len(breakdown))
+	}
+	payload.updateFull(full, fees, genParams.report)
+
+	breakdown := payload.TxFeeBreakdown()
+	if len(breakdown) != 2 {
+		t.Fatalf("Unexpected breakdown, have %d, want 2", len(breakdown))
+	}
+	if breakdown[0].Hash != rich.Hash() || breakdown[1].Hash != pendingTxs[0].Hash() {
+		t.Fatalf("Unexpected breakdown order, have %x, %x", breakdown[0].Hash, breakdown[1].Hash)
+	}
+	sum := new(big.Int).Add(breakdown[0].Fee, breakdown[1].Fee)
+	if breakdown[0].Fee.Cmp(breakdown[1].Fee) <= 0 || sum.Cmp(fees) != 0 {
+		t.Fatalf("Unexpected fees, have %v + %v, want %v", breakdown[0].Fee, breakdown[1].Fee, fees)
+	}
+	// Nothing is reported if the receipts are not retained
+	payload = newPayload(empty)
+	payload.updateFull(full, fees, genParams.report)
+	if breakdown := payload.TxFeeBreakdown(); breakdown != nil {
+		t.Fatalf("Unexpected breakdown without receipts, have %d", len(breakdown))
+	}
+}
+
+func TestPayloadForceEmpty(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	if full := payload.ResolveFull(); full == nil || len(full.Transactions) == 0 {
+		t.Fatal("Full block is not built")
+	}
+	empty := payload.ResolveEmpty()
+	payload.ForceEmpty()
+
+	// The empty block is resolved regardless of the full one, and the updates
+	// are rejected afterwards
+	for i := 0; i < 2; i++ {
+		snapshot := payload.ResolveSnapshot()
+		if snapshot.Data.BlockHash != empty.BlockHash || snapshot.Full || snapshot.Value.Sign() != 0 {
+			t.Fatalf("Unexpected resolved block, have %x (full %v), want %x", snapshot.Data.BlockHash, snapshot.Full, empty.BlockHash)
+		}
+		block, fees, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()),
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		}, false))
+		if err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		payload.update(block, fees)
+	}
+	if report := payload.Report(); report.Full {
+		t.Fatal("Forced payload is reported as full")
+	}
+}
+
+func TestBuildPayloadArgsValidate(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	var (
+		parent  = b.chain.CurrentBlock().Header()
+		foreign = types.MustSignNewTx(testBankKey, types.LatestSignerForChainID(big.NewInt(99)), &types.DynamicFeeTx{
+			ChainID:   big.NewInt(99),
+			To:        &testUserAddress,
+			Gas:       params.TxGas,
+			GasFeeCap: big.NewInt(params.InitialBaseFee),
+		})
+	)
+	valid := func() *BuildPayloadArgs {
+		return &BuildPayloadArgs{
+			Parent:       parent.Hash(),
+			Timestamp:    parent.Time + 1,
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		}
+	}
+	var tests = []struct {
+		name   string
+		mutate func(args *BuildPayloadArgs)
+		parent *types.Header
+		valid  bool
+	}{
+		{"valid", func(args *BuildPayloadArgs) {}, parent, true},
+		{"valid extras", func(args *BuildPayloadArgs) {
+			args.SeedTx, args.AppendTxs, args.ReserveGas = pendingTxs[0], newTxs, params.TxGas
+		}, parent, true},
+		{"missing parent", func(args *BuildPayloadArgs) {}, nil, false},
+		{"parent mismatch", func(args *BuildPayloadArgs) { args.Parent = common.Hash{0x01} }, parent, false},
+		{"timestamp equal to parent", func(args *BuildPayloadArgs) { args.Timestamp = parent.Time }, parent, false},
+		{"reserve over gas limit", func(args *BuildPayloadArgs) { args.ReserveGas = 2 * parent.GasLimit }, parent, false},
+		{"negative gas price floor", func(args *BuildPayloadArgs) { args.MinGasPrice = big.NewInt(-1) }, parent, false},
+		{"negative relay gas price floor", func(args *BuildPayloadArgs) { args.RelayMinGasPrice = big.NewInt(-1) }, parent, false},
+		{"foreign seed transaction", func(args *BuildPayloadArgs) { args.SeedTx = foreign }, parent, false},
+		{"foreign appended transaction", func(args *BuildPayloadArgs) { args.AppendTxs = []*types.Transaction{foreign} }, parent, false},
+		{"seed transaction appended", func(args *BuildPayloadArgs) {
+			args.SeedTx, args.AppendTxs = pendingTxs[0], pendingTxs
+		}, parent, false},
+		{"duplicate appended transactions", func(args *BuildPayloadArgs) {
+			args.AppendTxs = []*types.Transaction{newTxs[0], newTxs[0]}
+		}, parent, false},
+		{"conflicting state overrides", func(args *BuildPayloadArgs) {
+			args.StateOverrides = StateOverride{testUserAddress: {
+				State:     map[common.Hash]common.Hash{{0x01}: {0x01}},
+				StateDiff: map[common.Hash]common.Hash{{0x02}: {0x02}},
+			}}
+		}, parent, false},
+	}
+	for _, test := range tests {
+		args := valid()
+		test.mutate(args)
+		if err := args.Validate(params.TestChainConfig, test.parent); (err == nil) != test.valid {
+			t.Errorf("%s: unexpected validation result, err %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+	// The invalid arguments are rejected before building
+	args := valid()
+	args.Timestamp = parent.Time
+	if _, err := w.buildPayload(args); err == nil {
+		t.Fatal("Invalid payload arguments are accepted")
+	}
+}
+
+func TestPayloadPinCurrent(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}
+	empty, _, err := w.getSealingBlock(w.sealingParams(args, true))
+	if err != nil {
+		t.Fatalf("Failed to generate empty block %v", err)
+	}
+	short, shortFees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate short block %v", err)
+	}
+	b.txPool.AddLocals(newTxs)
+	long, longFees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate long block %v", err)
+	}
+	payload := newPayload(empty)
+	payload.update(short, shortFees)
+
+	// The better block is forgone while pinned, but it's still counted
+	payload.PinCurrent()
+	payload.update(long, longFees)
+	if snapshot := payload.ResolveSnapshot(); snapshot.Data.BlockHash != short.Hash() {
+		t.Fatalf("Pinned block is replaced, have %x, want %x", snapshot.Data.BlockHash, short.Hash())
+	}
+	if report := payload.Report(); report.Rebuilds != 2 || report.PeakGasUsed != long.GasUsed() {
+		t.Fatalf("Forgone block is not counted, rebuilds %d, peak gas %d", report.Rebuilds, report.PeakGasUsed)
+	}
+	// The better blocks replace the served one again once unpinned
+	payload = newPayload(empty)
+	payload.update(short, shortFees)
+	payload.PinCurrent()
+	payload.update(long, longFees)
+	payload.Unpin()
+	payload.update(long, longFees)
+	if snapshot := payload.ResolveSnapshot(); snapshot.Data.BlockHash != long.Hash() {
+		t.Fatalf("Unpinned block is not replaced, have %x, want %x", snapshot.Data.BlockHash, long.Hash())
+	}
+}
+
+func TestPayloadCommitBid(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}
+	empty, _, err := w.getSealingBlock(w.sealingParams(args, true))
+	if err != nil {
+		t.Fatalf("Failed to generate empty block %v", err)
+	}
+	short, shortFees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate short block %v", err)
+	}
+	b.txPool.AddLocals(newTxs)
+	long, longFees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate long block %v", err)
+	}
+	payload := newPayload(empty)
+	payload.update(short, shortFees)
+
+	block, fees := payload.CommitBid()
+	if block.Hash() != short.Hash() || fees.Cmp(shortFees) != 0 {
+		t.Fatalf("Unexpected committed block %x, fees %v", block.Hash(), fees)
+	}
+	// The committed block is served for good, even if unpinned
+	payload.update(long, longFees)
+	payload.Unpin()
+	payload.update(long, longFees)
+	for i := 0; i < 3; i++ {
+		if snapshot := payload.ResolveSnapshot(); snapshot.Data.BlockHash != short.Hash() {
+			t.Fatalf("Committed block is replaced, have %x, want %x", snapshot.Data.BlockHash, short.Hash())
+		}
+	}
+}
+
+// blockDiff is the difference of a built block against a reference block.
+type blockDiff struct {
+	feeDelta *big.Int      // The fees of the built block minus the reference's
+	gasDelta int64         // The gas used by the built block minus the reference's
+	added    []common.Hash // The transactions only in the built block, in block order
+	missing  []common.Hash // The transactions only in the reference block, in block order
+}
+
+// buildAndCompare builds a full block with the given arguments and diffs it
+// against the reference block built on the same parent. The reference fees are
+// measured by replaying its transactions, so they must not revert. The diff is
+// deterministic if the arguments carry a pending snapshot.
+func (w *worker) buildAndCompare(args *BuildPayloadArgs, reference *types.Block) (*blockDiff, error) {
+	block, fees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		return nil, err
+	}
+	replay := *args
+	replay.Pending, replay.AppendTxs = new(PendingSnapshot), reference.Transactions()
+	_, refFees, err := w.getSealingBlock(w.sealingParams(&replay, false))
+	if err != nil {
+		return nil, err
+	}
+	diff := &blockDiff{
+		feeDelta: new(big.Int).Sub(fees, refFees),
+		gasDelta: int64(block.GasUsed()) - int64(reference.GasUsed()),
+	}
+	diffTxs := func(a, b types.Transactions) []common.Hash {
+		known := make(map[common.Hash]struct{})
+		for _, tx := range b {
+			known[tx.Hash()] = struct{}{}
+		}
+		var hashes []common.Hash
+		for _, tx := range a {
+			if _, ok := known[tx.Hash()]; !ok {
+				hashes = append(hashes, tx.Hash())
+			}
+		}
+		return hashes
+	}
+	diff.added = diffTxs(block.Transactions(), reference.Transactions())
+	diff.missing = diffTxs(reference.Transactions(), block.Transactions())
+	return diff, nil
+}
+
+func TestBuildAndCompare(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		Pending:      w.snapshotPending(),
+	}
+	reference, _, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate reference block %v", err)
+	}
+	// The build from the same snapshot is identical to the reference, no matter
+	// the txpool changes
+	b.txPool.AddLocals(newTxs)
+	diff, err := w.buildAndCompare(args, reference)
+	if err != nil {
+		t.Fatalf("Failed to compare block %v", err)
+	}
+	if diff.feeDelta.Sign() != 0 || diff.gasDelta != 0 || len(diff.added) != 0 || len(diff.missing) != 0 {
+		t.Fatalf("Unexpected diff of identical build: %+v", diff)
+	}
+	// The build with more transactions is more valuable than the reference
+	args.Pending = w.snapshotPending()
+	diff, err = w.buildAndCompare(args, reference)
+	if err != nil {
+		t.Fatalf("Failed to compare block %v", err)
+	}
+	if diff.feeDelta.Sign() <= 0 || diff.gasDelta != int64(params.TxGas) || len(diff.missing) != 0 {
+		t.Fatalf("Unexpected diff of improved build: %+v", diff)
+	}
+	if len(diff.added) != 1 || diff.added[0] != newTxs[0].Hash() {
+		t.Fatalf("Unexpected added transactions, have %v, want %v", diff.added, newTxs[0].Hash())
+	}
+}
+
+func TestBuildPayloadMaxTxsPerSender(t *testing.T) {
+	config := *testConfig
+	config.MaxTxsPerSender = 2
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// Let the test bank submit a bunch of well paying transactions
+	b.txPool.AddLocals(newTxs)
+	for i := 0; i < 5; i++ {
+		if err := b.txPool.AddLocal(b.newRandomTx(false)); err != nil {
+			t.Fatalf("Failed to add transaction %v", err)
+		}
+	}
+	if pending, _ := b.txPool.Stats(); pending != 7 {
+		t.Fatalf("Unexpected pending transactions, have %d, want 7", pending)
+	}
+	block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if len(block.Transactions()) != config.MaxTxsPerSender {
+		t.Fatalf("Unexpected transaction set, have %d, want %d", len(block.Transactions()), config.MaxTxsPerSender)
+	}
+	for i, tx := range block.Transactions() {
+		if tx.Nonce() != uint64(i) {
+			t.Fatalf("Transaction %d nonce mismatch, have %d, want %d", i, tx.Nonce(), i)
+		}
+	}
+}
+
+func TestBuildPayloadOnGenesis(t *testing.T) {
+	// Activate London right after the genesis, which has no base fee then
+	londonAfter := *params.TestChainConfig
+	londonAfter.LondonBlock = big.NewInt(1)
+	londonAfter.ArrowGlacierBlock = big.NewInt(1)
+	londonAfter.GrayGlacierBlock = big.NewInt(1)
+	londonAfter.MergeNetsplitBlock = nil
+
+	for _, config := range []*params.ChainConfig{params.TestChainConfig, &londonAfter} {
+		w, b := newTestWorker(t, config, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+
+		genesis := b.chain.CurrentBlock()
+		if genesis.NumberU64() != 0 {
+			t.Fatalf("Unexpected parent, have %d, want genesis", genesis.NumberU64())
+		}
+		payload, err := w.buildPayload(&BuildPayloadArgs{
+			Parent:       genesis.Hash(),
+			Timestamp:    genesis.Time() + 1,
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		})
+		if err != nil {
+			t.Fatalf("Failed to build payload on genesis %v", err)
+		}
+		full := payload.ResolveFull()
+		payload.stopBuilding()
+
+		wantBaseFee, wantGasLimit := misc.CalcBaseFee(config, genesis.Header()), core.CalcGasLimit(genesis.GasLimit(), w.config.GasCeil)
+		if genesis.BaseFee() == nil {
+			// The initial base fee applies and the gas limit is elasticized
+			wantBaseFee, wantGasLimit = big.NewInt(params.InitialBaseFee), core.CalcGasLimit(genesis.GasLimit()*params.ElasticityMultiplier, w.config.GasCeil)
+		}
+		if full.Number != 1 || full.BaseFeePerGas.Cmp(wantBaseFee) != 0 || full.GasLimit != wantGasLimit {
+			t.Fatalf("Unexpected first block, number %d, base fee %v (want %v), gas limit %d (want %d)", full.Number, full.BaseFeePerGas, wantBaseFee, full.GasLimit, wantGasLimit)
+		}
+		if len(full.Transactions) != len(pendingTxs) {
+			t.Fatalf("Unexpected transaction set, have %d, want %d", len(full.Transactions), len(pendingTxs))
+		}
+		w.close()
+	}
+}
+
+func TestBuildPayloadTimestampSkew(t *testing.T) {
+	now := time.Unix(1000, 0)
+	if skew := timestampSkew(1030, now); skew != 30*time.Second {
+		t.Fatalf("Unexpected skew ahead, have %v, want %v", skew, 30*time.Second)
+	}
+	if skew := timestampSkew(970, now); skew != -30*time.Second {
+		t.Fatalf("Unexpected skew behind, have %v, want %v", skew, -30*time.Second)
+	}
+	// The skewed timestamp is only warned about, never rejected
+	config := *testConfig
+	config.TimestampSkew = time.Second
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Add(time.Hour).Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if err != nil {
+		t.Fatalf("Skewed payload is rejected %v", err)
+	}
+	payload.Resolve()
+}
+
+func TestBuildPayloadFutureTimestamp(t *testing.T) {
+	config := *testConfig
+	config.MaxFutureTimestamp = time.Minute
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// The timestamps within the tolerance are accepted
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Add(12 * time.Second).Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	payload.Resolve()
+
+	// The far-future ones are rejected
+	_, err = w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Add(time.Hour).Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if !errors.Is(err, errFutureTimestamp) {
+		t.Fatalf("Unexpected error, have %v, want %v", err, errFutureTimestamp)
+	}
+}
+
+func TestBuildPayloadPrefetch(t *testing.T) {
+	var (
+		timestamp = uint64(time.Now().Unix())
+		roots     []common.Hash
+		counts    []int
+	)
+	for _, prefetch := range []bool{false, true} {
+		config := *testConfig
+		config.Prefetch = prefetch
+
+		w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+		b.txPool.AddRemotesSync(newTxs) // both builds must see the same transactions
+
+		block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    timestamp,
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		}, false))
+		if err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		roots, counts = append(roots, block.Root()), append(counts, len(block.Transactions()))
+		w.close()
+	}
+	// The prefetching must not affect the execution in any way
+	if roots[0] != roots[1] {
+		t.Fatalf("Prefetching changed the state root, have %x, want %x", roots[1], roots[0])
+	}
+	if counts[0] != counts[1] || counts[0] == 0 {
+		t.Fatalf("Unexpected transaction count, have %d, want %d", counts[1], counts[0])
+	}
+}
+
+func TestBuildPayloadOmmers(t *testing.T) {
+	w, b := newTestWorkerWithConfig(t, testConfig, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 1)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		Ommers:       []*types.Header{b.uncleBlock.Header()},
+	}
+	// The uncle is included and its inclusion reward counts into the value
+	block, fees, err := w.getSealingBlock(w.sealingParams(args, true))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if uncles := block.Uncles(); len(uncles) != 1 || uncles[0].Hash() != b.uncleBlock.Hash() {
+		t.Fatalf("Unexpected uncles %v", uncles)
+	}
+	if want := new(big.Int).Div(ethash.ConstantinopleBlockReward, big.NewInt(32)); fees.Cmp(want) != 0 {
+		t.Fatalf("Unexpected block value, have %v, want %v", fees, want)
+	}
+	payload, err := w.buildPayload(args)
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	payload.Resolve()
+	if uncles := payload.empty.Uncles(); len(uncles) != 1 {
+		t.Fatalf("Unexpected empty block uncles %v", uncles)
+	}
+	// The uncles which can't be included fail the building
+	invalid := *args
+	invalid.Ommers = []*types.Header{b.chain.CurrentBlock().Header()}
+	if _, _, err := w.getSealingBlock(w.sealingParams(&invalid, true)); err == nil {
+		t.Fatal("Invalid uncle is accepted")
+	}
+	// The post-merge payloads reject the ommers upfront
+	config := *params.TestChainConfig
+	config.TerminalTotalDifficulty = common.Big0
+
+	merged, mb := newTestWorkerWithConfig(t, testConfig, &config, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 1)
+	defer merged.close()
+
+	_, err = merged.buildPayload(&BuildPayloadArgs{
+		Parent:       mb.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		Ommers:       []*types.Header{mb.uncleBlock.Header()},
+	})
+	if !errors.Is(err, errOmmersPostMerge) {
+		t.Fatalf("Unexpected error, have %v, want %v", err, errOmmersPostMerge)
+	}
+}
+
+func TestPayloadBidValue(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// Pay the recipient directly on top of the tip, like a searcher does
+	var (
+		recipient = common.HexToAddress("0xdeadbeef")
+		signer    = types.LatestSigner(params.TestChainConfig)
+		payment   = big.NewInt(params.Ether / 10)
+	)
+	tx := types.MustSignNewTx(testBankKey, signer, &types.LegacyTx{
+		Nonce:    b.txPool.Nonce(testBankAddress),
+		To:       &recipient,
+		Value:    payment,
+		Gas:      params.TxGas,
+		GasPrice: big.NewInt(2 * params.InitialBaseFee),
+	})
+	if err := b.txPool.AddLocal(tx); err != nil {
+		t.Fatalf("Failed to add transaction %v", err)
+	}
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: recipient,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	payload.ResolveFull()
+
+	payload.lock.Lock()
+	if payload.full.Transaction(tx.Hash()) == nil {
+		t.Fatalf("Payment transaction is not included")
+	}
+	fees := new(big.Int).Set(payload.fullFees)
+	payload.lock.Unlock()
+
+	if fees.Sign() <= 0 {
+		t.Fatalf("Missing transaction tips")
+	}
+	// The pre-merge block reward is credited to the recipient too
+	want := new(big.Int).Add(fees, payment)
+	want.Add(want, ethash.ConstantinopleBlockReward)
+	if payload.BidValue().Cmp(want) != 0 {
+		t.Fatalf("Unexpected bid value, have %v, want %v", payload.BidValue(), want)
+	}
+}
+
+func TestBuildPayloadBundles(t *testing.T) {
+	config := *testConfig
+	config.AllowStateOverrides = true
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	var (
+		reverter = common.HexToAddress("0xbad")
+		signer   = types.LatestSigner(params.TestChainConfig)
+	)
+	statedb, err := b.chain.State()
+	if err != nil {
+		t.Fatalf("Failed to retrieve state %v", err)
+	}
+	nonce := statedb.GetNonce(testBankAddress)
+
+	newTx := func(nonce uint64, to common.Address) *types.Transaction {
+		return types.MustSignNewTx(testBankKey, signer, &types.LegacyTx{
+			Nonce:    nonce,
+			To:       &to,
+			Gas:      50000,
+			GasPrice: big.NewInt(2 * params.InitialBaseFee),
+		})
+	}
+	build := func(bundles ...*Bundle) *types.Block {
+		block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+			Parent:         b.chain.CurrentBlock().Hash(),
+			Timestamp:      uint64(time.Now().Unix()),
+			FeeRecipient:   common.HexToAddress("0xdeadbeef"),
+			Pending:        &PendingSnapshot{},
+			StateOverrides: StateOverride{reverter: AccountOverride{Code: common.FromHex("0x60006000fd")}}, // revert(0, 0)
+			Bundles:        bundles,
+		}, false))
+		if err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		return block
+	}
+	// The bundle is kept if only the optional transaction reverts
+	transfer, revert := newTx(nonce, testUserAddress), newTx(nonce+1, reverter)
+	block := build(&Bundle{Txs: []*types.Transaction{transfer, revert}, MayRevert: []common.Hash{revert.Hash()}})
+	if len(block.Transactions()) != 2 {
+		t.Fatalf("Unexpected transaction count, have %d, want %d", len(block.Transactions()), 2)
+	}
+	// The bundle is dropped as a whole if a mandatory transaction reverts, the
+	// following bundles are still included
+	fallback := newTx(nonce, common.HexToAddress("0xfa11"))
+	block = build(
+		&Bundle{Txs: []*types.Transaction{transfer, revert}},
+		&Bundle{Txs: []*types.Transaction{fallback}},
+	)
+	if len(block.Transactions()) != 1 || block.Transactions()[0].Hash() != fallback.Hash() {
+		t.Fatalf("Unexpected transactions %v", block.Transactions())
+	}
+}
+
+func TestPayloadMempoolView(t *testing.T) {
+	for _, diagnostics := range []bool{false, true} {
+		config := *testConfig
+		config.PayloadDiagnostics = diagnostics
+
+		w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+		defer w.close()
+
+		// The random transactions pay ten times the tip of the preset ones
+		b.txPool.AddLocals(newTxs)
+		rich := b.newRandomTx(false)
+		if err := b.txPool.AddLocal(rich); err != nil {
+			t.Fatalf("Failed to add transaction %v", err)
+		}
+		payload, err := w.buildPayload(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()),
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		})
+		if err != nil {
+			t.Fatalf("Failed to build payload %v", err)
+		}
+		payload.ResolveFull()
+		payload.stopBuilding()
+
+		view := payload.MempoolView()
+		if !diagnostics {
+			if view != nil {
+				t.Fatalf("Mempool view collected without diagnostics: %+v", view)
+			}
+			continue
+		}
+		if view == nil || view.Senders != 1 || view.Txs != 3 || len(view.Top) != 3 {
+			t.Fatalf("Unexpected mempool view: %+v", view)
+		}
+		if view.Top[0] != rich.Hash() {
+			t.Fatalf("Unexpected top transaction, have %v, want %v", view.Top[0], rich.Hash())
+		}
+	}
+}
+
+func TestPayloadStarved(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// Fill the pending set with the transactions of unfunded senders
+	var (
+		signer  = types.LatestSigner(params.TestChainConfig)
+		pending = &PendingSnapshot{remotes: make(map[common.Address]types.Transactions)}
+	)
+	for i := 0; i < 4; i++ {
+		key, _ := crypto.GenerateKey()
+		pending.remotes[crypto.PubkeyToAddress(key.PublicKey)] = types.Transactions{
+			types.MustSignNewTx(key, signer, &types.LegacyTx{
+				To:       &testUserAddress,
+				Value:    big.NewInt(1000),
+				Gas:      params.TxGas,
+				GasPrice: big.NewInt(10 * params.InitialBaseFee),
+			}),
+		}
+	}
+	for i, test := range []struct {
+		pending *PendingSnapshot
+		starved bool
+	}{
+		{nil, false},
+		{pending, true},
+		{new(PendingSnapshot), false},
+	} {
+		payload, err := w.buildPayload(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()),
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+			Pending:      test.pending,
+		})
+		if err != nil {
+			t.Fatalf("Failed to build payload %v", err)
+		}
+		payload.ResolveFull()
+		payload.stopBuilding()
+
+		if starved := payload.Starved(); starved != test.starved {
+			t.Fatalf("Test %d: unexpected starvation, have %v, want %v", i, starved, test.starved)
+		}
+	}
+}
+
+func TestBuildPayloadExtra(t *testing.T) {
+	config := *testConfig
+	config.PayloadExtra = &PayloadExtra{Prefix: "builder", Version: 1, Strategy: "fees"}
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	for _, noTxs := range []bool{true, false} {
+		block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    uint64(time.Now().Unix()),
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		}, noTxs))
+		if err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		layout, err := DecodePayloadExtra(block.Extra())
+		if err != nil {
+			t.Fatalf("Failed to decode extra %v", err)
+		}
+		if *layout != *config.PayloadExtra {
+			t.Fatalf("Extra layout mismatch, have %+v, want %+v", layout, config.PayloadExtra)
+		}
+	}
+}
+
+func TestPayloadWorthProposing(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}
+	empty, _, err := w.getSealingBlock(w.sealingParams(args, true))
+	if err != nil {
+		t.Fatalf("Failed to generate empty block %v", err)
+	}
+	full, fees, err := w.getSealingBlock(w.sealingParams(args, false))
+	if err != nil {
+		t.Fatalf("Failed to generate full block %v", err)
+	}
+	var (
+		one     = big.NewInt(1)
+		below   = new(big.Int).Sub(fees, one)
+		above   = new(big.Int).Add(fees, one)
+		twoLess = new(big.Int).Sub(fees, big.NewInt(2))
+	)
+	var tests = []struct {
+		margin *big.Int
+		bid    *big.Int
+		want   bool
+	}{
+		{nil, nil, true},
+		{nil, below, true},
+		{nil, fees, true},
+		{nil, above, false},
+		{one, nil, true},
+		{one, twoLess, true},
+		{one, below, true},
+		{one, fees, false},
+		{big.NewInt(-1), above, true},
+		{big.NewInt(-1), new(big.Int).Add(above, one), false},
+	}
+	for i, test := range tests {
+		payload := newPayload(empty)
+		payload.margin = test.margin
+		payload.update(full, fees)
+		if have := payload.WorthProposing(test.bid); have != test.want {
+			t.Errorf("test %d: margin %v, bid %v: have %v, want %v", i, test.margin, test.bid, have, test.want)
+		}
+	}
+	// The empty block is only worth proposing over the worthless bids
+	payload := newPayload(empty)
+	if !payload.WorthProposing(new(big.Int)) || payload.WorthProposing(one) {
+		t.Fatal("Unexpected proposing decision of empty block")
+	}
+}
+
+type testPrivateTxs map[common.Address]types.Transactions
+
+func (s testPrivateTxs) Pending() map[common.Address]types.Transactions { return s }
+
+func TestBuildPayloadPrivateTxs(t *testing.T) {
+	config := *testConfig
+	config.PrivateTxs = testPrivateTxs{testBankAddress: newTxs}
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	block, _, err := w.getSealingBlock(w.sealingParams(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}, false))
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	want := append(append([]*types.Transaction{}, pendingTxs...), newTxs...)
+	if len(block.Transactions()) != len(want) {
+		t.Fatalf("Unexpected transaction set, have %d, want %d", len(block.Transactions()), len(want))
+	}
+	for i, tx := range block.Transactions() {
+		if tx.Hash() != want[i].Hash() {
+			t.Fatalf("Transaction %d mismatch, have %v, want %v", i, tx.Hash(), want[i].Hash())
+		}
+	}
+	// The private transactions must never leak into the public txpool
+	for _, tx := range newTxs {
+		if b.txPool.Has(tx.Hash()) {
+			t.Fatalf("Private transaction %v leaked into txpool", tx.Hash())
+		}
+	}
+}
+
+type testDeposits []*types.Transaction
+
+func (s testDeposits) Deposits(parent *types.Header) ([]*types.Transaction, error) { return s, nil }
+
+func TestBuildPayloadDeposits(t *testing.T) {
+	signer := types.LatestSigner(params.TestChainConfig)
+	deposit := func(nonce uint64) *types.Transaction {
+		return types.MustSignNewTx(testUserKey, signer, &types.LegacyTx{
+			Nonce:    nonce,
+			To:       &testBankAddress,
+			Value:    big.NewInt(1),
+			Gas:      params.TxGas,
+			GasPrice: big.NewInt(params.InitialBaseFee), // lower tip than the pending ones
+		})
+	}
+	build := func(deposits testDeposits) (*Payload, error) {
+		config := *testConfig
+		config.AllowStateOverrides = true
+		config.DepositSource = deposits
+
+		w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+		t.Cleanup(w.close)
+
+		return w.buildPayload(&BuildPayloadArgs{
+			Parent:         b.chain.CurrentBlock().Hash(),
+			Timestamp:      uint64(time.Now().Unix()),
+			FeeRecipient:   common.HexToAddress("0xdeadbeef"),
+			StateOverrides: StateOverride{testUserAddress: {Balance: big.NewInt(params.Ether)}},
+		})
+	}
+	deposits := testDeposits{deposit(0), deposit(1)}
+	payload, err := build(deposits)
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	empty, full := payload.ResolveEmpty(), payload.ResolveFull()
+	payload.stopBuilding()
+
+	// The deposits are at the top of both blocks in order, followed by the
+	// pending transactions in the full block
+	want := append(append([]*types.Transaction{}, deposits...), pendingTxs...)
+	for _, test := range []struct {
+		data *beacon.ExecutableDataV1
+		want []*types.Transaction
+	}{
+		{empty, deposits},
+		{full, want},
+	} {
+		if len(test.data.Transactions) != len(test.want) {
+			t.Fatalf("Unexpected transaction set, have %d, want %d", len(test.data.Transactions), len(test.want))
+		}
+		for i, enc := range test.data.Transactions {
+			var tx types.Transaction
+			if err := tx.UnmarshalBinary(enc); err != nil {
+				t.Fatalf("Failed to decode transaction %v", err)
+			}
+			if tx.Hash() != test.want[i].Hash() {
+				t.Fatalf("Transaction %d mismatch, have %v, want %v", i, tx.Hash(), test.want[i].Hash())
+			}
+		}
+	}
+	// The payload is not built with an invalid deposit
+	if _, err := build(testDeposits{deposit(0), deposit(2)}); err == nil {
+		t.Fatal("Payload built with invalid deposit")
+	}
+}
+
+func TestBuildPayloadSeedTx(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	tx := b.newRandomTx(false)
+	if err := b.txPool.AddLocal(tx); err != nil {
+		t.Fatalf("Failed to add transaction %v", err)
+	}
+	// Seed with the pending transaction, it's skipped by the txpool filling then
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		SeedTx:       pendingTxs[0],
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	seed, _ := pendingTxs[0].MarshalBinary()
+	empty := payload.ResolveEmpty()
+	if len(empty.Transactions) != 1 || !bytes.Equal(empty.Transactions[0], seed) {
+		t.Fatalf("Seed transaction is missing in empty block, have %d txs", len(empty.Transactions))
+	}
+	full := payload.ResolveFull()
+	if len(full.Transactions) != 2 || !bytes.Equal(full.Transactions[0], seed) {
+		t.Fatalf("Seed transaction is missing in full block, have %d txs", len(full.Transactions))
+	}
+}
+
+func TestBuildPayloadFillStopReason(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	args := &BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	}
+	// The sparse txpool is exhausted before reaching the gas limit
+	payload, err := w.buildPayload(args)
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	payload.ResolveFull()
+	if reason := payload.FillStopReason(); reason != FillStopTxsExhausted {
+		t.Fatalf("Unexpected fill stop reason, have %q, want %q", reason, FillStopTxsExhausted)
+	}
+	payload.Resolve()
+
+	// The crowded txpool hits the gas limit, which is shrunk by the reservation
+	if err := b.txPool.AddLocal(b.newRandomTx(false)); err != nil {
+		t.Fatalf("Failed to add transaction %v", err)
+	}
+	empty, _, err := w.getSealingBlock(w.sealingParams(args, true))
+	if err != nil {
+		t.Fatalf("Failed to generate empty block %v", err)
+	}
+	args.ReserveGas = empty.GasLimit() - params.TxGas
+
+	params := w.sealingParams(args, false)
+	params.report = new(fillReport)
+	block, _, err := w.getSealingBlock(params)
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if len(block.Transactions()) != 1 {
+		t.Fatalf("Unexpected transaction set, have %d, want 1", len(block.Transactions()))
+	}
+	if params.report.stop != FillStopGasLimit {
+		t.Fatalf("Unexpected fill stop reason, have %q, want %q", params.report.stop, FillStopGasLimit)
+	}
+}
+
+func TestBuildPayloadStalledAccounts(t *testing.T) {
+	// Feed a private transaction leaving a nonce gap after the pending one
+	gapped := types.MustSignNewTx(testBankKey, types.LatestSigner(params.TestChainConfig), &types.LegacyTx{
+		Nonce:    5,
+		To:       &testUserAddress,
+		Value:    big.NewInt(1000),
+		Gas:      params.TxGas,
+		GasPrice: big.NewInt(params.InitialBaseFee),
+	})
+	config := *testConfig
+	config.PayloadDiagnostics = true
+	config.PrivateTxs = testPrivateTxs{testBankAddress: types.Transactions{gapped}}
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	defer payload.stopBuilding()
+
+	payload.ResolveFull()
+	stalled := payload.StalledAccounts()
+	if len(stalled) != 1 {
+		t.Fatalf("Unexpected stalled accounts, have %d, want 1", len(stalled))
+	}
+	want := StalledAccount{Address: testBankAddress, Nonce: 1, Next: 5}
+	if stalled[0] != want {
+		t.Fatalf("Stalled account mismatch, have %+v, want %+v", stalled[0], want)
+	}
+}
+
+func TestBuildPayloadMulti(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	recipients := []common.Address{common.HexToAddress("0xdeadbeef"), common.HexToAddress("0xcafebabe")}
+	payloads, err := w.buildPayloadMulti(BuildPayloadArgs{
+		Parent:    b.chain.CurrentBlock().Hash(),
+		Timestamp: uint64(time.Now().Unix()),
+	}, recipients)
+	if err != nil {
+		t.Fatalf("Failed to build payloads %v", err)
+	}
+	if len(payloads) != len(recipients) {
+		t.Fatalf("Unexpected payload count, have %d, want %d", len(payloads), len(recipients))
+	}
+	for i, payload := range payloads {
+		full := payload.ResolveFull()
+		if full.FeeRecipient != recipients[i] {
+			t.Fatalf("Payload %d fee recipient mismatch, have %v, want %v", i, full.FeeRecipient, recipients[i])
+		}
+		if len(full.Transactions) != len(pendingTxs) {
+			t.Fatalf("Payload %d transaction set mismatch, have %d, want %d", i, len(full.Transactions), len(pendingTxs))
+		}
+		payload.Resolve()
+	}
+}
+
+func TestFeesBucket(t *testing.T) {
+	var tests = []struct {
+		elapsed time.Duration
+		want    int
+	}{
+		{0, 0},
+		{999 * time.Millisecond, 0},
+		{time.Second, 1},
+		{11500 * time.Millisecond, 11},
+		{12 * time.Second, payloadFeesBuckets},
+		{time.Minute, payloadFeesBuckets},
+	}
+	for i, test := range tests {
+		if have := feesBucket(test.elapsed); have != test.want {
+			t.Errorf("test %d: bucket mismatch, have %d, want %d", i, have, test.want)
+		}
+	}
+}
+
+func TestRecentPayloads(t *testing.T) {
+	config := *testConfig
+	config.RecentPayloads = 3
+
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	var (
+		timestamp = uint64(time.Now().Unix())
+		ids       []beacon.PayloadID
+	)
+	for i := 0; i < 5; i++ {
+		args := &BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    timestamp + uint64(i),
+			FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		}
+		payload, err := w.buildPayload(args)
+		if err != nil {
+			t.Fatalf("Failed to build payload %v", err)
+		}
+		payload.Resolve()
+		<-payload.done
+		ids = append(ids, args.Id())
+
+		// The payloads stopped without resolving are not retained
+		payload, err = w.buildPayload(&BuildPayloadArgs{
+			Parent:       b.chain.CurrentBlock().Hash(),
+			Timestamp:    timestamp + uint64(i),
+			FeeRecipient: common.HexToAddress("0xcafe"),
+		})
+		if err != nil {
+			t.Fatalf("Failed to build payload %v", err)
+		}
+		payload.stopBuilding()
+		<-payload.done
+	}
+	records := w.RecentPayloads(10)
+	if len(records) != 3 {
+		t.Fatalf("Retained payload number mismatch, have %d, want %d", len(records), 3)
+	}
+	for i, record := range records {
+		want := len(ids) - 1 - i
+		if record.Report.ID != ids[want] {
+			t.Errorf("record %d: id mismatch, have %v, want %v", i, record.Report.ID, ids[want])
+		}
+		if record.Block == nil || record.Block.Time() != timestamp+uint64(want) {
+			t.Errorf("record %d: block mismatch", i)
+		}
+	}
+	if records := w.RecentPayloads(2); len(records) != 2 || records[0].Report.ID != ids[4] {
+		t.Errorf("Limited recent payloads mismatch")
+	}
+	if records := w.RecentPayloads(0); len(records) != 0 {
+		t.Errorf("Unexpected recent payloads, have %d", len(records))
+	}
+}
+
+func TestPayloadTimings(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	if timings := payload.Timings(); timings.Started.IsZero() || timings.EmptyReady.IsZero() || !timings.Stopped.IsZero() {
+		t.Fatalf("Unexpected timings of running payload %+v", timings)
+	}
+	payload.ResolveFull() // wait for the full block
+	payload.Resolve()
+	<-payload.done
+
+	timings := payload.Timings()
+	stages := []struct {
+		name string
+		time time.Time
+	}{
+		{"started", timings.Started},
+		{"empty ready", timings.EmptyReady},
+		{"first full", timings.FirstFull},
+		{"last update", timings.LastUpdate},
+		{"stopped", timings.Stopped},
+	}
+	for i, stage := range stages {
+		if stage.time.IsZero() {
+			t.Fatalf("Missing %s timestamp", stage.name)
+		}
+		if i > 0 && stage.time.Before(stages[i-1].time) {
+			t.Fatalf("Timestamp %s %v precedes %s %v", stage.name, stage.time, stages[i-1].name, stages[i-1].time)
+		}
+	}
+}
+
+func TestPayloadResolveWithValue(t *testing.T) {
+	var (
+		empty = types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), BaseFee: big.NewInt(params.InitialBaseFee)})
+		full  = types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), BaseFee: big.NewInt(params.InitialBaseFee), GasUsed: params.TxGas})
+		fees  = big.NewInt(params.GWei)
+	)
+	// The empty block is valued zero rather than nil
+	data, value := newPayload(empty).ResolveWithValue()
+	if data == nil || data.BlockHash != empty.Hash() {
+		t.Fatalf("Empty block not resolved")
+	}
+	if value == nil || value.Sign() != 0 {
+		t.Fatalf("Unexpected empty block value, have %v, want 0", value)
+	}
+	// The full block is valued with its fees
+	payload := newPayload(empty)
+	payload.update(full, fees)
+	data, value = payload.ResolveWithValue()
+	if data == nil || data.BlockHash != full.Hash() {
+		t.Fatalf("Full block not resolved")
+	}
+	if value == nil || value.Cmp(fees) != 0 {
+		t.Fatalf("Unexpected full block value, have %v, want %v", value, fees)
+	}
+}
+
+// countingTimer is a timer counting its samples, for checking the sampling of a
+// timer metric while the metrics are disabled.
+type countingTimer struct {
+	metrics.NilTimer
+	samples int32
+}
+
+func (t *countingTimer) UpdateSince(time.Time) { atomic.AddInt32(&t.samples, 1) }
+
+// countFirstFull replaces the timer of the first full blocks with a counting one
+// for the duration of the test.
+func countFirstFull(t *testing.T) *countingTimer {
+	timer, prev := new(countingTimer), payloadFirstFullTimer
+	payloadFirstFullTimer = timer
+	t.Cleanup(func() { payloadFirstFullTimer = prev })
+	return timer
+}
+
+func TestFirstFullTimerRejected(t *testing.T) {
+	timer := countFirstFull(t)
+
+	w, b := newTestWorkerWithConfig(t, testConfig, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	w.recommit = 50 * time.Millisecond
+	iterations := watchIterations(w)
+
+	vetoed := int32(1)
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+		BlockVeto:    func(*types.Block) bool { return atomic.LoadInt32(&vetoed) == 1 },
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	defer payload.stopBuilding()
+
+	// The rejected blocks are not sampled
+	for i := 0; i < 3; i++ {
+		select {
+		case <-iterations:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Payload building iteration is not finished")
+		}
+	}
+	if n := atomic.LoadInt32(&timer.samples); n != 0 {
+		t.Fatalf("Rejected blocks sampled, have %d, want 0", n)
+	}
+	// The first accepted full block is sampled once, the later ones aren't
+	atomic.StoreInt32(&vetoed, 0)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-iterations:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Payload building iteration is not finished")
+		}
+	}
+	if n := atomic.LoadInt32(&timer.samples); n != 1 {
+		t.Fatalf("Unexpected first full samples, have %d, want 1", n)
+	}
+}
+
+func TestFirstFullTimerFailedIterations(t *testing.T) {
+	timer := countFirstFull(t)
+
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	// Fail the first two full-block iterations with the retries exhausted, the
+	// first state retrieval is made for the empty block
+	backoffs := stateRetryBackoffs
+	stateRetryBackoffs = []time.Duration{time.Millisecond}
+	defer func() { stateRetryBackoffs = backoffs }()
+
+	var calls int32
+	w.stateHook = func() error {
+		if n := atomic.AddInt32(&calls, 1); n >= 2 && n <= 5 {
+			return errors.New("state flushing")
+		}
+		return nil
+	}
+	w.recommit = 50 * time.Millisecond
+	iterations := watchIterations(w)
+
+	payload, err := w.buildPayload(&BuildPayloadArgs{
+		Parent:       b.chain.CurrentBlock().Hash(),
+		Timestamp:    uint64(time.Now().Unix()),
+		FeeRecipient: common.HexToAddress("0xdeadbeef"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to build payload %v", err)
+	}
+	defer payload.stopBuilding()
+
+	for i := 0; i < 5; i++ {
+		select {
+		case result := <-iterations:
+			if failed := result.err != nil; failed != (i < 2) {
+				t.Fatalf("iteration %d: unexpected outcome, err %v", i, result.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Payload building iteration is not finished")
+		}
+	}
+	if n := atomic.LoadInt32(&timer.samples); n != 1 {
+		t.Fatalf("Unexpected first full samples, have %d, want 1", n)
+	}
+}
@@ -17,20 +17,25 @@
 package miner
 
 import (
+	"crypto/ecdsa"
 	"errors"
 	"fmt"
 	"math/big"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	mapset "github.com/deckarep/golang-set"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/consensus/misc"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/params"
@@ -54,6 +59,10 @@ const (
 	// resubmitAdjustChanSize is the size of resubmitting interval adjustment channel.
 	resubmitAdjustChanSize = 10
 
+	// builtBlockChanSize is the size of channel buffering the accepted payload
+	// blocks for the subscribers, the overflowing ones are dropped.
+	builtBlockChanSize = 16
+
 	// sealingLogAtDepth is the number of confirmations before logging successful sealing.
 	sealingLogAtDepth = 7
 
@@ -75,12 +84,25 @@ const (
 
 	// staleThreshold is the maximum depth of the acceptable stale block.
 	staleThreshold = 7
+
+	// spliceCheckpointInterval is the number of transactions between two execution
+	// checkpoints kept for re-building the payload with the unchanged prefix.
+	spliceCheckpointInterval = 16
 )
 
 var (
 	errBlockInterruptedByNewHead  = errors.New("new head arrived while building block")
 	errBlockInterruptedByRecommit = errors.New("recommit interrupt while building block")
 	errBlockInterruptedByTimeout  = errors.New("timeout while building block")
+	errBlockInterruptedByPayload  = errors.New("new payload requested while building block")
+	errBlockInterruptedByResolve  = errors.New("payload resolved while building block")
+	errTxTouchesExcluded          = errors.New("transaction touches excluded address")
+	errAppendTxReverted           = errors.New("appended transaction reverted")
+	errBundleTxReverted           = errors.New("bundle transaction reverted")
+	errPayoutReverted             = errors.New("payout transaction reverted")
+	errStateUnavailable           = errors.New("sealing state unavailable")
+	errTxExecutionTimeout         = errors.New("transaction execution timeout")
+	errTimestampAdjusted          = errors.New("timestamp adjusted by consensus engine")
 )
 
 // environment is the worker's current environment and holds all
@@ -88,12 +110,35 @@ var (
 type environment struct {
 	signer types.Signer
 
-	state     *state.StateDB // apply state changes here
-	ancestors mapset.Set     // ancestor set (used for checking uncle parent validity)
-	family    mapset.Set     // family set (used for checking uncle invalidity)
-	tcount    int            // tx count in cycle
-	gasPool   *core.GasPool  // available gas used to pack transactions
-	coinbase  common.Address
+	state      *state.StateDB // apply state changes here
+	ancestors  mapset.Set     // ancestor set (used for checking uncle parent validity)
+	family     mapset.Set     // family set (used for checking uncle invalidity)
+	tcount     int            // tx count in cycle
+	gasPool    *core.GasPool  // available gas used to pack transactions
+	coinbase   common.Address
+	excluded   map[common.Address]struct{}       // addresses whose transactions are not allowed
+	allowed    map[common.Address]struct{}       // senders whose transactions are exclusively allowed, nil means all
+	disabled   map[common.Address]struct{}       // precompiled contracts executed as absent, nil means none
+	valuer     func(*types.Transaction) *big.Int // custom transaction valuer for ordering
+	scorer     func(common.Address) int64        // sender scorer for breaking ordering ties, nil means neutral
+	splice     *spliceCache                      // execution cache of the previous build, nil means disabled
+	txTypes    uint64                            // bitmask of the allowed transaction types, zero means all
+	minTxAge   time.Duration                     // minimum time since the transactions were first seen, zero means no limit
+	minPrice   *big.Int                          // minimum gas price of the pre-1559 transactions, nil means no floor
+	feeFloor   *big.Int                          // minimum fee cap of the transactions, the base fee plus the margin, nil means no floor
+	relayFloor *big.Int                          // minimum effective gas price of the transactions of all types, nil means no floor
+	senderCap  int                               // maximum number of transactions per sender, zero means unlimited
+	senderTxs  map[common.Address]int            // number of transactions per sender, lazily counted if capped
+	dataCap    uint64                            // maximum total calldata bytes of the transactions, zero means unlimited
+	dataSize   *uint64                           // total calldata bytes of the transactions, lazily counted if capped
+	drainCap   uint64                            // maximum gas of the pending transactions to include, zero means unlimited
+	drained    uint64                            // gas of the pending transactions included so far
+	pending    *PendingSnapshot                  // frozen pending transactions to fill from, nil means the live txpool
+	gasLimited bool                              // flag whether the filling is limited by the gas limit
+	starved    bool                              // flag whether no pending transaction is included though some are available
+	diagnose   bool                              // flag whether the inclusion diagnostics are collected
+	stalled    []StalledAccount                  // accounts stalled by nonce gaps, collected for diagnostics only
+	view       *MempoolView                      // summary of the pending transactions filled from, collected for diagnostics only
 
 	header   *types.Header
 	txs      []*types.Transaction
@@ -104,14 +149,35 @@ type environment struct {
 // copy creates a deep copy of environment.
 func (env *environment) copy() *environment {
 	cpy := &environment{
-		signer:    env.signer,
-		state:     env.state.Copy(),
-		ancestors: env.ancestors.Clone(),
-		family:    env.family.Clone(),
-		tcount:    env.tcount,
-		coinbase:  env.coinbase,
-		header:    types.CopyHeader(env.header),
-		receipts:  copyReceipts(env.receipts),
+		signer:     env.signer,
+		state:      env.state.Copy(),
+		ancestors:  env.ancestors.Clone(),
+		family:     env.family.Clone(),
+		tcount:     env.tcount,
+		coinbase:   env.coinbase,
+		excluded:   env.excluded,
+		allowed:    env.allowed,
+		disabled:   env.disabled,
+		valuer:     env.valuer,
+		scorer:     env.scorer,
+		splice:     env.splice,
+		txTypes:    env.txTypes,
+		minTxAge:   env.minTxAge,
+		minPrice:   env.minPrice,
+		feeFloor:   env.feeFloor,
+		relayFloor: env.relayFloor,
+		senderCap:  env.senderCap,
+		dataCap:    env.dataCap,
+		drainCap:   env.drainCap,
+		drained:    env.drained,
+		pending:    env.pending,
+		gasLimited: env.gasLimited,
+		starved:    env.starved,
+		diagnose:   env.diagnose,
+		stalled:    append([]StalledAccount(nil), env.stalled...),
+		view:       env.view,
+		header:     types.CopyHeader(env.header),
+		receipts:   copyReceipts(env.receipts),
 	}
 	if env.gasPool != nil {
 		gasPool := *env.gasPool
@@ -128,6 +194,34 @@ func (env *environment) copy() *environment {
 	return cpy
 }
 
+// senderCount returns the number of the transactions sent by the given address
+// in the block. The counters are built lazily from the included transactions,
+// which may be restored from the previous build.
+func (env *environment) senderCount(addr common.Address) int {
+	if env.senderTxs == nil {
+		env.senderTxs = make(map[common.Address]int)
+		for _, tx := range env.txs {
+			from, _ := types.Sender(env.signer, tx)
+			env.senderTxs[from]++
+		}
+	}
+	return env.senderTxs[addr]
+}
+
+// calldataSize returns the total calldata bytes of the transactions in the block.
+// The counter is built lazily from the included transactions, which may be
+// restored from the previous build.
+func (env *environment) calldataSize() uint64 {
+	if env.dataSize == nil {
+		var size uint64
+		for _, tx := range env.txs {
+			size += uint64(len(tx.Data()))
+		}
+		env.dataSize = &size
+	}
+	return *env.dataSize
+}
+
 // unclelist returns the contained uncles as the list format.
 func (env *environment) unclelist() []*types.Header {
 	var uncles []*types.Header
@@ -137,6 +231,17 @@ func (env *environment) unclelist() []*types.Header {
 	return uncles
 }
 
+// checkpoint records the current execution state if the splice cache is enabled
+// and the checkpoint interval is reached.
+func (env *environment) checkpoint() {
+	if env.splice == nil || env.tcount == 0 || env.tcount%spliceCheckpointInterval != 0 {
+		return
+	}
+	if len(env.splice.checkpoints) == env.tcount/spliceCheckpointInterval-1 {
+		env.splice.checkpoints = append(env.splice.checkpoints, env.copy())
+	}
+}
+
 // discard terminates the background prefetcher go-routine. It should
 // always be called for all created environment instances otherwise
 // the go-routine leak can happen.
@@ -147,6 +252,14 @@ func (env *environment) discard() {
 	env.state.StopPrefetcher()
 }
 
+// spliceCache is the execution cache of the last build of a payload, used for
+// re-executing only the changed suffix of the transactions in the next build.
+type spliceCache struct {
+	header      common.Hash          // Hash of the header the cache is built on
+	txs         []*types.Transaction // Transactions included in the last build
+	checkpoints []*environment       // Execution states after every spliceCheckpointInterval transactions
+}
+
 // task contains all information for consensus engine sealing and result submitting.
 type task struct {
 	receipts  []*types.Receipt
@@ -160,6 +273,8 @@ const (
 	commitInterruptNewHead
 	commitInterruptResubmit
 	commitInterruptTimeout
+	commitInterruptNewPayload
+	commitInterruptResolve
 )
 
 // newWorkReq represents a request for new sealing work submitting with relative interrupt notifier.
@@ -199,6 +314,7 @@ type worker struct {
 
 	// Feeds
 	pendingLogsFeed event.Feed
+	builtBlockFeed  event.Feed
 
 	// Subscriptions
 	mux          *event.TypeMux
@@ -218,6 +334,7 @@ type worker struct {
 	exitCh             chan struct{}
 	resubmitIntervalCh chan time.Duration
 	resubmitAdjustCh   chan *intervalAdjust
+	builtBlockCh       chan *types.Block
 
 	wg sync.WaitGroup
 
@@ -238,6 +355,16 @@ type worker struct {
 	snapshotReceipts types.Receipts
 	snapshotState    *state.StateDB
 
+	payloadsMu sync.Mutex            // The lock used to protect the payloads below
+	payloads   map[*Payload]struct{} // The payloads with an active background builder
+
+	recentMu   sync.Mutex       // The lock used to protect the recent payloads below
+	recent     []*PayloadRecord // The ring buffer of the last resolved payloads, nil if disabled
+	recentNext int              // The slot in the ring for the next resolved payload
+
+	sealingMu         sync.Mutex             // The lock used to protect the sealing interrupts
+	sealingInterrupts map[*int32]common.Hash // The interrupt signals of the in-flight payload generations, keyed to their parents
+
 	// atomic status counters
 	running int32 // The indicator whether the consensus engine is running or not.
 	newTxs  int32 // New arrival transaction count since last sealing work submitting.
@@ -260,6 +387,40 @@ type worker struct {
 	// payload in proof-of-stake stage.
 	recommit time.Duration
 
+	// payloadCandidates is the number of the best distinct blocks retained per
+	// payload, zero or one means only the best one is tracked.
+	payloadCandidates int
+
+	// payloadLifetime is the time allowance of the payload building in the
+	// background, it's only changed in tests.
+	payloadLifetime time.Duration
+
+	// reward is the custom block subsidy minted by the consensus engine, nil if
+	// there is none.
+	reward RewardFunc
+
+	// builderKey is the key for signing the payout transactions to the fee
+	// recipients of payloads, nil means the fees are collected directly.
+	builderKey  *ecdsa.PrivateKey
+	builderAddr common.Address
+
+	// compareCandidates is the custom valuation of the payload full blocks, it
+	// returns a positive number if a is more valuable than b, negative if less
+	// and zero if they are equal. Nil means comparing the transaction fees.
+	compareCandidates func(a, b *candidateStats) int
+
+	// excluded is the set of addresses specified by the operator whose touching
+	// transactions are never included in the payloads built for the beacon chain.
+	excluded map[common.Address]struct{}
+
+	// payloadExtra is the header extra-data of the payloads, composed from the
+	// configured layout. Nil means leaving it empty.
+	payloadExtra []byte
+
+	// allowed is the set of senders specified by the operator whose transactions
+	// are exclusively included in the payloads, nil means allowing all senders.
+	allowed map[common.Address]struct{}
+
 	// External functions
 	isLocalBlock func(header *types.Header) bool // Function used to determine whether the specified block is mined by local miner.
 
@@ -268,6 +429,11 @@ type worker struct {
 	skipSealHook func(*task) bool                   // Method to decide whether skipping the sealing.
 	fullTaskHook func()                             // Method to call before pushing the full sealing task.
 	resubmitHook func(time.Duration, time.Duration) // Method to call upon updating resubmitting interval.
+	fillHook     func()                             // Method to call before filling the transactions of payload.
+	validateHook func(*types.Block) error           // Method to call before validating the payload block.
+	stateHook    func() error                       // Method to call before retrieving the sealing state.
+	iterHook     func(iterationResult)              // Method to call upon finishing each payload building iteration.
+	nonceHook    func(common.Address) uint64        // Method to query the nonce an account must reach before its transactions are included.
 }
 
 func newWorker(config *Config, chainConfig *params.ChainConfig, engine consensus.Engine, eth Backend, mux *event.TypeMux, isLocalBlock func(header *types.Header) bool, init bool) *worker {
@@ -283,6 +449,9 @@ func newWorker(config *Config, chainConfig *params.ChainConfig, engine consensus
 		remoteUncles:       make(map[common.Hash]*types.Block),
 		unconfirmed:        newUnconfirmedBlocks(eth.BlockChain(), sealingLogAtDepth),
 		pendingTasks:       make(map[common.Hash]*task),
+		payloads:           make(map[*Payload]struct{}),
+		sealingInterrupts:  make(map[*int32]common.Hash),
+		payloadLifetime:    payloadLifetime,
 		txsCh:              make(chan core.NewTxsEvent, txChanSize),
 		chainHeadCh:        make(chan core.ChainHeadEvent, chainHeadChanSize),
 		chainSideCh:        make(chan core.ChainSideEvent, chainSideChanSize),
@@ -294,6 +463,7 @@ func newWorker(config *Config, chainConfig *params.ChainConfig, engine consensus
 		startCh:            make(chan struct{}, 1),
 		resubmitIntervalCh: make(chan time.Duration),
 		resubmitAdjustCh:   make(chan *intervalAdjust, resubmitAdjustChanSize),
+		builtBlockCh:       make(chan *types.Block, builtBlockChanSize),
 	}
 	// Subscribe NewTxsEvent for tx pool
 	worker.txsSub = eth.TxPool().SubscribeNewTxsEvent(worker.txsCh)
@@ -320,11 +490,78 @@ func newWorker(config *Config, chainConfig *params.ChainConfig, engine consensus
 	}
 	worker.newpayloadTimeout = newpayloadTimeout
 
-	worker.wg.Add(4)
+	// Sanitize the candidate number retained per payload.
+	payloadCandidates := worker.config.PayloadCandidates
+	if payloadCandidates > maxPayloadCandidates {
+		log.Warn("Sanitizing payload candidates", "provided", payloadCandidates, "updated", maxPayloadCandidates)
+		payloadCandidates = maxPayloadCandidates
+	}
+	worker.payloadCandidates = payloadCandidates
+
+	// Set up the ring buffer of the recent resolved payloads if it's enabled.
+	if recent := worker.config.RecentPayloads; recent > 0 {
+		worker.recent = make([]*PayloadRecord, 0, recent)
+	}
+
+	// Set up the valuation of the payload full blocks, the default one compares
+	// the fees.
+	if objective := worker.config.BuildObjective; objective != BuildMaxFees {
+		if compare := objective.comparator(); compare != nil {
+			log.Info("Building payloads with custom objective", "objective", objective)
+			worker.compareCandidates = compare
+		} else {
+			log.Warn("Sanitizing unknown build objective", "provided", objective, "updated", BuildMaxFees)
+		}
+	}
+
+	// Install the custom block subsidy into the consensus engine if it's configured,
+	// the blocks have to be finalized alike on sealing and on import.
+	if reward := worker.config.RewardFunc; reward != nil {
+		if engine, ok := engine.(RewardEngine); ok {
+			engine.SetRewardFunc(reward)
+			worker.reward = reward
+		} else {
+			log.Error("Ignoring block reward unsupported by consensus engine")
+		}
+	}
+	// Set up the builder account for paying out the payloads if it's configured.
+	if key := worker.config.BuilderKey; key != nil {
+		worker.builderKey, worker.builderAddr = key, crypto.PubkeyToAddress(key.PublicKey)
+		log.Info("Paying out payloads from builder account", "builder", worker.builderAddr)
+	}
+	// Assemble the address blocklist for building payloads if it's configured.
+	if len(worker.config.ExcludeAddresses) > 0 {
+		worker.excluded = make(map[common.Address]struct{})
+		for _, addr := range worker.config.ExcludeAddresses {
+			worker.excluded[addr] = struct{}{}
+		}
+		log.Info("Excluding transactions from payloads", "addresses", len(worker.excluded))
+	}
+	// Compose the extra-data of payloads if it's configured, it's ignored if
+	// it's invalid since the payloads can be built regardless.
+	if layout := worker.config.PayloadExtra; layout != nil {
+		extra, err := layout.Encode()
+		if err != nil {
+			log.Warn("Ignoring invalid payload extra-data", "err", err)
+		} else {
+			worker.payloadExtra = extra
+		}
+	}
+	// Assemble the sender allowlist for building payloads if it's configured.
+	if len(worker.config.AllowedSenders) > 0 {
+		worker.allowed = make(map[common.Address]struct{})
+		for _, addr := range worker.config.AllowedSenders {
+			worker.allowed[addr] = struct{}{}
+		}
+		log.Info("Restricting payload transactions to allowed senders", "senders", len(worker.allowed))
+	}
+
+	worker.wg.Add(5)
 	go worker.mainLoop()
 	go worker.newWorkLoop(recommit)
 	go worker.resultLoop()
 	go worker.taskLoop()
+	go worker.builtBlockLoop()
 
 	// Submit first work to initialize pending state.
 	if init {
@@ -418,6 +655,11 @@ func (w *worker) isRunning() bool {
 // Note the worker does not support being closed multiple times.
 func (w *worker) close() {
 	atomic.StoreInt32(&w.running, 0)
+
+	// Terminate the in-flight payload builders before the main loop, they
+	// might still be waiting for the sealing block to be generated.
+	w.stopPayloadBuilding()
+
 	close(w.exitCh)
 	w.wg.Wait()
 }
@@ -780,13 +1022,32 @@ func (w *worker) resultLoop() {
 	}
 }
 
+// builtBlockLoop is a standalone goroutine to deliver the accepted payload blocks
+// to the subscribers, decoupling the payload building from the slow consumers.
+func (w *worker) builtBlockLoop() {
+	defer w.wg.Done()
+	for {
+		select {
+		case block := <-w.builtBlockCh:
+			w.builtBlockFeed.Send(block)
+		case <-w.exitCh:
+			return
+		}
+	}
+}
+
 // makeEnv creates a new environment for the sealing block.
 func (w *worker) makeEnv(parent *types.Block, header *types.Header, coinbase common.Address) (*environment, error) {
 	// Retrieve the parent state to execute on top and start a prefetcher for
 	// the miner to speed block sealing up a bit.
+	if w.stateHook != nil {
+		if err := w.stateHook(); err != nil {
+			return nil, fmt.Errorf("%w: %v", errStateUnavailable, err)
+		}
+	}
 	state, err := w.chain.StateAt(parent.Root())
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", errStateUnavailable, err)
 	}
 	state.StartPrefetcher("miner")
 
@@ -852,11 +1113,16 @@ func (w *worker) updateSnapshot(env *environment) {
 }
 
 func (w *worker) commitTransaction(env *environment, tx *types.Transaction) ([]*types.Log, error) {
-	snap := env.state.Snapshot()
-
-	receipt, err := core.ApplyTransaction(w.chainConfig, w.chain, &env.coinbase, env.gasPool, env.state, env.header, tx, &env.header.GasUsed, *w.chain.GetVMConfig())
+	var (
+		snap    = env.state.Snapshot()
+		gasPool = *env.gasPool
+	)
+	receipt, err := w.applyTransaction(env, tx)
 	if err != nil {
 		env.state.RevertToSnapshot(snap)
+		if errors.Is(err, errTxExecutionTimeout) || errors.Is(err, errTxTouchesExcluded) {
+			*env.gasPool = gasPool
+		}
 		return nil, err
 	}
 	env.txs = append(env.txs, tx)
@@ -865,6 +1131,98 @@ func (w *worker) commitTransaction(env *environment, tx *types.Transaction) ([]*
 	return receipt.Logs, nil
 }
 
+// applyTransaction executes the transaction on top of the environment. The
+// execution is cancelled if it exceeds the configured timeout or it touches any
+// excluded address, the gas pool is consumed and the state changes are left for
+// the caller to revert then.
+func (w *worker) applyTransaction(env *environment, tx *types.Transaction) (*types.Receipt, error) {
+	cfg := *w.chain.GetVMConfig()
+	if env.disabled != nil {
+		cfg.DisabledPrecompiles = env.disabled
+	}
+	// Watch the addresses actually touched by the execution if any is excluded.
+	// Note it replaces the tracer configured for the chain, if any.
+	var tracer *exclusionTracer
+	if len(env.excluded) > 0 {
+		tracer = &exclusionTracer{excluded: env.excluded}
+		cfg.Debug, cfg.Tracer = true, tracer
+	}
+	receipt, err := w.applyTransactionWithConfig(env, tx, cfg)
+	if tracer != nil && tracer.touched {
+		return nil, errTxTouchesExcluded
+	}
+	return receipt, err
+}
+
+// applyTransactionWithConfig is identical to applyTransaction, but it executes
+// the transaction with the given vm config.
+func (w *worker) applyTransactionWithConfig(env *environment, tx *types.Transaction, cfg vm.Config) (*types.Receipt, error) {
+	timeout := w.config.TxExecutionTimeout
+	if timeout <= 0 {
+		return core.ApplyTransaction(w.chainConfig, w.chain, &env.coinbase, env.gasPool, env.state, env.header, tx, &env.header.GasUsed, cfg)
+	}
+	msg, err := tx.AsMessage(types.MakeSigner(w.chainConfig, env.header.Number), env.header.BaseFee)
+	if err != nil {
+		return nil, err
+	}
+	evm := vm.NewEVM(core.NewEVMBlockContext(env.header, w.chain, &env.coinbase), vm.TxContext{}, env.state, w.chainConfig, cfg)
+	timer := time.AfterFunc(timeout, evm.Cancel)
+	defer timer.Stop()
+
+	receipt, err := core.ApplyTransactionWithEVM(msg, w.chainConfig, &env.coinbase, env.gasPool, env.state, env.header, tx, &env.header.GasUsed, evm)
+	if errors.Is(err, core.ErrExecutionAborted) {
+		return nil, fmt.Errorf("%w: %v", errTxExecutionTimeout, timeout)
+	}
+	return receipt, err
+}
+
+// prefetchTransactions executes the given pending transactions on a throwaway
+// copy of the sealing state in the background, warming the shared trie and
+// snapshot caches for the actual execution. The changes are discarded, so the
+// sealing state is never touched. The returned function aborts the prefetching.
+func (w *worker) prefetchTransactions(env *environment, groups ...map[common.Address]types.Transactions) func() {
+	var (
+		interrupt uint32
+		statedb   = env.state.Copy()
+		header    = types.CopyHeader(env.header)
+		signer    = env.signer
+		cfg       = *w.chain.GetVMConfig()
+	)
+	if env.disabled != nil {
+		cfg.DisabledPrecompiles = env.disabled
+	}
+	evm := vm.NewEVM(core.NewEVMBlockContext(header, w.chain, &env.coinbase), vm.TxContext{}, statedb, w.chainConfig, cfg)
+
+	// Copy the lists, the ordering consumes the pending sets while building.
+	var lists []types.Transactions
+	for _, group := range groups {
+		for _, list := range group {
+			lists = append(lists, list)
+		}
+	}
+	go func() {
+		var index int
+		for _, list := range lists {
+			for _, tx := range list {
+				if atomic.LoadUint32(&interrupt) == 1 {
+					return
+				}
+				msg, err := tx.AsMessage(signer, header.BaseFee)
+				if err != nil {
+					break
+				}
+				statedb.Prepare(tx.Hash(), index)
+				evm.Reset(core.NewEVMTxContext(msg), statedb)
+				if _, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(tx.Gas())); err != nil {
+					break // the rest of the account is most likely invalid too
+				}
+				index++
+			}
+		}
+	}()
+	return func() { atomic.StoreUint32(&interrupt, 1) }
+}
+
 func (w *worker) commitTransactions(env *environment, txs *types.TransactionsByPriceAndNonce, interrupt *int32) error {
 	gasLimit := env.header.GasLimit
 	if env.gasPool == nil {
@@ -882,6 +1240,12 @@ func (w *worker) commitTransactions(env *environment, txs *types.TransactionsByP
 		// If we don't have enough gas for any further transactions then we're done.
 		if env.gasPool.Gas() < params.TxGas {
 			log.Trace("Not enough gas for further transactions", "have", env.gasPool, "want", params.TxGas)
+			env.gasLimited = true
+			break
+		}
+		// If the block already drained enough of the pending set, we're done too.
+		if env.drainCap > 0 && env.drained >= env.drainCap {
+			log.Trace("Pending transaction drain cap reached", "have", env.drained, "cap", env.drainCap)
 			break
 		}
 		// Retrieve the next transaction and abort if all done.
@@ -901,6 +1265,86 @@ func (w *worker) commitTransactions(env *environment, txs *types.TransactionsByP
 			txs.Pop()
 			continue
 		}
+		// Skip the sender if the transaction type is not allowed in the block.
+		if env.txTypes != 0 && env.txTypes&(1<<tx.Type()) == 0 {
+			log.Trace("Skipping disallowed transaction type", "sender", from, "type", tx.Type())
+
+			txs.Pop()
+			continue
+		}
+		// Skip the sender if the transaction is too fresh, it may be replaced soon.
+		// The ones without the arrival time are skipped as well.
+		if env.minTxAge > 0 && (tx.Time().IsZero() || time.Since(tx.Time()) < env.minTxAge) {
+			log.Trace("Skipping fresh transaction", "hash", tx.Hash(), "sender", from, "age", time.Since(tx.Time()))
+
+			txs.Pop()
+			continue
+		}
+		// Skip the sender if it, or the recipient, is excluded from the block.
+		if isExcluded(env, from, tx.To()) {
+			log.Trace("Skipping transaction of excluded address", "hash", tx.Hash(), "sender", from)
+
+			txs.Pop()
+			continue
+		}
+		// Skip the sender if the pre-1559 transaction pays below the gas price floor,
+		// the dynamic fee ones are left to the tip ordering.
+		if env.minPrice != nil && tx.Type() < types.DynamicFeeTxType && tx.GasPrice().Cmp(env.minPrice) < 0 {
+			log.Trace("Skipping underpriced legacy transaction", "hash", tx.Hash(), "sender", from, "price", tx.GasPrice())
+
+			txs.Pop()
+			continue
+		}
+		// Skip the sender if the transaction pays below the relay floor, measured
+		// by the effective gas price across all the transaction types.
+		if env.relayFloor != nil && effectiveGasPrice(tx, env.header.BaseFee).Cmp(env.relayFloor) < 0 {
+			log.Trace("Skipping transaction below relay floor", "hash", tx.Hash(), "sender", from, "price", effectiveGasPrice(tx, env.header.BaseFee))
+
+			txs.Pop()
+			continue
+		}
+		// Skip the sender if the transaction barely affords the base fee, within
+		// the configured affordability margin.
+		if env.feeFloor != nil && tx.GasFeeCap().Cmp(env.feeFloor) < 0 {
+			log.Trace("Skipping barely affordable transaction", "hash", tx.Hash(), "sender", from, "feecap", tx.GasFeeCap(), "floor", env.feeFloor)
+
+			txs.Pop()
+			continue
+		}
+		// Skip the sender if it's not allowed by the sender allowlist.
+		if env.allowed != nil {
+			if _, ok := env.allowed[from]; !ok {
+				log.Trace("Skipping transaction of disallowed sender", "hash", tx.Hash(), "sender", from)
+
+				txs.Pop()
+				continue
+			}
+		}
+		// Skip the sender if it already reached the transaction cap of the block.
+		if env.senderCap > 0 && env.senderCount(from) >= env.senderCap {
+			log.Trace("Skipping sender reaching transaction cap", "hash", tx.Hash(), "sender", from, "cap", env.senderCap)
+
+			txs.Pop()
+			continue
+		}
+		// Hold the sender until its nonce reaches the awaited one, simulating a
+		// pending dependency in the scenario tests.
+		if w.nonceHook != nil {
+			if want := w.nonceHook(from); env.state.GetNonce(from) < want {
+				log.Trace("Holding transaction awaiting nonce", "hash", tx.Hash(), "sender", from, "nonce", env.state.GetNonce(from), "want", want)
+
+				txs.Pop()
+				continue
+			}
+		}
+		// Skip the sender if the calldata of the transaction doesn't fit in the
+		// remaining calldata allowance, the ones without calldata always fit.
+		if size := uint64(len(tx.Data())); env.dataCap > 0 && size > 0 && env.calldataSize()+size > env.dataCap {
+			log.Trace("Skipping transaction exceeding calldata cap", "hash", tx.Hash(), "sender", from, "size", size, "cap", env.dataCap)
+
+			txs.Pop()
+			continue
+		}
 		// Start executing the transaction
 		env.state.Prepare(tx.Hash(), env.tcount)
 
@@ -909,6 +1353,7 @@ func (w *worker) commitTransactions(env *environment, txs *types.TransactionsByP
 		case errors.Is(err, core.ErrGasLimitReached):
 			// Pop the current out-of-gas transaction without shifting in the next from the account
 			log.Trace("Gas limit exceeded for current block", "sender", from)
+			env.gasLimited = true
 			txs.Pop()
 
 		case errors.Is(err, core.ErrNonceTooLow):
@@ -919,14 +1364,35 @@ func (w *worker) commitTransactions(env *environment, txs *types.TransactionsByP
 		case errors.Is(err, core.ErrNonceTooHigh):
 			// Reorg notification data race between the transaction pool and miner, skip account =
 			log.Trace("Skipping account with hight nonce", "sender", from, "nonce", tx.Nonce())
+			if env.diagnose {
+				env.stalled = append(env.stalled, StalledAccount{Address: from, Nonce: env.state.GetNonce(from), Next: tx.Nonce()})
+			}
 			txs.Pop()
 
 		case errors.Is(err, nil):
 			// Everything ok, collect the logs and shift in the next transaction from the same account
 			coalescedLogs = append(coalescedLogs, logs...)
 			env.tcount++
+			env.checkpoint()
+			if env.senderTxs != nil {
+				env.senderTxs[from]++
+			}
+			if env.dataSize != nil {
+				*env.dataSize += uint64(len(tx.Data()))
+			}
+			env.drained += tx.Gas()
 			txs.Shift()
 
+		case errors.Is(err, errTxTouchesExcluded):
+			// Pop the transaction touching excluded address without shifting in the next from the account
+			log.Trace("Skipping transaction touching excluded address", "hash", tx.Hash(), "sender", from)
+			txs.Pop()
+
+		case errors.Is(err, errTxExecutionTimeout):
+			// Pop the too slow transaction without shifting in the next from the account
+			log.Debug("Skipping transaction exceeding execution timeout", "hash", tx.Hash(), "sender", from, "err", err)
+			txs.Pop()
+
 		case errors.Is(err, types.ErrTxTypeNotSupported):
 			// Pop the unsupported transaction without shifting in the next from the account
 			log.Trace("Skipping unsupported transaction type", "sender", from, "type", tx.Type())
@@ -967,6 +1433,131 @@ type generateParams struct {
 	noUncle    bool           // Flag whether the uncle block inclusion is allowed
 	noExtra    bool           // Flag whether the extra field assignment is allowed
 	noTxs      bool           // Flag whether an empty block without any transaction is expected
+	extra      []byte         // The extra field overriding the miner's one, nil means not overridden
+
+	excluded map[common.Address]struct{}       // Addresses whose transactions are not allowed
+	allowed  map[common.Address]struct{}       // Senders whose transactions are exclusively allowed, nil means all
+	disabled map[common.Address]struct{}       // Precompiled contracts executed as absent, nil means none
+	valuer   func(*types.Transaction) *big.Int // Custom transaction valuer for ordering, nil means the effective tip
+	scorer   func(common.Address) int64        // Sender scorer for breaking ordering ties, nil means neutral
+	splice   *spliceCache                      // Execution cache of the previous build, nil means building from scratch
+
+	onIncluded func(*types.Transaction, *types.Receipt) // Callback for each included transaction, ignored for empty block
+
+	appendTxs  []*types.Transaction // Transactions to be included at the end of the block, ignored for empty block
+	txTypes    uint64               // Bitmask of the transaction types allowed from the txpool, zero means all
+	minTxAge   time.Duration        // Minimum time since the txpool transactions were first seen, zero means no limit
+	minPrice   *big.Int             // Minimum gas price of the pre-1559 txpool transactions, nil means no floor
+	relayFloor *big.Int             // Minimum effective gas price of the txpool and bundle transactions, nil means no floor
+	senderCap  int                  // Maximum number of txpool transactions per sender, zero means unlimited
+	pending    *PendingSnapshot     // Frozen pending transactions to fill from, nil means the live txpool
+	payout     *common.Address      // The recipient to pay the block profit to, nil means the coinbase keeps the fees
+	overrides  StateOverride        // The changes applied to the parent state before building, simulation only
+	interrupt  *int32               // The external interrupt signal, the partial block is returned if it's fired
+	reserveGas uint64               // The gas reserved from the txpool transactions for the appended ones
+	seedTx     *types.Transaction   // The transaction included first in both the empty and full blocks
+	deposits   []*types.Transaction // The deposits included in order at the top of both the empty and full blocks
+	uncles     []*types.Header      // The uncles explicitly included in both the empty and full blocks, all required
+	bundles    []*Bundle            // The transaction groups included atomically at the top of the full block
+	gasTarget  uint64               // The cap of the gas used by the full block below the gas limit, zero means none
+	relaxed    bool                 // Flag whether the optional inclusion filters are dropped
+	feeConfig  *params.ChainConfig  // The chain config overriding the EIP-1559 parameters, nil means the worker's
+	report     *fillReport          // The destination for the filling outcome, ignored for empty block
+	diagnose   bool                 // Flag whether the inclusion diagnostics are collected
+}
+
+// calcBaseFee returns the base fee of the block on top of the given parent, nil
+// if the block is before the London fork. The parent base fee is not assumed,
+// the initial base fee applies if the parent is before the fork, e.g. the
+// genesis of a chain activating it at block one.
+func (w *worker) calcBaseFee(parent *types.Header) *big.Int {
+	if !w.chainConfig.IsLondon(new(big.Int).Add(parent.Number, common.Big1)) {
+		return nil
+	}
+	return misc.CalcBaseFee(w.chainConfig, parent)
+}
+
+// applyBaseFeeOracle sets the base fee of the header to the one provided by the
+// oracle, if the consensus engine accepts the header with it. The derived base
+// fee is kept otherwise.
+func (w *worker) applyBaseFeeOracle(oracle BaseFeeOracle, parent, header *types.Header) {
+	baseFee := oracle.BaseFee(parent)
+	if baseFee == nil || baseFee.Cmp(header.BaseFee) == 0 {
+		return
+	}
+	if baseFee.Sign() < 0 {
+		log.Warn("Rejected negative oracle base fee", "number", header.Number, "basefee", baseFee)
+		return
+	}
+	// The uncles are not assembled yet, verify the header as an uncle-less one.
+	check := types.CopyHeader(header)
+	check.BaseFee, check.UncleHash = new(big.Int).Set(baseFee), types.EmptyUncleHash
+	if err := w.engine.VerifyHeader(w.chain, check, false); err != nil {
+		log.Warn("Rejected invalid oracle base fee", "number", header.Number, "basefee", baseFee, "derived", header.BaseFee, "err", err)
+		return
+	}
+	header.BaseFee = check.BaseFee
+}
+
+// nextBaseFee returns the expected base fee of the block on top of the specified
+// parent without building it, nil if the block is before the London fork.
+func (w *worker) nextBaseFee(parentHash common.Hash) (*big.Int, error) {
+	parent := w.chain.GetHeaderByHash(parentHash)
+	if parent == nil {
+		return nil, fmt.Errorf("missing parent")
+	}
+	return w.calcBaseFee(parent), nil
+}
+
+// parentBlockValue returns the transaction tips paid by the specified block, in
+// order to compare the value of the building payload against its parent's.
+func (w *worker) parentBlockValue(parentHash common.Hash) (*big.Int, error) {
+	block := w.chain.GetBlockByHash(parentHash)
+	if block == nil {
+		return nil, fmt.Errorf("missing parent")
+	}
+	receipts := w.chain.GetReceiptsByHash(parentHash)
+	if len(receipts) != len(block.Transactions()) {
+		return nil, fmt.Errorf("missing parent receipts")
+	}
+	return w.blockFees(block, receipts), nil
+}
+
+// blockFees computes the proposer value of the block, via the configured fee
+// calculator if there is one.
+func (w *worker) blockFees(block *types.Block, receipts []*types.Receipt) *big.Int {
+	var fees *big.Int
+	if calc := w.config.FeeCalculator; calc != nil {
+		fees = calc.Fees(block, receipts)
+	} else {
+		fees = totalFees(block, receipts)
+	}
+	if reward := w.blockReward(block.Header()); reward != nil {
+		fees = new(big.Int).Add(fees, reward)
+	}
+	return fees
+}
+
+// blockReward returns the custom subsidy of the block with the given header, nil
+// if there is none.
+func (w *worker) blockReward(header *types.Header) *big.Int {
+	if w.reward == nil {
+		return nil
+	}
+	if reward := w.reward(header); reward != nil && reward.Sign() > 0 {
+		return reward
+	}
+	return nil
+}
+
+// uncleReward measures the extra reward credited to the coinbase by the consensus
+// engine for including the uncles of the block, by finalizing the block with and
+// without them on throwaway copies of the state.
+func (w *worker) uncleReward(env *environment) *big.Int {
+	with, without := env.state.Copy(), env.state.Copy()
+	w.engine.Finalize(w.chain, types.CopyHeader(env.header), with, env.txs, env.unclelist())
+	w.engine.Finalize(w.chain, types.CopyHeader(env.header), without, env.txs, nil)
+	return new(big.Int).Sub(with.GetBalance(env.coinbase), without.GetBalance(env.coinbase))
 }
 
 // prepareWork constructs the sealing task according to the given parameters,
@@ -1005,15 +1596,22 @@ func (w *worker) prepareWork(genParams *generateParams) (*environment, error) {
 	if !genParams.noExtra && len(w.extra) != 0 {
 		header.Extra = w.extra
 	}
+	if genParams.extra != nil {
+		header.Extra = genParams.extra
+	}
 	// Set the randomness field from the beacon chain if it's available.
 	if genParams.random != (common.Hash{}) {
 		header.MixDigest = genParams.random
 	}
 	// Set baseFee and GasLimit if we are on an EIP-1559 chain
 	if w.chainConfig.IsLondon(header.Number) {
-		header.BaseFee = misc.CalcBaseFee(w.chainConfig, parent.Header())
+		feeConfig := w.chainConfig
+		if genParams.feeConfig != nil {
+			feeConfig = genParams.feeConfig
+		}
+		header.BaseFee = misc.CalcBaseFee(feeConfig, parent.Header())
 		if !w.chainConfig.IsLondon(parent.Number()) {
-			parentGasLimit := parent.GasLimit() * params.ElasticityMultiplier
+			parentGasLimit := parent.GasLimit() * feeConfig.ElasticityMultiplier()
 			header.GasLimit = core.CalcGasLimit(parentGasLimit, w.config.GasCeil)
 		}
 	}
@@ -1022,6 +1620,16 @@ func (w *worker) prepareWork(genParams *generateParams) (*environment, error) {
 		log.Error("Failed to prepare header for sealing", "err", err)
 		return nil, err
 	}
+	// The consensus layer expects the exact timestamp requested, never let the
+	// engine adjust it silently.
+	if genParams.forceTime && header.Time != timestamp {
+		return nil, fmt.Errorf("%w: requested %d, have %d", errTimestampAdjusted, timestamp, header.Time)
+	}
+	// Replace the derived base fee with the oracle one if it's configured, as
+	// long as the header stays valid per the chain rules.
+	if oracle := w.config.BaseFeeOracle; oracle != nil && header.BaseFee != nil {
+		w.applyBaseFeeOracle(oracle, parent.Header(), header)
+	}
 	// Could potentially happen if starting to mine in an odd state.
 	// Note genParams.coinbase can be different with header.Coinbase
 	// since clique algorithm can modify the coinbase field in header.
@@ -1030,6 +1638,38 @@ func (w *worker) prepareWork(genParams *generateParams) (*environment, error) {
 		log.Error("Failed to create sealing context", "err", err)
 		return nil, err
 	}
+	env.excluded, env.valuer, env.scorer, env.txTypes = genParams.excluded, genParams.valuer, genParams.scorer, genParams.txTypes
+	env.allowed, env.minTxAge, env.pending, env.diagnose = genParams.allowed, genParams.minTxAge, genParams.pending, genParams.diagnose
+	env.minPrice, env.senderCap, env.disabled = genParams.minPrice, genParams.senderCap, genParams.disabled
+	env.relayFloor = genParams.relayFloor
+	env.dataCap = w.config.MaxCalldataBytes
+
+	// Require the transactions to afford a higher base fee than the actual one
+	// if a margin is configured, so that they're still valid if the base fee in
+	// effect turns out higher than expected.
+	if margin := w.config.AffordabilityMargin; margin > 0 && header.BaseFee != nil && !genParams.relaxed {
+		floor := new(big.Int).Mul(header.BaseFee, new(big.Int).SetUint64(100+margin))
+		env.feeFloor = floor.Div(floor, big.NewInt(100))
+	}
+
+	// Apply the state overrides to the sealing state, it's a private copy of
+	// the parent state which is never committed.
+	if err := genParams.overrides.apply(env.state); err != nil {
+		env.discard()
+		return nil, err
+	}
+
+	// Reset the splice cache if it's built on a different header, e.g. the gas
+	// limit is changed in between. It's not applicable with the seed transaction,
+	// the deposits or the bundles since the cached prefix is assumed to start
+	// from the empty block.
+	if cache := genParams.splice; cache != nil && genParams.seedTx == nil && len(genParams.deposits) == 0 && len(genParams.bundles) == 0 {
+		if hash := header.Hash(); cache.header != hash {
+			*cache = spliceCache{header: hash}
+		}
+		env.splice = cache
+	}
+
 	// Accumulate the uncles for the sealing work only if it's allowed.
 	if !genParams.noUncle {
 		commitUncles := func(blocks map[common.Hash]*types.Block) {
@@ -1048,6 +1688,13 @@ func (w *worker) prepareWork(genParams *generateParams) (*environment, error) {
 		commitUncles(w.localUncles)
 		commitUncles(w.remoteUncles)
 	}
+	// Include the explicitly specified uncles, none of them may be dropped.
+	for _, uncle := range genParams.uncles {
+		if err := w.commitUncle(env, uncle); err != nil {
+			env.discard()
+			return nil, fmt.Errorf("invalid uncle %x: %v", uncle.Hash(), err)
+		}
+	}
 	return env, nil
 }
 
@@ -1055,8 +1702,80 @@ func (w *worker) prepareWork(genParams *generateParams) (*environment, error) {
 // into the given sealing block. The transaction selection and ordering strategy can
 // be customized with the plugin in the future.
 func (w *worker) fillTransactions(interrupt *int32, env *environment) error {
-	// Split the pending transactions into locals and remotes
-	// Fill the block with all available pending transactions.
+	// Fill the block with all available pending transactions, or the frozen
+	// ones if the snapshot is specified.
+	var localTxs, remoteTxs map[common.Address]types.Transactions
+	if env.pending != nil {
+		localTxs, remoteTxs = env.pending.copy()
+	} else {
+		localTxs, remoteTxs = w.pendingTxs()
+	}
+	if env.diagnose {
+		env.view = newMempoolView(localTxs, remoteTxs, env.header.BaseFee)
+	}
+	if w.config.Prefetch {
+		defer w.prefetchTransactions(env, localTxs, remoteTxs)()
+	}
+	included := len(env.txs)
+
+	// The pending sets are consumed by the ordering, sum up the gas beforehand.
+	var drainCap uint64
+	if fraction := w.config.MaxMempoolFraction; fraction > 0 && fraction < 1 {
+		var total uint64
+		for _, group := range []map[common.Address]types.Transactions{localTxs, remoteTxs} {
+			for _, list := range group {
+				for _, tx := range list {
+					total += tx.Gas()
+				}
+			}
+		}
+		drainCap = uint64(float64(total) * fraction)
+		if drainCap == 0 {
+			drainCap = 1 // include at least one transaction
+		}
+	}
+	var sets []*types.TransactionsByPriceAndNonce
+	if len(localTxs) > 0 {
+		sets = append(sets, types.NewTransactionsByPriorityAndNonce(env.signer, localTxs, env.header.BaseFee, w.config.PriorityBid, env.valuer, env.scorer))
+	}
+	if len(remoteTxs) > 0 {
+		sets = append(sets, types.NewTransactionsByPriorityAndNonce(env.signer, remoteTxs, env.header.BaseFee, w.config.PriorityBid, env.valuer, env.scorer))
+	}
+	// Skip the execution of the unchanged prefix of the last build if possible.
+	if env.splice != nil {
+		if err := w.spliceTransactions(env, sets); err != nil {
+			return err
+		}
+		defer func() {
+			env.splice.txs = append([]*types.Transaction(nil), env.txs...)
+		}()
+	}
+	// Cap the gas drained from the pending set, counting the spliced prefix.
+	if drainCap > 0 {
+		env.drainCap, env.drained = drainCap, 0
+		for _, tx := range env.txs[included:] {
+			env.drained += tx.Gas()
+		}
+	}
+	for _, txs := range sets {
+		if err := w.commitTransactions(env, txs, interrupt); err != nil {
+			return err
+		}
+	}
+	// Flag the suspicious condition that none of the pending transactions can be
+	// included, e.g. due to a corrupted state or an unaffordable base fee.
+	if len(sets) > 0 && len(env.txs) == included {
+		log.Debug("No pending transaction is included", "number", env.header.Number, "senders", len(localTxs)+len(remoteTxs))
+		starvedBlockMeter.Mark(1)
+		env.starved = true
+	}
+	return nil
+}
+
+// pendingTxs retrieves the pending transactions from the txpool, split into
+// locals and remotes. The private transactions are merged in if the source is
+// configured, they are never handed to the txpool.
+func (w *worker) pendingTxs() (map[common.Address]types.Transactions, map[common.Address]types.Transactions) {
 	pending := w.eth.TxPool().Pending(true)
 	localTxs, remoteTxs := make(map[common.Address]types.Transactions), pending
 	for _, account := range w.eth.TxPool().Locals() {
@@ -1065,17 +1784,233 @@ func (w *worker) fillTransactions(interrupt *int32, env *environment) error {
 			localTxs[account] = txs
 		}
 	}
-	if len(localTxs) > 0 {
-		txs := types.NewTransactionsByPriceAndNonce(env.signer, localTxs, env.header.BaseFee)
-		if err := w.commitTransactions(env, txs, interrupt); err != nil {
-			return err
+	if source := w.config.PrivateTxs; source != nil {
+		for addr, txs := range source.Pending() {
+			if _, ok := localTxs[addr]; ok {
+				localTxs[addr] = mergeTxs(txs, localTxs[addr])
+			} else {
+				remoteTxs[addr] = mergeTxs(txs, remoteTxs[addr])
+			}
 		}
 	}
-	if len(remoteTxs) > 0 {
-		txs := types.NewTransactionsByPriceAndNonce(env.signer, remoteTxs, env.header.BaseFee)
-		if err := w.commitTransactions(env, txs, interrupt); err != nil {
-			return err
+	return localTxs, remoteTxs
+}
+
+// mergeTxs merges the private transactions of an account with the public ones
+// into a nonce-sorted list. The private one takes precedence if both of them
+// have the same nonce.
+func mergeTxs(private, public types.Transactions) types.Transactions {
+	nonces := make(map[uint64]struct{}, len(private))
+	merged := make(types.Transactions, 0, len(private)+len(public))
+	for _, tx := range private {
+		nonces[tx.Nonce()] = struct{}{}
+		merged = append(merged, tx)
+	}
+	for _, tx := range public {
+		if _, ok := nonces[tx.Nonce()]; !ok {
+			merged = append(merged, tx)
+		}
+	}
+	sort.Sort(types.TxByNonce(merged))
+	return merged
+}
+
+// snapshotPending freezes the current pending transactions of the txpool, the
+// payloads can be built against the snapshot instead of the live txpool.
+func (w *worker) snapshotPending() *PendingSnapshot {
+	locals, remotes := w.pendingTxs()
+	return &PendingSnapshot{locals: locals, remotes: remotes}
+}
+
+// spliceTransactions restores the execution state of the longest transaction
+// prefix of the last build that the given transaction sets would reproduce. The
+// sets are advanced past the prefix. The outcome is identical to the one built
+// from scratch, since the header and the parent state are unchanged.
+func (w *worker) spliceTransactions(env *environment, sets []*types.TransactionsByPriceAndNonce) error {
+	cache := env.splice
+
+	// Find the unchanged prefix, the transactions are only reproduced if they
+	// are picked in exactly the same order.
+	var n int
+	for _, txs := range sets {
+		for n < len(cache.txs) {
+			tx := txs.Peek()
+			if tx == nil || tx.Hash() != cache.txs[n].Hash() {
+				break
+			}
+			txs.Shift()
+			n++
+		}
+		if n < len(cache.txs) && txs.Peek() != nil {
+			break
+		}
+	}
+	// Restore the closest checkpoint and drop the stale ones after the prefix.
+	index := n / spliceCheckpointInterval
+	if index > len(cache.checkpoints) {
+		index = len(cache.checkpoints)
+	}
+	cache.checkpoints = cache.checkpoints[:index]
+	if index > 0 {
+		// The checkpoint was taken by the previous build, keep the fields
+		// describing this one and drop the stale stalled accounts.
+		pending, diagnose, view := env.pending, env.diagnose, env.view
+
+		env.discard()
+		*env = *cache.checkpoints[index-1].copy()
+		env.pending, env.diagnose, env.view, env.stalled = pending, diagnose, view, nil
+	}
+	// Re-execute the rest of the prefix on top.
+	for _, tx := range cache.txs[env.tcount:n] {
+		env.state.Prepare(tx.Hash(), env.tcount)
+		if _, err := w.commitTransaction(env, tx); err != nil {
+			return fmt.Errorf("failed to splice transaction %v: %w", tx.Hash(), err)
+		}
+		env.tcount++
+		env.checkpoint()
+	}
+	if n > 0 {
+		log.Trace("Spliced payload transactions", "reused", n, "checkpoint", index*spliceCheckpointInterval)
+	}
+	return nil
+}
+
+// appendTransactions includes the given transactions at the end of the block in
+// order. An error is returned if any of them can't fit in the block, or fails to
+// be applied or reverts.
+func (w *worker) appendTransactions(env *environment, txs []*types.Transaction) error {
+	if env.gasPool == nil {
+		env.gasPool = new(core.GasPool).AddGas(env.header.GasLimit)
+	}
+	for _, tx := range txs {
+		env.state.Prepare(tx.Hash(), env.tcount)
+		if _, err := w.commitTransaction(env, tx); err != nil {
+			return fmt.Errorf("failed to append transaction %v: %w", tx.Hash(), err)
+		}
+		env.tcount++
+		if receipt := env.receipts[len(env.receipts)-1]; receipt.Status == types.ReceiptStatusFailed {
+			return fmt.Errorf("%w: %v", errAppendTxReverted, tx.Hash())
+		}
+	}
+	return nil
+}
+
+// commitBundle includes the transactions of the bundle at the end of the block
+// in order. The block is rolled back to the state before the bundle if any of
+// them fails to be applied, or reverts without being allowed to. The bundle is
+// rejected as a whole if any of them pays below the relay floor.
+func (w *worker) commitBundle(env *environment, bundle *Bundle) error {
+	if env.gasPool == nil {
+		env.gasPool = new(core.GasPool).AddGas(env.header.GasLimit)
+	}
+	// The journal is flushed after each transaction, so the whole state has to
+	// be backed up for reverting multiple ones.
+	var (
+		backup   = env.state.Copy()
+		gasPool  = *env.gasPool
+		gasUsed  = env.header.GasUsed
+		included = len(env.txs)
+		tcount   = env.tcount
+	)
+	rollback := func() {
+		env.state.StopPrefetcher()
+		env.state = backup
+		*env.gasPool, env.header.GasUsed = gasPool, gasUsed
+		env.txs, env.receipts, env.tcount = env.txs[:included], env.receipts[:included], tcount
+	}
+	mayRevert := make(map[common.Hash]struct{}, len(bundle.MayRevert))
+	for _, hash := range bundle.MayRevert {
+		mayRevert[hash] = struct{}{}
+	}
+	if env.relayFloor != nil {
+		for _, tx := range bundle.Txs {
+			if price := effectiveGasPrice(tx, env.header.BaseFee); price.Cmp(env.relayFloor) < 0 {
+				return fmt.Errorf("bundle transaction %v priced %v below relay floor %v", tx.Hash(), price, env.relayFloor)
+			}
+		}
+	}
+	for _, tx := range bundle.Txs {
+		env.state.Prepare(tx.Hash(), env.tcount)
+		if _, err := w.commitTransaction(env, tx); err != nil {
+			rollback()
+			return fmt.Errorf("failed to include bundle transaction %v: %w", tx.Hash(), err)
+		}
+		env.tcount++
+		if receipt := env.receipts[len(env.receipts)-1]; receipt.Status == types.ReceiptStatusFailed {
+			if _, ok := mayRevert[tx.Hash()]; !ok {
+				rollback()
+				return fmt.Errorf("%w: %v", errBundleTxReverted, tx.Hash())
+			}
+		}
+	}
+	return nil
+}
+
+// finalizeTxs passes the transactions filled into the block since the given pre-
+// filling environment through the configured hook. If the hook rewrites them,
+// the new list is validated and re-executed on top of the pre-filling state,
+// replacing the filled one. Otherwise, or if the new list is rejected, the block
+// is left untouched.
+func (w *worker) finalizeTxs(base, env *environment) {
+	filled := env.txs[len(base.txs):]
+	txs := w.config.FinalizeTxs(append([]*types.Transaction(nil), filled...))
+	if sameTxs(txs, filled) {
+		return
+	}
+	if err := validateFinalTxs(env.signer, filled, txs); err != nil {
+		log.Warn("Rejected rewritten transaction list", "err", err)
+		return
+	}
+	if base.gasPool == nil {
+		base.gasPool = new(core.GasPool).AddGas(base.header.GasLimit)
+	}
+	for _, tx := range txs {
+		base.state.Prepare(tx.Hash(), base.tcount)
+		if _, err := w.commitTransaction(base, tx); err != nil {
+			log.Warn("Rejected rewritten transaction list", "hash", tx.Hash(), "err", err)
+			return
+		}
+		base.tcount++
+	}
+	// Swap the states, so that the discarded one is released by the caller.
+	env.state, base.state = base.state, env.state
+	env.txs, env.receipts, env.tcount = base.txs, base.receipts, base.tcount
+	env.gasPool, env.header.GasUsed = base.gasPool, base.header.GasUsed
+}
+
+// sameTxs reports whether the two transaction lists are identical.
+func sameTxs(a, b []*types.Transaction) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Hash() != b[i].Hash() {
+			return false
+		}
+	}
+	return true
+}
+
+// validateFinalTxs checks that the rewritten transaction list only includes the
+// original transactions, each at most once, and that the transactions of every
+// sender stay in the nonce order. The gas limit is enforced by the re-execution.
+func validateFinalTxs(signer types.Signer, original, rewritten []*types.Transaction) error {
+	known := make(map[common.Hash]struct{}, len(original))
+	for _, tx := range original {
+		known[tx.Hash()] = struct{}{}
+	}
+	nonces := make(map[common.Address]uint64)
+	for _, tx := range rewritten {
+		if _, ok := known[tx.Hash()]; !ok {
+			return fmt.Errorf("unknown or duplicate transaction %x", tx.Hash())
+		}
+		delete(known, tx.Hash())
+
+		from, _ := types.Sender(signer, tx)
+		if last, ok := nonces[from]; ok && tx.Nonce() <= last {
+			return fmt.Errorf("transaction %x of %x out of nonce order", tx.Hash(), from)
 		}
+		nonces[from] = tx.Nonce()
 	}
 	return nil
 }
@@ -1088,23 +2023,241 @@ func (w *worker) generateWork(params *generateParams) (*types.Block, *big.Int, e
 	}
 	defer work.discard()
 
+	var start, fees *big.Int
+	if params.payout != nil {
+		start = work.state.GetBalance(work.coinbase)
+	}
+	// Track the balance of the fee recipient, namely the payout one if the
+	// profit is transferred, for measuring its gain in the block.
+	recipient := work.coinbase
+	if params.payout != nil {
+		recipient = *params.payout
+	}
+	before := new(big.Int).Set(work.state.GetBalance(recipient))
+
+	// Include the deposits at the very top, in both the empty and full blocks.
+	if len(params.deposits) > 0 {
+		if err := w.appendTransactions(work, params.deposits); err != nil {
+			return nil, nil, fmt.Errorf("failed to include deposits: %w", err)
+		}
+	}
+	// Include the seed transaction first, in both the empty and full blocks.
+	if params.seedTx != nil {
+		if err := w.appendTransactions(work, []*types.Transaction{params.seedTx}); err != nil {
+			return nil, nil, fmt.Errorf("failed to include seed transaction: %w", err)
+		}
+	}
 	if !params.noTxs {
-		interrupt := new(int32)
+		// Use the external interrupt signal if it's provided, the timeout is
+		// only signalled if no other interruption is fired yet.
+		interrupt := params.interrupt
+		if interrupt == nil {
+			interrupt = new(int32)
+		}
 		timer := time.AfterFunc(w.newpayloadTimeout, func() {
-			atomic.StoreInt32(interrupt, commitInterruptTimeout)
+			atomic.CompareAndSwapInt32(interrupt, commitInterruptNone, commitInterruptTimeout)
 		})
 		defer timer.Stop()
 
+		w.trackSealingInterrupt(interrupt, work.header.ParentHash)
+		defer w.untrackSealingInterrupt(interrupt)
+
+		if w.fillHook != nil {
+			w.fillHook()
+		}
+		// Withhold the gas beyond the target for good if it's lower than the gas
+		// limit, the rest of the block is built as if the limit was the target.
+		if target := params.gasTarget; target > 0 && target < work.header.GasLimit {
+			if work.gasPool == nil {
+				work.gasPool = new(core.GasPool).AddGas(work.header.GasLimit)
+			}
+			var allowed uint64
+			if used := work.header.GasLimit - work.gasPool.Gas(); used < target {
+				allowed = target - used
+			}
+			if gas := work.gasPool.Gas(); gas > allowed {
+				work.gasPool.SubGas(gas - allowed)
+			}
+		}
+		// Reserve the gas for the trailing transactions in advance, namely the
+		// appended ones and the payout, so that the txpool can't exhaust it.
+		appendGas, payoutGas := params.reserveGas, uint64(0)
+		if params.payout != nil {
+			payoutGas = feeRecipientProbeGas
+		}
+		if appendGas+payoutGas > 0 {
+			if work.gasPool == nil {
+				work.gasPool = new(core.GasPool).AddGas(work.header.GasLimit)
+			}
+			if err := work.gasPool.SubGas(appendGas + payoutGas); err != nil {
+				appendGas, payoutGas = 0, 0 // not enough room anyway, don't bother
+			}
+		}
+		for i, bundle := range params.bundles {
+			if err := w.commitBundle(work, bundle); err != nil {
+				log.Debug("Dropped payload bundle", "index", i, "txs", len(bundle.Txs), "err", err)
+			}
+		}
+		// Keep the state before the filling for re-executing the rewritten list.
+		var prefill *environment
+		if w.config.FinalizeTxs != nil {
+			prefill = work.copy()
+		}
 		err := w.fillTransactions(interrupt, work)
+		if prefill != nil {
+			if err == nil {
+				w.finalizeTxs(prefill, work)
+			}
+			prefill.discard()
+		}
 		if errors.Is(err, errBlockInterruptedByTimeout) {
 			log.Warn("Block building is interrupted", "allowance", common.PrettyDuration(w.newpayloadTimeout))
 		}
+		if report := params.report; report != nil {
+			switch {
+			case err != nil:
+				report.stop = FillStopInterrupted
+			case work.gasLimited:
+				report.stop = FillStopGasLimit
+			default:
+				report.stop = FillStopTxsExhausted
+			}
+			report.stalled, report.view, report.starved = work.stalled, work.view, work.starved
+		}
+		// The block is obsolete if a new payload is requested, discard it.
+		if errors.Is(err, errBlockInterruptedByPayload) {
+			return nil, nil, err
+		}
+		if appendGas > 0 {
+			work.gasPool.AddGas(appendGas)
+		}
+		if err := w.appendTransactions(work, params.appendTxs); err != nil {
+			return nil, nil, err
+		}
+		// Pay the profit to the recipient, which is the value of the block then.
+		if params.payout != nil {
+			if payoutGas > 0 {
+				work.gasPool.AddGas(payoutGas)
+			}
+			value, err := w.commitPayout(work, start, *params.payout)
+			if err != nil {
+				return nil, nil, err
+			}
+			fees = value
+		}
+	}
+	// Measure the inclusion reward of the explicit uncles before finalizing, the
+	// builder keeps it in the payout mode like the other engine rewards.
+	var uncleReward *big.Int
+	if len(params.uncles) > 0 && params.payout == nil {
+		uncleReward = w.uncleReward(work)
 	}
 	block, err := w.engine.FinalizeAndAssemble(w.chain, work.header, work.state, work.txs, work.unclelist(), work.receipts)
 	if err != nil {
 		return nil, nil, err
 	}
-	return block, totalFees(block, work.receipts), nil
+	if fees == nil {
+		fees = w.blockFees(block, work.receipts)
+	}
+	if uncleReward != nil && uncleReward.Sign() > 0 {
+		fees = new(big.Int).Add(fees, uncleReward)
+	}
+	if report := params.report; report != nil && !params.noTxs {
+		report.receipts = work.receipts
+		report.gain = new(big.Int).Sub(work.state.GetBalance(recipient), before)
+	}
+	if params.onIncluded != nil && !params.noTxs {
+		notifyIncluded(block, work.receipts, params.onIncluded)
+	}
+	return block, fees, nil
+}
+
+// commitPayout transfers the block profit accrued to the coinbase since the given
+// starting balance to the recipient, with a transaction signed by the builder key
+// at the end of the block. It returns the value paid, which is zero if the profit
+// can't even cover the cost of the transfer itself.
+func (w *worker) commitPayout(env *environment, start *big.Int, recipient common.Address) (*big.Int, error) {
+	var (
+		gas      = params.TxGas
+		gasPrice = new(big.Int)
+	)
+	if env.state.GetCodeSize(recipient) > 0 {
+		gas = feeRecipientProbeGas
+	}
+	if env.header.BaseFee != nil {
+		gasPrice = env.header.BaseFee
+	}
+	value := new(big.Int).Sub(env.state.GetBalance(env.coinbase), start)
+	value.Sub(value, new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(gas)))
+	if value.Sign() <= 0 {
+		return new(big.Int), nil
+	}
+	var txdata types.TxData
+	if env.header.BaseFee != nil {
+		txdata = &types.DynamicFeeTx{
+			ChainID:   w.chainConfig.ChainID,
+			Nonce:     env.state.GetNonce(env.coinbase),
+			GasTipCap: new(big.Int),
+			GasFeeCap: gasPrice,
+			Gas:       gas,
+			To:        &recipient,
+			Value:     value,
+		}
+	} else {
+		txdata = &types.LegacyTx{
+			Nonce:    env.state.GetNonce(env.coinbase),
+			GasPrice: gasPrice,
+			Gas:      gas,
+			To:       &recipient,
+			Value:    value,
+		}
+	}
+	tx, err := types.SignNewTx(w.builderKey, env.signer, txdata)
+	if err != nil {
+		return nil, err
+	}
+	env.state.Prepare(tx.Hash(), env.tcount)
+	if _, err := w.commitTransaction(env, tx); err != nil {
+		return nil, fmt.Errorf("failed to commit payout transaction: %w", err)
+	}
+	env.tcount++
+	if receipt := env.receipts[len(env.receipts)-1]; receipt.Status == types.ReceiptStatusFailed {
+		return nil, errPayoutReverted
+	}
+	return value, nil
+}
+
+// trackSealingInterrupt registers the interrupt signal of an in-flight payload
+// generation on top of the given parent.
+func (w *worker) trackSealingInterrupt(interrupt *int32, parent common.Hash) {
+	w.sealingMu.Lock()
+	defer w.sealingMu.Unlock()
+
+	w.sealingInterrupts[interrupt] = parent
+}
+
+// untrackSealingInterrupt deregisters the interrupt signal of a finished payload
+// generation.
+func (w *worker) untrackSealingInterrupt(interrupt *int32) {
+	w.sealingMu.Lock()
+	defer w.sealingMu.Unlock()
+
+	delete(w.sealingInterrupts, interrupt)
+}
+
+// interruptSealing aborts the in-flight payload generations built on top of any
+// parent other than the given head, so that the new payload can be built without
+// waiting for the obsolete ones. The generations on the head, e.g. the sibling
+// payloads or the rebuilds for the same slot, are left running.
+func (w *worker) interruptSealing(head common.Hash) {
+	w.sealingMu.Lock()
+	defer w.sealingMu.Unlock()
+
+	for interrupt, parent := range w.sealingInterrupts {
+		if parent != head {
+			atomic.StoreInt32(interrupt, commitInterruptNewPayload)
+		}
+	}
 }
 
 // commitWork generates several new sealing tasks based on the parent block
@@ -1216,18 +2369,9 @@ func (w *worker) commit(env *environment, interval func(), update bool, start ti
 // getSealingBlock generates the sealing block based on the given parameters.
 // The generation result will be passed back via the given channel no matter
 // the generation itself succeeds or not.
-func (w *worker) getSealingBlock(parent common.Hash, timestamp uint64, coinbase common.Address, random common.Hash, noTxs bool) (*types.Block, *big.Int, error) {
+func (w *worker) getSealingBlock(params *generateParams) (*types.Block, *big.Int, error) {
 	req := &getWorkReq{
-		params: &generateParams{
-			timestamp:  timestamp,
-			forceTime:  true,
-			parentHash: parent,
-			coinbase:   coinbase,
-			random:     random,
-			noUncle:    true,
-			noExtra:    true,
-			noTxs:      noTxs,
-		},
+		params: params,
 		result: make(chan *newPayloadResult, 1),
 	}
 	select {
@@ -1277,6 +2421,86 @@ func totalFees(block *types.Block, receipts []*types.Receipt) *big.Int {
 	return feesWei
 }
 
+// effectiveGasPrice returns the gas price the transaction actually pays in a block
+// with the given base fee, i.e. the base fee plus the effective tip, capped by the
+// fee cap. It's the plain gas price for the blocks before London.
+func effectiveGasPrice(tx *types.Transaction, baseFee *big.Int) *big.Int {
+	if baseFee == nil {
+		return tx.GasPrice()
+	}
+	return math.BigMin(tx.GasFeeCap(), new(big.Int).Add(baseFee, tx.GasTipCap()))
+}
+
+// isExcluded reports whether the sender or the recipient of a transaction is
+// excluded from the sealing block.
+func isExcluded(env *environment, from common.Address, to *common.Address) bool {
+	if len(env.excluded) == 0 {
+		return false
+	}
+	if _, ok := env.excluded[from]; ok {
+		return true
+	}
+	if to != nil {
+		if _, ok := env.excluded[*to]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// exclusionTracer watches the addresses touched by a transaction execution, and
+// cancels the execution as soon as any excluded one is touched. An address is
+// touched if it's the sender, the target of any call frame or creation, or the
+// operand of the account inspecting opcodes. Unlike the EIP-2929 access list,
+// the addresses only declared by the transaction or warmed up by the fork, e.g.
+// the precompiled contracts, don't count as touched.
+type exclusionTracer struct {
+	excluded map[common.Address]struct{}
+	evm      *vm.EVM
+	touched  bool
+}
+
+// touch marks the address as touched by the execution.
+func (t *exclusionTracer) touch(addr common.Address) {
+	if t.touched {
+		return
+	}
+	if _, ok := t.excluded[addr]; ok {
+		t.touched = true
+		t.evm.Cancel()
+	}
+}
+
+func (t *exclusionTracer) CaptureTxStart(gasLimit uint64) {}
+
+func (t *exclusionTracer) CaptureTxEnd(restGas uint64) {}
+
+func (t *exclusionTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	t.evm = env
+	t.touch(from)
+	t.touch(to)
+}
+
+func (t *exclusionTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) {}
+
+func (t *exclusionTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	t.touch(to)
+}
+
+func (t *exclusionTracer) CaptureExit(output []byte, gasUsed uint64, err error) {}
+
+func (t *exclusionTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	switch op {
+	case vm.BALANCE, vm.EXTCODESIZE, vm.EXTCODECOPY, vm.EXTCODEHASH, vm.SELFDESTRUCT:
+		if data := scope.Stack.Data(); len(data) > 0 {
+			t.touch(common.Address(data[len(data)-1].Bytes20()))
+		}
+	}
+}
+
+func (t *exclusionTracer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
+}
+
 // signalToErr converts the interruption signal to a concrete error type for return.
 // The given signal must be a valid interruption signal.
 func signalToErr(signal int32) error {
@@ -1287,6 +2511,10 @@ func signalToErr(signal int32) error {
 		return errBlockInterruptedByRecommit
 	case commitInterruptTimeout:
 		return errBlockInterruptedByTimeout
+	case commitInterruptNewPayload:
+		return errBlockInterruptedByPayload
+	case commitInterruptResolve:
+		return errBlockInterruptedByResolve
 	default:
 		panic(fmt.Errorf("undefined signal %d", signal))
 	}
@@ -20,6 +20,7 @@ import (
 	"errors"
 	"math/big"
 	"math/rand"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -27,6 +28,7 @@ import (
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/beacon"
 	"github.com/ethereum/go-ethereum/consensus/clique"
 	"github.com/ethereum/go-ethereum/consensus/ethash"
 	"github.com/ethereum/go-ethereum/core"
@@ -39,6 +41,7 @@ import (
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
 const (
@@ -130,7 +133,7 @@ func newTestWorkerBackend(t *testing.T, chainConfig *params.ChainConfig, engine
 		e.Authorize(testBankAddress, func(account accounts.Account, s string, data []byte) ([]byte, error) {
 			return crypto.Sign(crypto.Keccak256(data), testBankKey)
 		})
-	case *ethash.Ethash:
+	case *ethash.Ethash, *beacon.Beacon, *rewardEngine:
 	default:
 		t.Fatalf("unexpected consensus engine type: %T", engine)
 	}
@@ -203,9 +206,13 @@ func (b *testWorkerBackend) newRandomTx(creation bool) *types.Transaction {
 }
 
 func newTestWorker(t *testing.T, chainConfig *params.ChainConfig, engine consensus.Engine, db ethdb.Database, blocks int) (*worker, *testWorkerBackend) {
+	return newTestWorkerWithConfig(t, testConfig, chainConfig, engine, db, blocks)
+}
+
+func newTestWorkerWithConfig(t *testing.T, config *Config, chainConfig *params.ChainConfig, engine consensus.Engine, db ethdb.Database, blocks int) (*worker, *testWorkerBackend) {
 	backend := newTestWorkerBackend(t, chainConfig, engine, db, blocks)
 	backend.txPool.AddLocals(pendingTxs)
-	w := newWorker(testConfig, chainConfig, engine, backend, new(event.TypeMux), nil, false)
+	w := newWorker(config, chainConfig, engine, backend, new(event.TypeMux), nil, false)
 	w.setEtherbase(testBankAddress)
 	return w, backend
 }
@@ -541,6 +548,48 @@ func TestGetSealingWorkPostMerge(t *testing.T) {
 	testGetSealingWork(t, local, ethash.NewFaker())
 }
 
+func TestGetSealingWorkDifficulty(t *testing.T) {
+	var tests = []struct {
+		ttd    *big.Int
+		merged bool
+	}{
+		{nil, false},
+		{new(big.Int).Lsh(common.Big1, 60), false},
+		{common.Big0, true},
+	}
+	for i, test := range tests {
+		config := new(params.ChainConfig)
+		*config = *ethashChainConfig
+		config.TerminalTotalDifficulty = test.ttd
+
+		engine := beacon.New(ethash.NewFaker())
+		w, b := newTestWorker(t, config, engine, rawdb.NewMemoryDatabase(), 0)
+
+		parent := b.chain.CurrentBlock()
+		block, _, err := w.getSealingBlock(&generateParams{
+			timestamp:  parent.Time() + 10,
+			parentHash: parent.Hash(),
+			coinbase:   testUserAddress,
+		})
+		w.close()
+		engine.Close()
+		if err != nil {
+			t.Fatalf("test %d: failed to generate block %v", i, err)
+		}
+		// The pre-merge difficulty is derived from the parent by the legacy rules
+		want := new(big.Int)
+		if !test.merged {
+			want = ethash.CalcDifficulty(config, block.Time(), parent.Header())
+		}
+		if want.Sign() == 0 && !test.merged {
+			t.Fatalf("test %d: zero pre-merge difficulty", i)
+		}
+		if block.Difficulty().Cmp(want) != 0 {
+			t.Errorf("test %d: unexpected difficulty, have %v, want %v", i, block.Difficulty(), want)
+		}
+	}
+}
+
 func testGetSealingWork(t *testing.T, chainConfig *params.ChainConfig, engine consensus.Engine) {
 	defer engine.Close()
 
@@ -637,7 +686,15 @@ func testGetSealingWork(t *testing.T, chainConfig *params.ChainConfig, engine co
 
 	// This API should work even when the automatic sealing is not enabled
 	for _, c := range cases {
-		block, _, err := w.getSealingBlock(c.parent, timestamp, c.coinbase, c.random, false)
+		block, _, err := w.getSealingBlock(&generateParams{
+			timestamp:  timestamp,
+			forceTime:  true,
+			parentHash: c.parent,
+			coinbase:   c.coinbase,
+			random:     c.random,
+			noUncle:    true,
+			noExtra:    true,
+		})
 		if c.expectErr {
 			if err == nil {
 				t.Error("Expect error but get nil")
@@ -653,7 +710,15 @@ func testGetSealingWork(t *testing.T, chainConfig *params.ChainConfig, engine co
 	// This API should work even when the automatic sealing is enabled
 	w.start()
 	for _, c := range cases {
-		block, _, err := w.getSealingBlock(c.parent, timestamp, c.coinbase, c.random, false)
+		block, _, err := w.getSealingBlock(&generateParams{
+			timestamp:  timestamp,
+			forceTime:  true,
+			parentHash: c.parent,
+			coinbase:   c.coinbase,
+			random:     c.random,
+			noUncle:    true,
+			noExtra:    true,
+		})
 		if c.expectErr {
 			if err == nil {
 				t.Error("Expect error but get nil")
@@ -666,3 +731,286 @@ func testGetSealingWork(t *testing.T, chainConfig *params.ChainConfig, engine co
 		}
 	}
 }
+
+func TestNextBaseFee(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	parent := b.chain.CurrentBlock()
+	baseFee, err := w.nextBaseFee(parent.Hash())
+	if err != nil {
+		t.Fatalf("Failed to compute base fee %v", err)
+	}
+	block, _, err := w.getSealingBlock(&generateParams{
+		timestamp:  parent.Time() + 1,
+		parentHash: parent.Hash(),
+		noTxs:      true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if block.BaseFee().Cmp(baseFee) != 0 {
+		t.Fatalf("Base fee mismatch, have %v, want %v", baseFee, block.BaseFee())
+	}
+	if _, err := w.nextBaseFee(common.Hash{0x01}); err == nil {
+		t.Fatal("Unknown parent is not rejected")
+	}
+}
+
+func TestParentBlockValue(t *testing.T) {
+	w, b := newTestWorker(t, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	parent := b.chain.CurrentBlock()
+	block, fees, err := w.getSealingBlock(&generateParams{
+		timestamp:  parent.Time() + 1,
+		parentHash: parent.Hash(),
+		coinbase:   testUserAddress,
+	})
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if len(block.Transactions()) == 0 || fees.Sign() <= 0 {
+		t.Fatalf("Unexpected block, txs %d, fees %v", len(block.Transactions()), fees)
+	}
+	if _, err := b.chain.InsertChain(types.Blocks{block}); err != nil {
+		t.Fatalf("Failed to insert block %v", err)
+	}
+	value, err := w.parentBlockValue(block.Hash())
+	if err != nil {
+		t.Fatalf("Failed to compute parent value %v", err)
+	}
+	if value.Cmp(fees) != 0 {
+		t.Fatalf("Parent value mismatch, have %v, want %v", value, fees)
+	}
+	if _, err := w.parentBlockValue(common.Hash{0x01}); err == nil {
+		t.Fatal("Unknown parent is not rejected")
+	}
+}
+
+// testFeeCalculator values the blocks by a flat rate per gas used, checking the
+// receipts are aligned with the transactions.
+type testFeeCalculator struct {
+	rate int64
+}
+
+func (c testFeeCalculator) Fees(block *types.Block, receipts []*types.Receipt) *big.Int {
+	if len(receipts) != len(block.Transactions()) {
+		return nil
+	}
+	var gas uint64
+	for i, receipt := range receipts {
+		if receipt.TxHash != block.Transactions()[i].Hash() {
+			return nil
+		}
+		gas += receipt.GasUsed
+	}
+	return new(big.Int).Mul(new(big.Int).SetUint64(gas), big.NewInt(c.rate))
+}
+
+func TestFeeCalculator(t *testing.T) {
+	config := *testConfig
+	config.FeeCalculator = testFeeCalculator{rate: 7}
+	w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+	defer w.close()
+
+	parent := b.chain.CurrentBlock()
+	block, fees, err := w.getSealingBlock(&generateParams{
+		timestamp:  parent.Time() + 1,
+		parentHash: parent.Hash(),
+		coinbase:   testUserAddress,
+	})
+	if err != nil {
+		t.Fatalf("Failed to generate block %v", err)
+	}
+	if len(block.Transactions()) == 0 {
+		t.Fatal("No transaction is included")
+	}
+	want := new(big.Int).Mul(new(big.Int).SetUint64(block.GasUsed()), big.NewInt(7))
+	if fees == nil || fees.Cmp(want) != 0 {
+		t.Fatalf("Unexpected fees, have %v, want %v", fees, want)
+	}
+	// The parent value is computed by the same calculator
+	if _, err := b.chain.InsertChain(types.Blocks{block}); err != nil {
+		t.Fatalf("Failed to insert block %v", err)
+	}
+	value, err := w.parentBlockValue(block.Hash())
+	if err != nil {
+		t.Fatalf("Failed to compute parent value %v", err)
+	}
+	if value.Cmp(want) != 0 {
+		t.Fatalf("Parent value mismatch, have %v, want %v", value, want)
+	}
+}
+
+// rewardEngine is a consensus engine minting the installed custom subsidy to
+// the coinbase in Finalize.
+type rewardEngine struct {
+	consensus.Engine
+	reward RewardFunc
+}
+
+func (e *rewardEngine) SetRewardFunc(reward RewardFunc) {
+	e.reward = reward
+}
+
+func (e *rewardEngine) Finalize(chain consensus.ChainHeaderReader, header *types.Header, state *state.StateDB, txs []*types.Transaction, uncles []*types.Header) {
+	e.Engine.Finalize(chain, header, state, txs, uncles)
+	if e.reward != nil {
+		if reward := e.reward(header); reward != nil {
+			state.AddBalance(header.Coinbase, reward)
+		}
+	}
+}
+
+func (e *rewardEngine) FinalizeAndAssemble(chain consensus.ChainHeaderReader, header *types.Header, state *state.StateDB, txs []*types.Transaction, uncles []*types.Header, receipts []*types.Receipt) (*types.Block, error) {
+	e.Finalize(chain, header, state, txs, uncles)
+	header.Root = state.IntermediateRoot(chain.Config().IsEIP158(header.Number))
+	return types.NewBlock(header, txs, uncles, receipts, trie.NewStackTrie(nil)), nil
+}
+
+func TestRewardFunc(t *testing.T) {
+	subsidy := big.NewInt(params.Ether)
+	build := func(engine consensus.Engine, reward RewardFunc) (*types.Block, *big.Int, *fillReport) {
+		config := *testConfig
+		config.RewardFunc = reward
+		w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, engine, rawdb.NewMemoryDatabase(), 0)
+		defer w.close()
+
+		parent := b.chain.CurrentBlock()
+		genParams := &generateParams{
+			timestamp:  parent.Time() + 1,
+			parentHash: parent.Hash(),
+			coinbase:   testUserAddress,
+			report:     new(fillReport),
+		}
+		block, fees, err := w.getSealingBlock(genParams)
+		if err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		// The engine verifying the chain must agree with the sealed block
+		if _, err := b.chain.InsertChain(types.Blocks{block}); err != nil {
+			t.Fatalf("Failed to import block %v", err)
+		}
+		return block, fees, genParams.report
+	}
+	reward := func(header *types.Header) *big.Int { return subsidy }
+	plain, plainFees, plainReport := build(&rewardEngine{Engine: ethash.NewFaker()}, nil)
+	block, fees, report := build(&rewardEngine{Engine: ethash.NewFaker()}, reward)
+
+	// The subsidy is minted to the coinbase and counted into the value
+	if want := new(big.Int).Add(plainFees, subsidy); fees.Cmp(want) != 0 {
+		t.Fatalf("Unexpected fees, have %v, want %v", fees, want)
+	}
+	if want := new(big.Int).Add(plainReport.gain, subsidy); report.gain.Cmp(want) != 0 {
+		t.Fatalf("Unexpected coinbase gain, have %v, want %v", report.gain, want)
+	}
+	if block.Root() == plain.Root() {
+		t.Fatal("Subsidy is not reflected in the state")
+	}
+	// The subsidy is ignored if the engine doesn't support it
+	unsupported, unsupportedFees, _ := build(ethash.NewFaker(), reward)
+	if unsupportedFees.Cmp(plainFees) != 0 || unsupported.Root() != plain.Root() {
+		t.Fatalf("Unsupported subsidy applied, fees %v, want %v", unsupportedFees, plainFees)
+	}
+}
+
+func TestMaxMempoolFraction(t *testing.T) {
+	var tests = []struct {
+		fraction float64
+		want     int
+	}{
+		{0, 2},
+		{1, 2},
+		{0.5, 1},
+		{0.6, 2}, // the cap is checked before adding a transaction
+		{0.01, 1},
+	}
+	for i, test := range tests {
+		config := *testConfig
+		config.MaxMempoolFraction = test.fraction
+		w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+		b.txPool.AddLocals(newTxs)
+
+		parent := b.chain.CurrentBlock()
+		block, _, err := w.getSealingBlock(&generateParams{
+			timestamp:  parent.Time() + 1,
+			parentHash: parent.Hash(),
+			coinbase:   testUserAddress,
+		})
+		w.close()
+		if err != nil {
+			t.Fatalf("test %d: failed to generate block %v", i, err)
+		}
+		if have := len(block.Transactions()); have != test.want {
+			t.Errorf("test %d: unexpected transactions with fraction %v, have %d, want %d", i, test.fraction, have, test.want)
+		}
+	}
+}
+
+// stallTracer stalls the execution once at the first opcode, standing in for a
+// computation expensive transaction regardless of the machine speed.
+type stallTracer struct {
+	once  sync.Once
+	delay time.Duration
+}
+
+func (t *stallTracer) CaptureTxStart(gasLimit uint64) {}
+func (t *stallTracer) CaptureTxEnd(restGas uint64)    {}
+func (t *stallTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+}
+func (t *stallTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) {}
+func (t *stallTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+}
+func (t *stallTracer) CaptureExit(output []byte, gasUsed uint64, err error) {}
+func (t *stallTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	t.once.Do(func() { time.Sleep(t.delay) })
+}
+func (t *stallTracer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
+}
+
+func TestTxExecutionTimeout(t *testing.T) {
+	var (
+		loopAddr = common.HexToAddress("0x100")
+		loopCode = []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0x00, byte(vm.JUMP)} // spin until out of gas
+		slowTx   = types.MustSignNewTx(testUserKey, types.LatestSigner(params.TestChainConfig), &types.LegacyTx{
+			To:       &loopAddr,
+			Gas:      1000000,
+			GasPrice: big.NewInt(params.InitialBaseFee),
+		})
+	)
+	for _, timeout := range []time.Duration{0, 10 * time.Millisecond} {
+		config := *testConfig
+		config.TxExecutionTimeout = timeout
+		config.PrivateTxs = testPrivateTxs{testUserAddress: types.Transactions{slowTx}}
+		w, b := newTestWorkerWithConfig(t, &config, params.TestChainConfig, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 0)
+		*b.chain.GetVMConfig() = vm.Config{Debug: true, Tracer: &stallTracer{delay: 20 * time.Millisecond}}
+
+		parent := b.chain.CurrentBlock()
+		block, _, err := w.getSealingBlock(&generateParams{
+			timestamp:  parent.Time() + 1,
+			parentHash: parent.Hash(),
+			coinbase:   testBankAddress,
+			overrides: StateOverride{
+				loopAddr:        {Code: loopCode},
+				testUserAddress: {Balance: big.NewInt(params.Ether)},
+			},
+		})
+		w.close()
+		if err != nil {
+			t.Fatalf("Failed to generate block %v", err)
+		}
+		// The slow transaction is only skipped with the timeout, the others are
+		// included regardless
+		var slow bool
+		for _, tx := range block.Transactions() {
+			slow = slow || tx.Hash() == slowTx.Hash()
+		}
+		if len(block.Transactions()) == 0 || slow != (timeout == 0) {
+			t.Fatalf("Unexpected block with timeout %v, txs %d, slow included %v", timeout, len(block.Transactions()), slow)
+		}
+		if timeout > 0 && block.GasUsed() != params.TxGas*uint64(len(block.Transactions())) {
+			t.Fatalf("Unexpected gas used, have %d, want %d", block.GasUsed(), params.TxGas*uint64(len(block.Transactions())))
+		}
+	}
+}
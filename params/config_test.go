@@ -87,6 +87,40 @@ func TestCheckCompatible(t *testing.T) {
 				RewindTo:     30,
 			},
 		},
+		{
+			stored:  &ChainConfig{LondonBlock: big.NewInt(30)},
+			new:     &ChainConfig{LondonBlock: big.NewInt(30), EIP1559Elasticity: 4},
+			head:    29,
+			wantErr: nil,
+		},
+		{
+			stored:  &ChainConfig{LondonBlock: big.NewInt(30)},
+			new:     &ChainConfig{LondonBlock: big.NewInt(30), EIP1559Elasticity: ElasticityMultiplier},
+			head:    40,
+			wantErr: nil,
+		},
+		{
+			stored: &ChainConfig{LondonBlock: big.NewInt(30)},
+			new:    &ChainConfig{LondonBlock: big.NewInt(30), EIP1559Elasticity: 4},
+			head:   40,
+			wantErr: &ConfigCompatError{
+				What:         "EIP1559 elasticity multiplier",
+				StoredConfig: big.NewInt(30),
+				NewConfig:    big.NewInt(30),
+				RewindTo:     29,
+			},
+		},
+		{
+			stored: &ChainConfig{LondonBlock: big.NewInt(30), EIP1559Denominator: 50},
+			new:    &ChainConfig{LondonBlock: big.NewInt(30)},
+			head:   40,
+			wantErr: &ConfigCompatError{
+				What:         "EIP1559 base fee change denominator",
+				StoredConfig: big.NewInt(30),
+				NewConfig:    big.NewInt(30),
+				RewindTo:     29,
+			},
+		},
 	}
 
 	for _, test := range tests {